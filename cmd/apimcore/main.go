@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -22,6 +27,7 @@ import (
 	"github.com/navantesolutions/apimcore/internal/admin"
 	"github.com/navantesolutions/apimcore/internal/devportal"
 	"github.com/navantesolutions/apimcore/internal/gateway"
+	"github.com/navantesolutions/apimcore/internal/handoff"
 	"github.com/navantesolutions/apimcore/internal/hub"
 	"github.com/navantesolutions/apimcore/internal/meter"
 	"github.com/navantesolutions/apimcore/internal/securitylog"
@@ -51,8 +57,8 @@ var devportalFS embed.FS
 var processStartTime = time.Now()
 
 type appFlags struct {
-	configPath string
-	hotReload  bool
+	configPath    string
+	hotReload     bool
 	useTUI        bool
 	useDB         bool
 	useFileLog    string
@@ -161,7 +167,7 @@ func setupPersistence(useDB bool, useFileLog string) (securitylog.Logger, string
 	return l, path
 }
 
-func setupMuxes(st *store.Store, gw *gateway.Gateway, reg *prometheus.Registry) (gatewayMux, serverMux *http.ServeMux) {
+func setupMuxes(st *store.Store, gw *gateway.Gateway, reg *prometheus.Registry, up *handoff.Upgrader) (gatewayMux, serverMux *http.ServeMux) {
 	gatewayMux = http.NewServeMux()
 	gatewayMux.Handle("/", gw)
 
@@ -171,28 +177,170 @@ func setupMuxes(st *store.Store, gw *gateway.Gateway, reg *prometheus.Registry)
 		_, _ = w.Write([]byte("OK"))
 	})
 	serverMux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
+		if ok, reason := gw.Ready(); !ok {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
 	serverMux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	admin.New(st, "/api/admin", gw).Register(serverMux)
+	adm := admin.New(st, "/api/admin", gw)
+	adm.Upgrade = up.Upgrade
+	adm.Register(serverMux)
 	devportal.New(st, "/devportal").Register(serverMux)
 	dpFS, _ := fs.Sub(devportalFS, "web/devportal")
 	serverMux.Handle("/devportal/", http.StripPrefix("/devportal", http.FileServer(http.FS(dpFS))))
 	return gatewayMux, serverMux
 }
 
-func runGateway(listen string, mux *http.ServeMux) {
-	log.Printf("apimcore gateway listening on %s", listen)
-	if err := http.ListenAndServe(listen, mux); err != nil {
+// runGateway starts the gateway server, and its HTTP redirect server when
+// configured, in the background. Listeners are inherited from the previous
+// process on upgrade.
+func runGateway(cfg config.GatewayConfig, mux *http.ServeMux, up *handoff.Upgrader) (srv, redirect *http.Server) {
+	srv, err := gateway.NewServer(cfg, mux)
+	if err != nil {
 		log.Fatalf("gateway: %v", err)
 	}
+	ln := listen(up, "gateway", cfg.Listen)
+	if cfg.TLS == nil {
+		log.Printf("apimcore gateway listening on %s", ln.Addr())
+		go serve("gateway", func() error { return srv.Serve(ln) })
+		return srv, nil
+	}
+	if redirect = gateway.NewRedirectServer(cfg); redirect != nil {
+		rln := listen(up, "redirect", redirect.Addr)
+		log.Printf("apimcore gateway redirecting HTTP on %s to HTTPS", rln.Addr())
+		go serve("gateway redirect", func() error { return redirect.Serve(rln) })
+	}
+	log.Printf("apimcore gateway listening on %s (TLS)", ln.Addr())
+	go serve("gateway", func() error { return srv.ServeTLS(ln, "", "") })
+	return srv, redirect
 }
 
-func runManagementServer(listen string, mux *http.ServeMux) {
-	log.Printf("apimcore server listening on %s (admin, devportal, metrics)", listen)
-	if err := http.ListenAndServe(listen, mux); err != nil {
-		log.Fatalf("server: %v", err)
+func runManagementServer(addr string, mux *http.ServeMux, up *handoff.Upgrader) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: mux}
+	ln := listen(up, "server", addr)
+	log.Printf("apimcore server listening on %s (admin, devportal, metrics)", ln.Addr())
+	go serve("server", func() error { return srv.Serve(ln) })
+	return srv
+}
+
+func listen(up *handoff.Upgrader, name, addr string) net.Listener {
+	ln, err := up.Listen(name, addr)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return ln
+}
+
+// serve runs a server until it fails, is shut down or hands its listener
+// over to a new process.
+func serve(name string, listenAndServe func() error) {
+	if err := listenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+// watchUpgrades upgrades the process on the upgrade signals, and calls
+// stop once a new process has taken over, whether through a signal or the
+// admin API.
+func watchUpgrades(up *handoff.Upgrader, stop func()) {
+	sig := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(sig, upgradeSignals...)
+		defer signal.Stop(sig)
+	}
+	for {
+		select {
+		case <-sig:
+			log.Printf("apimcore upgrading: starting a new process")
+			if err := up.Upgrade(); err != nil {
+				log.Printf("upgrade failed, still serving: %v", err)
+			}
+		case <-up.Upgraded():
+			log.Printf("apimcore upgraded: the new process took over the listeners")
+			stop()
+			return
+		}
+	}
+}
+
+// shutdown drains the gateway within the shutdown delay and timeout, then
+// stops the management server. Servers still busy at the deadline are
+// closed.
+func shutdown(cfg config.GatewayConfig, gw *gateway.Gateway, gatewaySrv, redirectSrv, serverSrv *http.Server) {
+	delay, timeout := gateway.ShutdownDelay(cfg), gateway.ShutdownTimeout(cfg)
+	if delay > 0 {
+		log.Printf("apimcore shutting down, failing readiness for %s before draining", delay)
+	}
+	log.Printf("apimcore shutting down, draining connections for up to %s", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), delay+timeout)
+	defer cancel()
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(ctx); err != nil {
+			_ = redirectSrv.Close()
+		}
+	}
+	if err := gw.Shutdown(ctx, gatewaySrv); err != nil {
+		log.Printf("gateway: drain incomplete, closing remaining connections: %v", err)
+		_ = gatewaySrv.Close()
+	}
+	if err := serverSrv.Shutdown(ctx); err != nil {
+		_ = serverSrv.Close()
+	}
+	gw.Close()
+}
+
+// runTrafficBatcher persists traffic events and forwards them to the TUI in
+// batches. Once stop is closed it handles the events still queued, then
+// closes done.
+func runTrafficBatcher(events <-chan hub.TrafficEvent, secLog, allTrafficLog securitylog.Logger, tuiTrafficChan chan []hub.TrafficEvent, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var batch []hub.TrafficEvent
+	flush := func() {
+		if tuiTrafficChan != nil && len(batch) > 0 {
+			tuiTrafficChan <- append([]hub.TrafficEvent(nil), batch...)
+			batch = nil
+		}
+	}
+	handle := func(ev hub.TrafficEvent) {
+		if secLog != nil && (ev.Action == "BLOCKED" || ev.Action == "RATE_LIMIT") {
+			secLog.Append(ev)
+		}
+		if allTrafficLog != nil {
+			allTrafficLog.Append(ev)
+		}
+		if tuiTrafficChan != nil {
+			batch = append(batch, ev)
+			if len(batch) >= TuiTrafficBatchSize {
+				flush()
+			}
+		}
+	}
+	ticker := time.NewTicker(TuiTrafficBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				flush()
+				return
+			}
+			handle(ev)
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			for {
+				select {
+				case ev := <-events:
+					handle(ev)
+				default:
+					flush()
+					return
+				}
+			}
+		}
 	}
 }
 
@@ -215,8 +363,7 @@ func runTUI(opts struct {
 	noConfigFile bool
 	hotReload    bool
 	trafficChan  chan []hub.TrafficEvent
-	serverMux    *http.ServeMux
-	serverListen string
+	shutdown     <-chan struct{}
 }) {
 	nodeID := os.Getenv(NodeIDEnv)
 	if nodeID == "" {
@@ -264,7 +411,8 @@ func runTUI(opts struct {
 			p.Send(hub.SystemStats{
 				TotalRequests: statsTotal, AvgLatency: avgLat,
 				RateLimited: rateLimited, Blocked: blocked,
-				Uptime: time.Since(processStartTime), CPUUsage: cpuPct,
+				ActiveConns: opts.gw.ActiveConns(),
+				Uptime:      time.Since(processStartTime), CPUUsage: cpuPct,
 				MemoryUsageMB: memUsedMB, MemoryTotalMB: memTotalMB,
 			})
 		}
@@ -278,16 +426,33 @@ func runTUI(opts struct {
 		}
 	}()
 
-	go runManagementServer(opts.serverListen, opts.serverMux)
+	go func() {
+		<-opts.shutdown
+		p.Quit()
+	}()
 
-	if _, err := p.Run(); err != nil {
-		fmt.Printf("Error running TUI: %v", err)
-		os.Exit(1)
+	_, err := p.Run()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Printf("Error running TUI: %v", err)
 	}
 }
 
 func main() {
 	flags := parseFlags()
+	up, err := handoff.New()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if flags.useTUI {
+		// The terminal belongs to this process's TUI until it exits; a new
+		// process started by an upgrade must not draw over it.
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		up.Output = devNull
+	}
 
 	cfg, noConfigFile := loadConfig(flags.configPath)
 	st := store.NewStore()
@@ -300,7 +465,6 @@ func main() {
 
 	secLog, secLogPath := setupPersistence(flags.useDB, flags.useFileLog)
 	if secLog != nil {
-		defer secLog.Close()
 		log.Printf("security events logged to %s", secLogPath)
 	}
 
@@ -311,7 +475,6 @@ func main() {
 		if err != nil {
 			log.Printf("file-log-all: %v", err)
 		} else {
-			defer allTrafficLog.Close()
 			log.Printf("all traffic logged to %s", flags.useFileLogAll)
 		}
 	}
@@ -320,39 +483,8 @@ func main() {
 	if flags.useTUI {
 		tuiTrafficChan = make(chan []hub.TrafficEvent, TuiTrafficBatchBuffer)
 	}
-	go func() {
-		var batch []hub.TrafficEvent
-		ticker := time.NewTicker(TuiTrafficBatchInterval)
-		for {
-			select {
-			case ev, ok := <-hb.TrafficChan():
-				if !ok {
-					if tuiTrafficChan != nil && len(batch) > 0 {
-						tuiTrafficChan <- append([]hub.TrafficEvent(nil), batch...)
-					}
-					return
-				}
-				if secLog != nil && (ev.Action == "BLOCKED" || ev.Action == "RATE_LIMIT") {
-					secLog.Append(ev)
-				}
-				if allTrafficLog != nil {
-					allTrafficLog.Append(ev)
-				}
-				if tuiTrafficChan != nil {
-					batch = append(batch, ev)
-					if len(batch) >= TuiTrafficBatchSize {
-						tuiTrafficChan <- append([]hub.TrafficEvent(nil), batch...)
-						batch = nil
-					}
-				}
-			case <-ticker.C:
-				if tuiTrafficChan != nil && len(batch) > 0 {
-					tuiTrafficChan <- append([]hub.TrafficEvent(nil), batch...)
-					batch = nil
-				}
-			}
-		}
-	}()
+	stopBatcher, batcherDone := make(chan struct{}), make(chan struct{})
+	go runTrafficBatcher(hb.TrafficChan(), secLog, allTrafficLog, tuiTrafficChan, stopBatcher, batcherDone)
 
 	if flags.hotReload {
 		go func() {
@@ -378,8 +510,18 @@ func main() {
 		}()
 	}
 
-	gatewayMux, serverMux := setupMuxes(st, gw, reg)
-	go runGateway(cfg.Gateway.Listen, gatewayMux)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	gatewayMux, serverMux := setupMuxes(st, gw, reg, up)
+	gatewaySrv, redirectSrv := runGateway(cfg.Gateway, gatewayMux, up)
+	serverSrv := runManagementServer(cfg.Server.Listen, serverMux, up)
+	if err := up.Ready(); err != nil {
+		log.Printf("upgrade: could not notify the previous process: %v", err)
+	}
+	ctx, upgraded := context.WithCancel(ctx)
+	defer upgraded()
+	go watchUpgrades(up, upgraded)
 
 	if flags.useTUI {
 		runTUI(struct {
@@ -392,14 +534,25 @@ func main() {
 			noConfigFile bool
 			hotReload    bool
 			trafficChan  chan []hub.TrafficEvent
-			serverMux    *http.ServeMux
-			serverListen string
+			shutdown     <-chan struct{}
 		}{
 			cfg: cfg, st: st, gw: gw, hb: hb, m: m,
 			configPath: flags.configPath, noConfigFile: noConfigFile, hotReload: flags.hotReload,
-			trafficChan: tuiTrafficChan, serverMux: serverMux, serverListen: cfg.Server.Listen,
+			trafficChan: tuiTrafficChan, shutdown: ctx.Done(),
 		})
 	} else {
-		runManagementServer(cfg.Server.Listen, serverMux)
+		<-ctx.Done()
+	}
+	stop()
+
+	shutdown(cfg.Gateway, gw, gatewaySrv, redirectSrv, serverSrv)
+	close(stopBatcher)
+	<-batcherDone
+	if secLog != nil {
+		_ = secLog.Close()
+	}
+	if allTrafficLog != nil {
+		_ = allTrafficLog.Close()
 	}
+	log.Printf("apimcore stopped")
 }
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals trigger a zero-downtime upgrade.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
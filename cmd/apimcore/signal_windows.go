@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// upgradeSignals trigger a zero-downtime upgrade; Windows has none.
+var upgradeSignals []os.Signal
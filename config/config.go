@@ -23,8 +23,87 @@ type Config struct {
 }
 
 type GatewayConfig struct {
-	Listen               string `yaml:"listen"`
-	BackendTimeoutSeconds int    `yaml:"backend_timeout_seconds"`
+	Listen                 string               `yaml:"listen"`
+	BackendTimeoutSeconds  int                  `yaml:"backend_timeout_seconds"`
+	RetryBudget            RetryBudgetConfig    `yaml:"retry_budget"`
+	Timeouts               TimeoutsConfig       `yaml:"timeouts"`
+	ConnectionPool         ConnectionPoolConfig `yaml:"connection_pool"`
+	H2C                    bool                 `yaml:"h2c"`
+	TLS                    *TLSConfig           `yaml:"tls"`
+	ShutdownTimeoutSeconds int                  `yaml:"shutdown_timeout_seconds"`
+	ShutdownDelaySeconds   int                  `yaml:"shutdown_delay_seconds"`
+	Cache                  ResponseCacheConfig  `yaml:"cache"`
+}
+
+// ResponseCacheConfig sizes the in-memory response cache shared by the APIs
+// with a cache block. The least recently used responses are evicted beyond
+// MaxSizeMB (default 64); responses larger than MaxEntrySizeKB (default
+// 1024) are not stored.
+type ResponseCacheConfig struct {
+	MaxSizeMB      int `yaml:"max_size_mb"`
+	MaxEntrySizeKB int `yaml:"max_entry_size_kb"`
+}
+
+// TLSConfig terminates TLS on the gateway listener. The certificate of a
+// connection is selected by SNI among Certificates; the first one is used
+// when no name matches. MinVersion is "1.0" to "1.3" (default "1.2");
+// CipherSuites restricts the TLS 1.2 suites by their Go names. Certificate
+// files are checked for changes every ReloadIntervalSeconds (default 30).
+// RedirectListen, when set, serves plain HTTP redirects to HTTPS.
+// ClientCAFiles are PEM bundles trusted to verify client certificates for
+// mutual TLS; clients without a certificate are still accepted.
+type TLSConfig struct {
+	Certificates          []CertificateConfig `yaml:"certificates"`
+	MinVersion            string              `yaml:"min_version"`
+	CipherSuites          []string            `yaml:"cipher_suites"`
+	ReloadIntervalSeconds int                 `yaml:"reload_interval_seconds"`
+	RedirectListen        string              `yaml:"redirect_listen"`
+	ClientCAFiles         []string            `yaml:"client_ca_files"`
+}
+
+// CertificateConfig is a PEM certificate chain and key. Hosts lists the
+// server names it serves, "*.example.com" wildcards included; by default
+// the DNS names of the certificate are used.
+type CertificateConfig struct {
+	CertFile string   `yaml:"cert_file"`
+	KeyFile  string   `yaml:"key_file"`
+	Hosts    []string `yaml:"hosts"`
+}
+
+// ConnectionPoolConfig tunes the backend connections of an API, each of
+// which owns its own pool. MaxIdleConns and MaxIdleConnsPerHost default to
+// 100 and 32, MaxConnsPerHost is unlimited by default and KeepAliveSeconds
+// (TCP keep-alive) defaults to 30. APIs inherit the gateway values they
+// leave at zero.
+type ConnectionPoolConfig struct {
+	MaxIdleConns        int  `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int  `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int  `yaml:"max_conns_per_host"`
+	KeepAliveSeconds    int  `yaml:"keep_alive_seconds"`
+	DisableKeepAlives   bool `yaml:"disable_keep_alives"`
+}
+
+// TimeoutsConfig bounds the phases of a backend request. DialSeconds,
+// TLSHandshakeSeconds and IdleSeconds default to 30, 10 and 90;
+// ResponseHeaderSeconds is unlimited by default. TotalSeconds covers the
+// whole request, retries and response body included, and defaults to
+// backend_timeout_seconds. APIs inherit the gateway values they leave at
+// zero.
+type TimeoutsConfig struct {
+	DialSeconds           int `yaml:"dial_seconds"`
+	TLSHandshakeSeconds   int `yaml:"tls_handshake_seconds"`
+	ResponseHeaderSeconds int `yaml:"response_header_seconds"`
+	IdleSeconds           int `yaml:"idle_seconds"`
+	TotalSeconds          int `yaml:"total_seconds"`
+}
+
+// RetryBudgetConfig limits retries across all APIs: within each window,
+// retries may not exceed Ratio times the number of requests, with a floor of
+// MinRetriesPerSecond. Defaults: ratio 0.2, 10 retries/s, 10s window.
+type RetryBudgetConfig struct {
+	Ratio               float64 `yaml:"ratio"`
+	MinRetriesPerSecond int     `yaml:"min_retries_per_second"`
+	WindowSeconds       int     `yaml:"window_seconds"`
 }
 
 type ServerConfig struct {
@@ -39,23 +118,238 @@ type ProductConfig struct {
 }
 
 type ApiConfig struct {
-	Name            string            `yaml:"name"`
-	Host            string            `yaml:"host"`
-	PathPrefix      string            `yaml:"path_prefix"`
-	BackendURL      string            `yaml:"target_url"`
-	OpenAPISpecURL  string            `yaml:"openapi_spec_url"`
-	Version         string            `yaml:"version"`
-	AddHeaders      map[string]string  `yaml:"add_headers"`
-	StripPathPrefix bool              `yaml:"strip_path_prefix"`
+	Name            string                `yaml:"name"`
+	Host            string                `yaml:"host"`
+	PathPrefix      string                `yaml:"path_prefix"`
+	BackendURL      string                `yaml:"target_url"`
+	OpenAPISpecURL  string                `yaml:"openapi_spec_url"`
+	Version         string                `yaml:"version"`
+	AddHeaders      map[string]string     `yaml:"add_headers"`
+	StripPathPrefix bool                  `yaml:"strip_path_prefix"`
+	Path            string                `yaml:"path"`
+	Methods         []string              `yaml:"methods"`
+	RewritePath     string                `yaml:"rewrite_path"`
+	Upstreams       []UpstreamConfig      `yaml:"upstreams"`
+	LoadBalancing   LoadBalancingConfig   `yaml:"load_balancing"`
+	HealthCheck     *HealthCheckConfig    `yaml:"health_check"`
+	CircuitBreaker  *CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Retry           *RetryConfig          `yaml:"retry"`
+	Canary          *CanaryConfig         `yaml:"canary"`
+	Deprecation     *DeprecationConfig    `yaml:"deprecation"`
+	Mirror          *MirrorConfig         `yaml:"mirror"`
+	Rewrite         *RewriteConfig        `yaml:"rewrite"`
+	Response        *ResponseConfig       `yaml:"response"`
+	Timeouts        *TimeoutsConfig       `yaml:"timeouts"`
+	ConnectionPool  *ConnectionPoolConfig `yaml:"connection_pool"`
+	Protocol        string                `yaml:"protocol"`
+	Transcoding     *TranscodingConfig    `yaml:"transcoding"`
+	WebSocket       *WebSocketConfig      `yaml:"websocket"`
+	Streaming       bool                  `yaml:"streaming"`
+	FlushIntervalMs int                   `yaml:"flush_interval_ms"`
+	MTLS            string                `yaml:"mtls"`
+	UpstreamTLS     *UpstreamTLSConfig    `yaml:"upstream_tls"`
+	Cache           *CacheConfig          `yaml:"cache"`
+	Compression     *CompressionConfig    `yaml:"compression"`
+}
+
+// UpstreamConfig is one backend of an API. Weight defaults to 1.
+type UpstreamConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+// LoadBalancingConfig selects how requests are spread across upstreams.
+// Strategy is one of round_robin (default), weighted, least_requests,
+// random_two_choices or consistent_hash. HashOn is "ip" (default) or
+// "header:<name>" and only applies to consistent_hash.
+type LoadBalancingConfig struct {
+	Strategy string `yaml:"strategy"`
+	HashOn   string `yaml:"hash_on"`
+}
+
+// HealthCheckConfig enables active health checks on every upstream of an
+// API. Zero values fall back to the gateway defaults: path "/", any 2xx
+// status, every 10s with a 2s timeout, 2 successes to recover and 3
+// failures to remove a target from rotation.
+type HealthCheckConfig struct {
+	Path               string `yaml:"path"`
+	ExpectedStatus     int    `yaml:"expected_status"`
+	IntervalSeconds    int    `yaml:"interval_seconds"`
+	TimeoutSeconds     int    `yaml:"timeout_seconds"`
+	HealthyThreshold   int    `yaml:"healthy_threshold"`
+	UnhealthyThreshold int    `yaml:"unhealthy_threshold"`
+}
+
+// CircuitBreakerConfig enables a circuit breaker on every upstream of an
+// API. The circuit opens after ConsecutiveFailures failures in a row, or
+// when at least MinRequests requests were seen in the current window and
+// the share of failures reaches ErrorRateThreshold (0-1). A zero
+// ConsecutiveFailures or ErrorRateThreshold disables that trigger. Failures
+// are transport errors, timeouts and 5xx responses.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int     `yaml:"consecutive_failures"`
+	ErrorRateThreshold  float64 `yaml:"error_rate_threshold"`
+	MinRequests         int     `yaml:"min_requests"`
+	WindowSeconds       int     `yaml:"window_seconds"`
+	OpenSeconds         int     `yaml:"open_seconds"`
+	HalfOpenRequests    int     `yaml:"half_open_requests"`
+}
+
+// RetryConfig enables retries for an API. Attempts counts the first try;
+// values below 2 disable retries. RetryOnStatus defaults to 502, 503 and 504
+// and RetryOnErrors to connect_failure and reset (timeout is also
+// accepted). Only idempotent methods are retried unless RetryNonIdempotent
+// is set. Request bodies up to MaxBodyBytes (default 1 MiB) are buffered
+// for replay; larger bodies are sent once.
+type RetryConfig struct {
+	Attempts           int      `yaml:"attempts"`
+	RetryOnStatus      []int    `yaml:"retry_on_status"`
+	RetryOnErrors      []string `yaml:"retry_on_errors"`
+	RetryNonIdempotent bool     `yaml:"retry_non_idempotent"`
+	BackoffBaseMs      int      `yaml:"backoff_base_ms"`
+	BackoffMaxMs       int      `yaml:"backoff_max_ms"`
+	MaxBodyBytes       int64    `yaml:"max_body_bytes"`
+}
+
+// CanaryConfig routes part of the traffic of an API to this version. It
+// applies to an API declared after another version of the same host, path
+// and methods. A request goes to this version when it carries all Headers,
+// or its subscription matches Plans, Tenants or Developers; otherwise
+// Weight percent of consumers are assigned to it, sticky per API key.
+type CanaryConfig struct {
+	Weight     int               `yaml:"weight"`
+	Headers    map[string]string `yaml:"headers"`
+	Plans      []string          `yaml:"plans"`
+	Tenants    []string          `yaml:"tenants"`
+	Developers []string          `yaml:"developers"`
+}
+
+// DeprecationConfig marks an API version as deprecated. Responses carry a
+// Deprecation header (the Date when set), a Sunset header when Sunset is set
+// and a Link to the migration guide. Dates use the YYYY-MM-DD format.
+type DeprecationConfig struct {
+	Date   string `yaml:"date"`
+	Sunset string `yaml:"sunset"`
+	Link   string `yaml:"link"`
+}
+
+// MirrorConfig copies Percentage percent (default 100) of the requests of an
+// API to a shadow backend at URL. Shadow responses are discarded; their
+// status and latency are recorded next to the primary ones and, when
+// Compare is set, response bodies up to MaxBodyBytes (default 1 MiB) are
+// compared. Requests with a larger body are not mirrored.
+type MirrorConfig struct {
+	URL            string  `yaml:"url"`
+	Percentage     float64 `yaml:"percentage"`
+	Compare        bool    `yaml:"compare"`
+	TimeoutSeconds int     `yaml:"timeout_seconds"`
+	MaxBodyBytes   int64   `yaml:"max_body_bytes"`
+}
+
+// RewriteConfig transforms requests before they are sent to the backend:
+// the first Path rule whose regex matches rewrites the path (with $1 or
+// ${name} capture groups), then RequestHeaders rules apply, then AddQuery
+// parameters are appended. Values may use {client_ip}, {tenant_id},
+// {subscription_id}, {request_id}, {claim.<name>} and path parameters.
+type RewriteConfig struct {
+	Path           []PathRewriteConfig `yaml:"path"`
+	RequestHeaders HeaderRulesConfig   `yaml:"request_headers"`
+	AddQuery       map[string]string   `yaml:"add_query"`
+}
+
+type PathRewriteConfig struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+// HeaderRulesConfig renames, removes, sets and adds headers, in that order.
+type HeaderRulesConfig struct {
+	Rename map[string]string `yaml:"rename"`
+	Remove []string          `yaml:"remove"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// ResponseConfig transforms backend responses: StatusMap remaps status
+// codes, RewriteLocation points Location headers aimed at a backend host
+// back to the public host, then Headers rules apply.
+type ResponseConfig struct {
+	Headers         HeaderRulesConfig `yaml:"headers"`
+	RewriteLocation bool              `yaml:"rewrite_location"`
+	StatusMap       map[int]int       `yaml:"status_map"`
+}
+
+// TranscodingConfig exposes the methods of a gRPC API as REST/JSON
+// endpoints. DescriptorSet is a file written by protoc
+// --include_imports --descriptor_set_out; methods are bound through their
+// google.api.http annotations. Services restricts the exposed services
+// (fully qualified names); all services are exposed by default.
+type TranscodingConfig struct {
+	DescriptorSet string   `yaml:"descriptor_set"`
+	Services      []string `yaml:"services"`
+}
+
+// WebSocketConfig tunes the WebSocket connections of an API. Upgrade
+// requests prefer an API declaring this block over other APIs on the same
+// route. Connections idle for IdleTimeoutSeconds are closed (default 300);
+// MaxConnectionsPerSubscription bounds the connections a subscription keeps
+// open on the API at once (0 means no limit).
+type WebSocketConfig struct {
+	IdleTimeoutSeconds            int `yaml:"idle_timeout_seconds"`
+	MaxConnectionsPerSubscription int `yaml:"max_connections_per_subscription"`
+}
+
+// UpstreamTLSConfig sets how the gateway connects to https upstreams:
+// CAFiles replaces the system roots, CertFile and KeyFile are presented as
+// the client certificate, and ServerName overrides the name sent in SNI and
+// verified in the upstream certificate. InsecureSkipVerify disables
+// verification entirely and is meant for labs only. The files are reloaded
+// when they change.
+type UpstreamTLSConfig struct {
+	CAFiles            []string `yaml:"ca_files"`
+	CertFile           string   `yaml:"cert_file"`
+	KeyFile            string   `yaml:"key_file"`
+	ServerName         string   `yaml:"server_name"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+}
+
+// CacheConfig enables the response cache of an API. GET responses are
+// stored for as long as their Cache-Control or Expires headers allow, or
+// DefaultTTLSeconds when they set no lifetime (0: not stored), capped at
+// MaxTTLSeconds when set. Scope partitions the cache by "subscription"
+// (default), "tenant", or "shared" between all consumers; KeyHeaders adds
+// request headers to the cache key.
+type CacheConfig struct {
+	DefaultTTLSeconds int      `yaml:"default_ttl_seconds"`
+	MaxTTLSeconds     int      `yaml:"max_ttl_seconds"`
+	Scope             string   `yaml:"scope"`
+	KeyHeaders        []string `yaml:"key_headers"`
+}
+
+// CompressionConfig compresses the responses of an API for clients that
+// accept it. Encodings lists the encodings offered, by preference, among
+// "zstd", "br" and "gzip" (default all three, in that order). Responses
+// smaller than MinSizeBytes (default 1024) are sent as is. ContentTypes
+// lists the media types compressed, "*" wildcards included (default text,
+// JSON, XML, JavaScript and SVG). DecompressRequests decodes request bodies
+// sent with one of these encodings before they reach the backend, up to
+// MaxDecompressedBytes (default 10 MiB) of decoded content.
+type CompressionConfig struct {
+	Encodings            []string `yaml:"encodings"`
+	MinSizeBytes         int      `yaml:"min_size_bytes"`
+	ContentTypes         []string `yaml:"content_types"`
+	DecompressRequests   bool     `yaml:"decompress_requests"`
+	MaxDecompressedBytes int64    `yaml:"max_decompressed_bytes"`
 }
 
 type SubscriptionConfig struct {
-	DeveloperID string      `yaml:"developer_id"`
-	ProductID   int64       `yaml:"product_id"`
-	ProductSlug string      `yaml:"product_slug"`
-	TenantID    string      `yaml:"tenant_id"`
-	Plan        string      `yaml:"plan"`
-	Keys        []KeyConfig `yaml:"keys"`
+	DeveloperID        string                    `yaml:"developer_id"`
+	ProductID          int64                     `yaml:"product_id"`
+	ProductSlug        string                    `yaml:"product_slug"`
+	TenantID           string                    `yaml:"tenant_id"`
+	Plan               string                    `yaml:"plan"`
+	Keys               []KeyConfig               `yaml:"keys"`
+	ClientCertificates []ClientCertificateConfig `yaml:"client_certificates"`
 }
 
 type KeyConfig struct {
@@ -63,6 +357,17 @@ type KeyConfig struct {
 	Value string `yaml:"value"`
 }
 
+// ClientCertificateConfig identifies the client certificates of a
+// subscription for mutual TLS by SHA-256 Fingerprint (hex, colons
+// allowed), Subject (e.g. "CN=partner,O=Acme") or one of its SANs (DNS
+// name, email, URI or IP). The first field set is used.
+type ClientCertificateConfig struct {
+	Name        string `yaml:"name"`
+	Fingerprint string `yaml:"fingerprint"`
+	Subject     string `yaml:"subject"`
+	SAN         string `yaml:"san"`
+}
+
 type DevPortalConfig struct {
 	Enabled bool   `yaml:"enabled"`
 	Path    string `yaml:"path"`
@@ -13,7 +13,11 @@ import (
 	"github.com/navantesolutions/apimcore/internal/store"
 )
 
+// Handler serves the admin API. Upgrade, when set, starts a zero-downtime
+// upgrade of the process.
 type Handler struct {
+	Upgrade func() error
+
 	store   *store.Store
 	prefix  string
 	gateway *gateway.Gateway
@@ -34,6 +38,10 @@ func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc(h.prefix+"/keys/", h.keyByID)
 	mux.HandleFunc(h.prefix+"/usage", h.usage)
 	mux.HandleFunc(h.prefix+"/metrics/summary", h.metricsSummary)
+	mux.HandleFunc(h.prefix+"/health/upstreams", h.upstreamHealth)
+	mux.HandleFunc(h.prefix+"/mirror", h.mirrorResults)
+	mux.HandleFunc(h.prefix+"/upgrade", h.upgrade)
+	mux.HandleFunc(h.prefix+"/cache", h.cachePurge)
 }
 
 func writeJSON(w http.ResponseWriter, v any) {
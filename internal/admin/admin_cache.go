@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// cachePurge removes cached responses by request path prefix. Query
+// parameters: prefix (required, "/" purges everything) and api to limit
+// the purge to one API by name.
+func (h *Handler) cachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.gateway == nil {
+		http.Error(w, "gateway not available", http.StatusServiceUnavailable)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		http.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"purged": h.gateway.PurgeCache(r.URL.Query().Get("api"), prefix),
+	})
+}
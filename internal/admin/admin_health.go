@@ -0,0 +1,22 @@
+package admin
+
+import (
+	"net/http"
+)
+
+func (h *Handler) upstreamHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.gateway == nil {
+		http.Error(w, "gateway not available", http.StatusServiceUnavailable)
+		return
+	}
+	ready, reason := h.gateway.Ready()
+	writeJSON(w, map[string]any{
+		"ready":     ready,
+		"reason":    reason,
+		"upstreams": h.gateway.UpstreamHealth(),
+	})
+}
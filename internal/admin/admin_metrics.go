@@ -27,6 +27,11 @@ func (h *Handler) metricsSummary(w http.ResponseWriter, r *http.Request) {
 	rpsByRoute := h.store.RPSByRouteSince(since)
 	usageByVersion := h.store.UsageByVersionSince(since)
 	avgBackendMs, avgGatewayMs, backendCount := h.store.AvgBackendVsGatewaySince(since)
+	responseBytes, sentBytes, _ := h.store.ResponseBytesSince(since)
+	var savedRatio float64
+	if responseBytes > 0 {
+		savedRatio = 1 - float64(sentBytes)/float64(responseBytes)
+	}
 
 	byTenant := make(map[string]int64)
 	for _, tenantID := range h.store.UniqueTenantIDs() {
@@ -56,5 +61,10 @@ func (h *Handler) metricsSummary(w http.ResponseWriter, r *http.Request) {
 			"avg_gateway_ms":  avgGatewayMs,
 			"requests_with_backend_latency": backendCount,
 		},
+		"response_bytes": map[string]any{
+			"before_compression": responseBytes,
+			"sent":               sentBytes,
+			"saved_ratio":        savedRatio,
+		},
 	})
 }
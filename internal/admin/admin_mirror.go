@@ -0,0 +1,77 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+const defaultMirrorHours = 1
+
+type mirrorSummary struct {
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	StatusMismatches int     `json:"status_mismatches"`
+	Compared         int     `json:"compared"`
+	Diffs            int     `json:"diffs"`
+	AvgPrimaryMs     float64 `json:"avg_primary_ms"`
+	AvgShadowMs      float64 `json:"avg_shadow_ms"`
+}
+
+// mirrorResults lists shadow request results and summarizes them per API.
+// Query parameters: hours (default 1) and api to filter by API name.
+func (h *Handler) mirrorResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hours := defaultMirrorHours
+	if s := r.URL.Query().Get("hours"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			hours = v
+		}
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+	api := r.URL.Query().Get("api")
+
+	results := make([]store.MirrorResult, 0)
+	summary := make(map[string]*mirrorSummary)
+	for _, m := range h.store.MirrorResultsSince(since) {
+		if api != "" && m.Api != api {
+			continue
+		}
+		results = append(results, m)
+		s := summary[m.Api]
+		if s == nil {
+			s = &mirrorSummary{}
+			summary[m.Api] = s
+		}
+		s.Requests++
+		s.AvgPrimaryMs += float64(m.PrimaryMs)
+		s.AvgShadowMs += float64(m.ShadowMs)
+		switch {
+		case m.Error != "":
+			s.Errors++
+		case m.PrimaryStatus != m.ShadowStatus:
+			s.StatusMismatches++
+		}
+		if m.Compared {
+			s.Compared++
+			if m.Diff != "" {
+				s.Diffs++
+			}
+		}
+	}
+	for _, s := range summary {
+		s.AvgPrimaryMs /= float64(s.Requests)
+		s.AvgShadowMs /= float64(s.Requests)
+	}
+	writeJSON(w, map[string]any{
+		"window_hours": hours,
+		"total":        len(results),
+		"summary":      summary,
+		"results":      results,
+	})
+}
@@ -0,0 +1,23 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// upgrade hands the listeners over to a new apimcore process, which then
+// serves the traffic while this one drains and exits.
+func (h *Handler) upgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Upgrade == nil {
+		http.Error(w, "upgrade not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err := h.Upgrade(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{"upgraded": true})
+}
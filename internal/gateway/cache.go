@@ -0,0 +1,645 @@
+package gateway
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+const (
+	DefaultCacheMaxSizeMB      = 64
+	DefaultCacheMaxEntrySizeKB = 1024
+
+	CacheScopeSubscription = "subscription"
+	CacheScopeTenant       = "tenant"
+	CacheScopeShared       = "shared"
+
+	// HeaderCache tells clients how the response cache served a request.
+	HeaderCache = "X-Cache"
+)
+
+// Results of the response cache, reported in the X-Cache header, the Cache
+// field of traffic events and the apim_cache_requests_total metric.
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+	CacheBypass      = "BYPASS"
+)
+
+// Statuses stored without an explicit lifetime (RFC 9111 heuristically
+// cacheable responses).
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cachePolicy is the compiled cache block of an API.
+type cachePolicy struct {
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	scope      string
+	keyHeaders []string
+}
+
+func newCachePolicy(d *store.ApiDefinition) (*cachePolicy, error) {
+	cfg := d.Cache
+	if cfg == nil {
+		return nil, nil
+	}
+	if d.Streaming {
+		return nil, errors.New("cache cannot be combined with streaming")
+	}
+	if strings.EqualFold(d.Protocol, ProtocolGRPC) {
+		return nil, errors.New("cache cannot be combined with protocol grpc")
+	}
+	if cfg.DefaultTTLSeconds < 0 || cfg.MaxTTLSeconds < 0 {
+		return nil, errors.New("cache: ttl cannot be negative")
+	}
+	p := &cachePolicy{
+		defaultTTL: time.Duration(cfg.DefaultTTLSeconds) * time.Second,
+		maxTTL:     time.Duration(cfg.MaxTTLSeconds) * time.Second,
+		scope:      strings.ToLower(cfg.Scope),
+	}
+	switch p.scope {
+	case "":
+		p.scope = CacheScopeSubscription
+	case CacheScopeSubscription, CacheScopeTenant, CacheScopeShared:
+	default:
+		return nil, errors.New("cache: scope must be subscription, tenant or shared, got " + strconv.Quote(cfg.Scope))
+	}
+	for _, h := range cfg.KeyHeaders {
+		p.keyHeaders = append(p.keyHeaders, http.CanonicalHeaderKey(h))
+	}
+	return p, nil
+}
+
+// key returns the cache key of a request before Vary is applied: the API,
+// its selected version and route, the partition of the consumer, the host,
+// the URL and the key headers. It reports false when the request carries
+// credentials but its subscription or tenant, as the scope requires, is
+// unknown: such requests must not share the anonymous partition.
+func (p *cachePolicy) key(def *store.ApiDefinition, r *http.Request, sub *store.Subscription) (string, bool) {
+	partition := ""
+	switch p.scope {
+	case CacheScopeShared:
+	case CacheScopeTenant:
+		if tenant := requestTenant(r, sub); tenant != "" {
+			partition = "tenant:" + tenant
+		}
+	default:
+		if sub != nil {
+			partition = "sub:" + strconv.FormatInt(sub.ID, 10)
+		}
+	}
+	if partition == "" && p.scope != CacheScopeShared && (sub != nil || r.Header.Get("Authorization") != "") {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(def.Name)
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatInt(def.ID, 10))
+	b.WriteByte(0)
+	b.WriteString(def.Version)
+	b.WriteByte(0)
+	b.WriteString(strings.ToLower(def.Host) + def.Route())
+	b.WriteByte(0)
+	b.WriteString(partition)
+	b.WriteByte(0)
+	b.WriteString(strings.ToLower(r.Host))
+	b.WriteString(r.URL.RequestURI())
+	for _, h := range p.keyHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String(), true
+}
+
+// lifetime returns how long a response may be served from the cache, and
+// whether it may be stored at all. A zero lifetime with a validator is
+// stored and revalidated on every use.
+func (p *cachePolicy) lifetime(status int, h http.Header, authorized bool, now time.Time) (time.Duration, bool) {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	switch {
+	case !cacheableStatus[status]:
+		return 0, false
+	case cc.has("no-store"), cc.has("private"):
+		return 0, false
+	case authorized && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return 0, false
+	case h.Get("Set-Cookie") != "", h.Get("Trailer") != "":
+		return 0, false
+	case strings.TrimSpace(h.Get("Vary")) == "*":
+		return 0, false
+	}
+
+	var ttl time.Duration
+	explicit := true
+	if v, ok := cc.seconds("s-maxage"); ok {
+		ttl = v
+	} else if v, ok := cc.seconds("max-age"); ok {
+		ttl = v
+	} else if e := h.Get("Expires"); e != "" {
+		// An invalid Expires, such as "0", means already expired.
+		if exp, err := http.ParseTime(e); err == nil {
+			date := now
+			if d, err := http.ParseTime(h.Get("Date")); err == nil {
+				date = d
+			}
+			ttl = exp.Sub(date)
+		}
+	} else {
+		ttl, explicit = p.defaultTTL, false
+	}
+	if explicit {
+		if age, err := strconv.Atoi(h.Get("Age")); err == nil && age > 0 {
+			ttl -= time.Duration(age) * time.Second
+		}
+	}
+	if cc.has("no-cache") || ttl < 0 {
+		ttl = 0
+	}
+	if p.maxTTL > 0 && ttl > p.maxTTL {
+		ttl = p.maxTTL
+	}
+	if ttl == 0 && h.Get("Etag") == "" && h.Get("Last-Modified") == "" {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// cacheControl holds the directives of Cache-Control headers by lower-case
+// name.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheEntry is a stored response. Its key includes the request headers
+// named by the Vary header of the response.
+type cacheEntry struct {
+	key     string
+	primary string
+	api     string
+	path    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	size    int64
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// responseCache is the in-memory LRU cache shared by every API. Sizes count
+// the bodies, headers and keys of the entries. The Vary header names of the
+// last response stored for a primary key select its variants.
+type responseCache struct {
+	mu       sync.Mutex
+	maxSize  int64
+	maxEntry int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	vary     map[string][]string
+	variants map[string]int
+}
+
+func newResponseCache(cfg config.ResponseCacheConfig) *responseCache {
+	c := &responseCache{
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		vary:     make(map[string][]string),
+		variants: make(map[string]int),
+	}
+	c.resize(cfg)
+	return c
+}
+
+// resize applies new size limits, evicting entries beyond the new maximum.
+func (c *responseCache) resize(cfg config.ResponseCacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = int64(cfg.MaxSizeMB) << 20
+	if c.maxSize <= 0 {
+		c.maxSize = DefaultCacheMaxSizeMB << 20
+	}
+	c.maxEntry = int64(cfg.MaxEntrySizeKB) << 10
+	if c.maxEntry <= 0 {
+		c.maxEntry = DefaultCacheMaxEntrySizeKB << 10
+	}
+	c.evict()
+}
+
+// variantKey extends a primary key with the request headers named by vary.
+func variantKey(primary string, vary []string, h http.Header) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\x00" + name + "=" + strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the canonical request header names of a Vary header.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// get returns the entry matching a request, fresh or not.
+func (c *responseCache) get(primary string, h http.Header) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[variantKey(primary, c.vary[primary], h)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put stores a response for the request headers reqHeader, replacing the
+// entry with the same key. Responses too large for the cache are dropped.
+func (c *responseCache) put(e *cacheEntry, reqHeader http.Header) {
+	vary := varyHeaders(e.header)
+	e.key = variantKey(e.primary, vary, reqHeader)
+	e.size = int64(len(e.body) + len(e.key))
+	for k, vv := range e.header {
+		e.size += int64(len(k))
+		for _, v := range vv {
+			e.size += int64(len(v))
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	if e.size > c.maxEntry {
+		return
+	}
+	c.vary[e.primary] = vary
+	c.variants[e.primary]++
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+	c.evict()
+}
+
+// delete removes the entries of a primary key, whatever their variant.
+func (c *responseCache) delete(primary string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).primary == primary {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// purge removes the entries whose request path starts with prefix, limited
+// to the API named api when it is not empty, and returns how many were
+// removed.
+func (c *responseCache) purge(api, prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*cacheEntry)
+		if (api == "" || e.api == api) && strings.HasPrefix(e.path, prefix) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// evict removes the least recently used entries beyond the maximum size.
+// Callers hold c.mu.
+func (c *responseCache) evict() {
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry. Callers hold c.mu.
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	if c.variants[e.primary]--; c.variants[e.primary] == 0 {
+		delete(c.variants, e.primary)
+		delete(c.vary, e.primary)
+	}
+}
+
+// PurgeCache removes the cached responses whose request path starts with
+// prefix, for the API named api or every API when api is empty. It returns
+// the number of responses removed.
+func (g *Gateway) PurgeCache(api, prefix string) int {
+	return g.cache.purge(api, prefix)
+}
+
+// serveCached serves a GET or HEAD request of an API with a cache block from
+// the cache when a fresh response is stored, and otherwise through the
+// proxy of rt, revalidating the stored response when it has a validator
+// and storing the new one when allowed. Successful unsafe requests
+// invalidate the response stored for their URL. It returns the cache
+// result of the request.
+func (g *Gateway) serveCached(w *responseRecorder, r *http.Request, rt *route, sub *store.Subscription, path string) string {
+	p := rt.cache
+	primary, partitioned := p.key(rt.def, r, sub)
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || reqCC.has("no-store") || !partitioned {
+		w.Header().Set(HeaderCache, CacheBypass)
+		rt.proxy.ServeHTTP(w, r)
+		if partitioned && r.Method != http.MethodGet && r.Method != http.MethodHead && w.status < 400 {
+			g.cache.delete(primary)
+		}
+		return CacheBypass
+	}
+	now := time.Now()
+	entry := g.cache.get(primary, r.Header)
+	maxAge, hasMaxAge := reqCC.seconds("max-age")
+	revalidate := reqCC.has("no-cache") || (hasMaxAge && maxAge == 0)
+	if entry != nil && entry.fresh(now) && !revalidate {
+		writeCached(w, r, entry, CacheHit, now)
+		return CacheHit
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, header: make(http.Header), limit: g.cache.maxEntrySize()}
+	var clientETag, clientSince string
+	if entry != nil {
+		clientETag, clientSince = r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+		etag, modified := entry.header.Get("Etag"), entry.header.Get("Last-Modified")
+		if etag != "" || modified != "" {
+			cw.revalidating = true
+			r.Header.Del("If-None-Match")
+			r.Header.Del("If-Modified-Since")
+			if etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			if modified != "" {
+				r.Header.Set("If-Modified-Since", modified)
+			}
+		}
+	}
+	w.Header().Set(HeaderCache, CacheMiss)
+	rt.proxy.ServeHTTP(cw, r)
+	cw.finish()
+
+	authorized := r.Header.Get("Authorization") != ""
+	now = time.Now()
+	if cw.notModified {
+		// Restore the conditions of the client, which the response to
+		// this request answers instead of those of the gateway.
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+		if clientETag != "" {
+			r.Header.Set("If-None-Match", clientETag)
+		}
+		if clientSince != "" {
+			r.Header.Set("If-Modified-Since", clientSince)
+		}
+		updated := *entry
+		updated.header = entry.header.Clone()
+		for k, v := range cw.header {
+			if k != "Content-Length" {
+				updated.header[k] = v
+			}
+		}
+		if ttl, ok := p.lifetime(updated.status, updated.header, authorized, now); ok {
+			updated.stored, updated.expires = now, now.Add(ttl)
+			g.cache.put(&updated, r.Header)
+		} else {
+			g.cache.delete(primary)
+		}
+		writeCached(w, r, &updated, CacheRevalidated, now)
+		return CacheRevalidated
+	}
+	if r.Method == http.MethodGet && cw.complete() {
+		if ttl, ok := p.lifetime(cw.status, cw.header, authorized, now); ok {
+			g.cache.put(&cacheEntry{
+				primary: primary,
+				api:     rt.def.Name,
+				path:    path,
+				status:  cw.status,
+				header:  cw.header.Clone(),
+				body:    cw.body.Bytes(),
+				stored:  now,
+				expires: now.Add(ttl),
+			}, r.Header)
+		}
+	}
+	return CacheMiss
+}
+
+func (c *responseCache) maxEntrySize() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxEntry
+}
+
+// writeCached writes a stored response, or 304 Not Modified when it
+// satisfies the conditions of the request.
+func writeCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, result string, now time.Time) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	age := int(now.Sub(e.stored) / time.Second)
+	if v, err := strconv.Atoi(e.header.Get("Age")); err == nil {
+		age += v
+	}
+	h.Set("Age", strconv.Itoa(age))
+	h.Set(HeaderCache, result)
+	if notModified(r.Header, e.header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// notModified reports whether a stored response with header h satisfies
+// the If-None-Match or, without it, the If-Modified-Since condition of a
+// request.
+func notModified(req, h http.Header) bool {
+	if inm := req.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(req.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// cacheWriter buffers a response for the cache while passing it to the
+// client. Its headers are copied to the client when the status is written,
+// so a 304 answering the revalidation of the gateway is held back and the
+// stored response is served instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	header       http.Header
+	revalidating bool
+	notModified  bool
+	status       int
+	body         bytes.Buffer
+	limit        int64
+	written      int64
+	tooLarge     bool
+}
+
+func (c *cacheWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *cacheWriter) WriteHeader(code int) {
+	if c.status != 0 {
+		return
+	}
+	dst := c.ResponseWriter.Header()
+	if code >= 100 && code < 200 {
+		// Informational responses keep the headers of the final one.
+		saved := dst.Clone()
+		for k, v := range c.header {
+			dst[k] = v
+		}
+		c.ResponseWriter.WriteHeader(code)
+		clear(dst)
+		for k, v := range saved {
+			dst[k] = v
+		}
+		return
+	}
+	c.status = code
+	if c.revalidating && code == http.StatusNotModified {
+		c.notModified = true
+		return
+	}
+	for k, v := range c.header {
+		dst[k] = v
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.notModified {
+		return len(p), nil
+	}
+	c.written += int64(len(p))
+	if !c.tooLarge {
+		if c.written > c.limit {
+			c.tooLarge = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *cacheWriter) Flush() {
+	if c.notModified {
+		return
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// finish passes the trailers set after the body to the client.
+func (c *cacheWriter) finish() {
+	if c.notModified || c.status == 0 {
+		return
+	}
+	dst := c.ResponseWriter.Header()
+	for k, v := range c.header {
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+}
+
+// complete reports whether the whole body was buffered.
+func (c *cacheWriter) complete() bool {
+	if c.status == 0 || c.tooLarge {
+		return false
+	}
+	if n, err := strconv.ParseInt(c.header.Get("Content-Length"), 10, 64); err == nil {
+		return n == c.written
+	}
+	return true
+}
+
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
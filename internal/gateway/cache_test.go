@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	p, err := newCachePolicy(&store.ApiDefinition{Cache: &config.CacheConfig{DefaultTTLSeconds: 30, MaxTTLSeconds: 600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		status     int
+		header     map[string]string
+		authorized bool
+		ttl        time.Duration
+		ok         bool
+	}{
+		{200, nil, false, 30 * time.Second, true},
+		{500, nil, false, 0, false},
+		{200, map[string]string{"Cache-Control": "max-age=120"}, false, 2 * time.Minute, true},
+		{200, map[string]string{"Cache-Control": "max-age=120, s-maxage=60"}, false, time.Minute, true},
+		{200, map[string]string{"Cache-Control": "max-age=86400"}, false, 10 * time.Minute, true},
+		{200, map[string]string{"Cache-Control": "max-age=120", "Age": "100"}, false, 20 * time.Second, true},
+		{200, map[string]string{"Expires": now.Add(time.Minute).Format(http.TimeFormat), "Date": now.Format(http.TimeFormat)}, false, time.Minute, true},
+		{200, map[string]string{"Expires": "0"}, false, 0, false},
+		{200, map[string]string{"Cache-Control": "no-cache", "Etag": `"a"`}, false, 0, true},
+		{200, map[string]string{"Cache-Control": "no-cache"}, false, 0, false},
+		{200, map[string]string{"Cache-Control": "no-store"}, false, 0, false},
+		{200, map[string]string{"Cache-Control": "private, max-age=60"}, false, 0, false},
+		{200, map[string]string{"Set-Cookie": "session=1"}, false, 0, false},
+		{200, map[string]string{"Vary": "*"}, false, 0, false},
+		{200, nil, true, 0, false},
+		{200, map[string]string{"Cache-Control": "public, max-age=60"}, true, time.Minute, true},
+	}
+	for _, tt := range tests {
+		h := make(http.Header)
+		for k, v := range tt.header {
+			h.Set(k, v)
+		}
+		ttl, ok := p.lifetime(tt.status, h, tt.authorized, now)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("%d %v authorized=%v: got %s, %v; want %s, %v", tt.status, tt.header, tt.authorized, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+
+	for _, cfg := range []config.CacheConfig{{Scope: "global"}, {DefaultTTLSeconds: -1}} {
+		if _, err := newCachePolicy(&store.ApiDefinition{Cache: &cfg}); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+	if _, err := newCachePolicy(&store.ApiDefinition{Streaming: true, Cache: &config.CacheConfig{}}); err == nil {
+		t.Error("expected cache and streaming to be rejected")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(config.ResponseCacheConfig{MaxSizeMB: 1, MaxEntrySizeKB: 300})
+	body := []byte(strings.Repeat("x", 200<<10))
+	put := func(key string) {
+		c.put(&cacheEntry{primary: key, api: "a", path: "/" + key, header: http.Header{}, body: body}, http.Header{})
+	}
+	for i := range 5 {
+		put(fmt.Sprint(i))
+	}
+	// The sixth entry evicts the least recently used one, which is not 0.
+	c.get("0", nil)
+	put("5")
+	if c.get("1", nil) != nil {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if c.get("0", nil) == nil || c.get("5", nil) == nil {
+		t.Error("expected recent entries to be kept")
+	}
+	if c.size > 1<<20 {
+		t.Errorf("cache size %d exceeds the maximum", c.size)
+	}
+
+	c.put(&cacheEntry{primary: "big", header: http.Header{}, body: make([]byte, 400<<10)}, http.Header{})
+	if c.get("big", nil) != nil {
+		t.Error("expected an entry over max_entry_size_kb to be dropped")
+	}
+	if n := c.purge("", "/"); n != 5 || c.size != 0 || len(c.vary) != 0 || len(c.variants) != 0 {
+		t.Errorf("expected the purge to empty the cache, purged %d, size %d", n, c.size)
+	}
+}
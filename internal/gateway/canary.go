@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// selectVersion returns the version of rt serving the request. Canary
+// versions are tried in declaration order: explicit rules (headers,
+// subscription plan, tenant or developer) first, then weights. The weight
+// bucket is derived from the API key, or the client IP for anonymous
+// requests, so a consumer keeps the same version while the weights do not
+// change.
+func (rt *route) selectVersion(r *http.Request, sub *store.Subscription) *route {
+	if len(rt.versions) == 0 {
+		return rt
+	}
+	for _, v := range rt.versions {
+		if v.def.Canary != nil && canaryMatches(v, r, sub) {
+			return v
+		}
+	}
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		key = clientIP(r)
+	}
+	bucket := int(hashString(rt.def.Host+rt.def.Route()+"|"+key) % 100)
+	cumulative := 0
+	for _, v := range rt.versions {
+		if v.def.Canary == nil {
+			continue
+		}
+		cumulative += v.def.Canary.Weight
+		if bucket < cumulative {
+			return v
+		}
+	}
+	return rt
+}
+
+func canaryMatches(v *route, r *http.Request, sub *store.Subscription) bool {
+	c := v.def.Canary
+	if len(c.Headers) > 0 {
+		all := true
+		for name, value := range c.Headers {
+			if r.Header.Get(name) != value {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	if sub == nil {
+		return false
+	}
+	return slices.ContainsFunc(c.Plans, func(p string) bool { return strings.EqualFold(p, sub.Plan) }) ||
+		(sub.TenantID != "" && slices.Contains(c.Tenants, sub.TenantID)) ||
+		(sub.DeveloperID != "" && slices.Contains(c.Developers, sub.DeveloperID))
+}
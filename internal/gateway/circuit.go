@@ -0,0 +1,306 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+const (
+	DefaultCircuitWindow           = 10 * time.Second
+	DefaultCircuitOpenDuration     = 30 * time.Second
+	DefaultCircuitMinRequests      = 20
+	DefaultCircuitHalfOpenRequests = 1
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops traffic to an upstream that keeps failing. It trips
+// after too many consecutive failures or when the error rate over a fixed
+// window exceeds the threshold, stays open for a cooldown, then lets a few
+// probe requests through (half-open) before closing again. Every state
+// change starts a new generation; outcomes of requests admitted in an
+// earlier generation are ignored.
+type circuitBreaker struct {
+	name               string
+	consecutiveLimit   int
+	errorRateThreshold float64
+	minRequests        int
+	window             time.Duration
+	openDuration       time.Duration
+	halfOpenRequests   int
+	now                func() time.Time
+
+	mu                  sync.Mutex
+	state               circuitState
+	generation          uint64
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	openedAt            time.Time
+	halfOpenInFlight    int
+	halfOpenSuccesses   int
+}
+
+func newCircuitBreaker(name string, cfg *config.CircuitBreakerConfig) *circuitBreaker {
+	if cfg == nil {
+		return nil
+	}
+	b := &circuitBreaker{
+		name:               name,
+		consecutiveLimit:   cfg.ConsecutiveFailures,
+		errorRateThreshold: cfg.ErrorRateThreshold,
+		minRequests:        cfg.MinRequests,
+		window:             time.Duration(cfg.WindowSeconds) * time.Second,
+		openDuration:       time.Duration(cfg.OpenSeconds) * time.Second,
+		halfOpenRequests:   cfg.HalfOpenRequests,
+		now:                time.Now,
+	}
+	if b.minRequests <= 0 {
+		b.minRequests = DefaultCircuitMinRequests
+	}
+	if b.window <= 0 {
+		b.window = DefaultCircuitWindow
+	}
+	if b.openDuration <= 0 {
+		b.openDuration = DefaultCircuitOpenDuration
+	}
+	if b.halfOpenRequests <= 0 {
+		b.halfOpenRequests = DefaultCircuitHalfOpenRequests
+	}
+	return b
+}
+
+// ready reports whether acquire would currently let a request through.
+func (b *circuitBreaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		return b.now().Sub(b.openedAt) >= b.openDuration
+	case circuitHalfOpen:
+		return b.halfOpenInFlight < b.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// acquire reserves the right to send one request and returns the
+// generation it was admitted in. Every successful acquire must be followed
+// by exactly one call to record or release with that generation.
+func (b *circuitBreaker) acquire() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.openDuration {
+			return 0, false
+		}
+		b.state = circuitHalfOpen
+		b.generation++
+		b.halfOpenInFlight = 0
+		b.halfOpenSuccesses = 0
+		log.Printf("apimcore gateway: circuit for %s is half-open", b.name)
+		fallthrough
+	case circuitHalfOpen:
+		if b.halfOpenInFlight >= b.halfOpenRequests {
+			return 0, false
+		}
+		b.halfOpenInFlight++
+	}
+	return b.generation, true
+}
+
+// record reports the outcome of a request let through by acquire in the
+// given generation.
+func (b *circuitBreaker) record(generation uint64, success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	now := b.now()
+	switch b.state {
+	case circuitHalfOpen:
+		b.halfOpenInFlight--
+		if !success {
+			b.trip(now, "half-open probe failed")
+			return
+		}
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= b.halfOpenRequests {
+			b.reset(now)
+			log.Printf("apimcore gateway: circuit for %s is closed", b.name)
+		}
+	case circuitClosed:
+		if now.Sub(b.windowStart) >= b.window {
+			b.windowStart = now
+			b.windowRequests = 0
+			b.windowFailures = 0
+		}
+		b.windowRequests++
+		if success {
+			b.consecutiveFailures = 0
+			return
+		}
+		b.windowFailures++
+		b.consecutiveFailures++
+		if b.consecutiveLimit > 0 && b.consecutiveFailures >= b.consecutiveLimit {
+			b.trip(now, "consecutive failures")
+			return
+		}
+		if b.errorRateThreshold > 0 && b.windowRequests >= b.minRequests &&
+			float64(b.windowFailures)/float64(b.windowRequests) >= b.errorRateThreshold {
+			b.trip(now, "error rate")
+		}
+	}
+}
+
+// release gives back a slot reserved by acquire without judging the
+// upstream, e.g. when the client went away before the response.
+func (b *circuitBreaker) release(generation uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation == b.generation && b.state == circuitHalfOpen {
+		b.halfOpenInFlight--
+	}
+}
+
+func (b *circuitBreaker) trip(now time.Time, reason string) {
+	b.state = circuitOpen
+	b.generation++
+	b.openedAt = now
+	b.halfOpenInFlight = 0
+	log.Printf("apimcore gateway: circuit for %s is open (%s)", b.name, reason)
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.state = circuitClosed
+	b.generation++
+	b.consecutiveFailures = 0
+	b.windowStart = now
+	b.windowRequests = 0
+	b.windowFailures = 0
+}
+
+// breakerRegistry owns the circuit breakers of the gateway, one per API and
+// upstream URL. Breakers outlive route rebuilds, and the config route and
+// the store definition of an API share them.
+type breakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*registeredBreaker
+}
+
+type registeredBreaker struct {
+	breaker  *circuitBreaker
+	settings config.CircuitBreakerConfig
+}
+
+func newBreakerRegistry() *breakerRegistry {
+	return &breakerRegistry{breakers: make(map[string]*registeredBreaker)}
+}
+
+func breakerKey(api, upstream string) string {
+	return api + "|" + upstream
+}
+
+// attach gives every target of the pool the breaker of its API and URL,
+// creating it on first use or when the circuit_breaker settings changed.
+func (r *breakerRegistry) attach(pool *upstreamPool, d *store.ApiDefinition) {
+	if pool == nil || d.CircuitBreaker == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range pool.targets {
+		key := breakerKey(d.Name, t.url.String())
+		rb := r.breakers[key]
+		if rb == nil || rb.settings != *d.CircuitBreaker {
+			rb = &registeredBreaker{
+				breaker:  newCircuitBreaker(fmt.Sprintf("%s -> %s", d.Name, t.url.Host), d.CircuitBreaker),
+				settings: *d.CircuitBreaker,
+			}
+			r.breakers[key] = rb
+		}
+		t.breaker = rb.breaker
+	}
+}
+
+// state returns the circuit state of an upstream of an API.
+func (r *breakerRegistry) state(api, upstream string) circuitState {
+	r.mu.Lock()
+	rb := r.breakers[breakerKey(api, upstream)]
+	r.mu.Unlock()
+	if rb == nil {
+		return circuitClosed
+	}
+	return rb.breaker.currentState()
+}
+
+// retain drops the breakers no longer used by the given routes.
+func (r *breakerRegistry) retain(routes []*route) {
+	used := make(map[*circuitBreaker]bool)
+	for _, rt := range routes {
+		if rt.upstreams == nil {
+			continue
+		}
+		for _, t := range rt.upstreams.targets {
+			if t.breaker != nil {
+				used[t.breaker] = true
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, rb := range r.breakers {
+		if !used[rb.breaker] {
+			delete(r.breakers, key)
+		}
+	}
+}
+
+func (b *circuitBreaker) currentState() circuitState {
+	if b == nil {
+		return circuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
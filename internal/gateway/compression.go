@@ -0,0 +1,394 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+
+	DefaultCompressionMinSize = 1024
+
+	// DefaultMaxDecompressedBytes caps the decoded content of a compressed
+	// request body.
+	DefaultMaxDecompressedBytes = 10 << 20
+
+	// Brotli levels above 5 are too slow for responses compressed on the
+	// fly.
+	brotliLevel = 5
+)
+
+var (
+	defaultEncodings    = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+	defaultContentTypes = []string{
+		"text/*",
+		"application/json", "application/*+json",
+		"application/xml", "application/*+xml",
+		"application/javascript",
+		"image/svg+xml",
+	}
+)
+
+// errDecompressedTooLarge is returned by the body of a decompressed request
+// once its decoded content exceeds the limit of the API.
+var errDecompressedTooLarge = errors.New("decompressed request body too large")
+
+// encoder is a compressor that can be reused for another response.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	EncodingZstd: {New: func() any {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return e
+	}},
+	EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}},
+	EncodingGzip: {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// compressionPolicy is the compiled compression block of an API.
+type compressionPolicy struct {
+	encodings       []string
+	minSize         int
+	contentTypes    []string
+	decompress      bool
+	maxDecompressed int64
+}
+
+func newCompressionPolicy(d *store.ApiDefinition) (*compressionPolicy, error) {
+	cfg := d.Compression
+	if cfg == nil {
+		return nil, nil
+	}
+	p := &compressionPolicy{
+		encodings:       defaultEncodings,
+		minSize:         cfg.MinSizeBytes,
+		contentTypes:    defaultContentTypes,
+		decompress:      cfg.DecompressRequests,
+		maxDecompressed: cfg.MaxDecompressedBytes,
+	}
+	if cfg.MinSizeBytes < 0 {
+		return nil, errors.New("compression: min_size_bytes cannot be negative")
+	}
+	if cfg.MaxDecompressedBytes < 0 {
+		return nil, errors.New("compression: max_decompressed_bytes cannot be negative")
+	}
+	if p.minSize == 0 {
+		p.minSize = DefaultCompressionMinSize
+	}
+	if p.maxDecompressed == 0 {
+		p.maxDecompressed = DefaultMaxDecompressedBytes
+	}
+	if len(cfg.Encodings) > 0 {
+		p.encodings = nil
+		for _, e := range cfg.Encodings {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if encoderPools[e] == nil {
+				return nil, fmt.Errorf("compression: unknown encoding %q, want zstd, br or gzip", e)
+			}
+			p.encodings = append(p.encodings, e)
+		}
+	}
+	if len(cfg.ContentTypes) > 0 {
+		p.contentTypes = nil
+		for _, t := range cfg.ContentTypes {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if _, err := path.Match(t, ""); err != nil {
+				return nil, fmt.Errorf("compression: invalid content type %q", t)
+			}
+			p.contentTypes = append(p.contentTypes, t)
+		}
+	}
+	return p, nil
+}
+
+// negotiate returns the encoding of the policy preferred by an
+// Accept-Encoding header: the highest q-value wins, then the order of the
+// policy. It returns "" when the client accepts none of them.
+func (p *compressionPolicy) negotiate(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, enc := range p.encodings {
+		q, wildcard := -1.0, -1.0
+		for _, part := range strings.Split(acceptEncoding, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			v := 1.0
+			if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if v, err = strconv.ParseFloat(qs, 64); err != nil {
+					v = 0
+				}
+			}
+			switch name = strings.ToLower(strings.TrimSpace(name)); name {
+			case enc:
+				q = v
+			case "*":
+				wildcard = v
+			}
+		}
+		if q < 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of a Content-Type are compressed.
+// Server-sent events are streams and never are.
+func (p *compressionPolicy) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	for _, pattern := range p.contentTypes {
+		if ok, _ := path.Match(pattern, mt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressRequest replaces a request body sent with a supported
+// Content-Encoding by its decoded content, which fails with
+// errDecompressedTooLarge past limit bytes. Other encodings are left to the
+// backend.
+func decompressRequest(r *http.Request, limit int64) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	var body io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case EncodingGzip:
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		body = zr
+	case EncodingBrotli:
+		body = io.NopCloser(brotli.NewReader(r.Body))
+	case EncodingZstd:
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		body = zr.IOReadCloser()
+	default:
+		return nil
+	}
+	r.Body = &decodedBody{ReadCloser: body, raw: r.Body, remaining: limit}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+// decodedBody reads the decoded content of a request body up to a limit,
+// and closes both the decoder and the original body.
+type decodedBody struct {
+	io.ReadCloser
+	raw       io.Closer
+	remaining int64
+	err       error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	// Read one byte past the limit to tell a body ending there from a
+	// longer one.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n, b.err = int(b.remaining), errDecompressedTooLarge
+		b.remaining = 0
+		return n, b.err
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
+
+// compressWriter compresses a response with the negotiated encoding when
+// its status, headers and size allow it. Responses of unknown length are
+// buffered until MinSizeBytes are written, then compressed; responses that
+// end or are flushed before that are sent as is. Close must be called once
+// the response is written.
+type compressWriter struct {
+	http.ResponseWriter
+	policy   *compressionPolicy
+	encoding string
+
+	status    int
+	pending   []byte
+	buffered  bool
+	enc       encoder
+	sentBytes int64
+}
+
+func newCompressWriter(w http.ResponseWriter, p *compressionPolicy, acceptEncoding string) *compressWriter {
+	return &compressWriter{ResponseWriter: w, policy: p, encoding: p.negotiate(acceptEncoding)}
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.status != 0 {
+		return
+	}
+	if code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	c.status = code
+	h := c.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || !c.policy.compressible(h.Get("Content-Type")) {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !slices.Contains(varyHeaders(h), "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	if c.encoding == "" || cc.has("no-transform") {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		if n < int64(c.policy.minSize) {
+			c.ResponseWriter.WriteHeader(code)
+			return
+		}
+		c.start()
+		return
+	}
+	c.buffered = true
+}
+
+// start writes the headers of a compressed response.
+func (c *compressWriter) start() {
+	h := c.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", c.encoding)
+	// The compressed representation is not byte-for-byte the one the
+	// backend tagged.
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	c.enc = encoderPools[c.encoding].Get().(encoder)
+	c.enc.Reset(countingWriter{w: c.ResponseWriter, n: &c.sentBytes})
+	c.buffered = false
+	if len(c.pending) > 0 {
+		_, _ = c.enc.Write(c.pending)
+		c.pending = nil
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case c.enc != nil:
+		return c.enc.Write(p)
+	case c.buffered:
+		c.pending = append(c.pending, p...)
+		if len(c.pending) >= c.policy.minSize {
+			c.start()
+		}
+		return len(p), nil
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.sentBytes += int64(n)
+	return n, err
+}
+
+// Flush sends what was written so far. A response still below the minimum
+// size is sent as is from then on, so small streamed chunks are not held
+// back waiting for more. Until the first body bytes, there is nothing to
+// send: the reverse proxy flushes the headers of every response of unknown
+// length before copying its body, and the encoding is not decided yet.
+func (c *compressWriter) Flush() {
+	if c.buffered {
+		if len(c.pending) == 0 {
+			return
+		}
+		c.sendPending()
+	}
+	if c.enc != nil {
+		_ = c.enc.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// sendPending gives up on compressing a buffered response and sends it as
+// is.
+func (c *compressWriter) sendPending() {
+	c.buffered = false
+	c.ResponseWriter.WriteHeader(c.status)
+	n, _ := c.ResponseWriter.Write(c.pending)
+	c.sentBytes += int64(n)
+	c.pending = nil
+}
+
+// Close ends the compressed stream, or sends a buffered response that
+// stayed below the minimum size as is.
+func (c *compressWriter) Close() {
+	if c.buffered {
+		c.sendPending()
+	}
+	if c.enc != nil {
+		_ = c.enc.Close()
+		c.enc.Reset(nil)
+		encoderPools[c.encoding].Put(c.enc)
+		c.enc = nil
+	}
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
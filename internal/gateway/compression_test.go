@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	p, err := newCompressionPolicy(&store.ApiDefinition{Compression: &config.CompressionConfig{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br, zstd", EncodingZstd},
+		{"gzip, br", EncodingBrotli},
+		{"gzip;q=1.0, br;q=0.5", EncodingGzip},
+		{"zstd;q=0, gzip", EncodingGzip},
+		{"*", EncodingZstd},
+		{"*;q=0.1, br;q=0", EncodingZstd},
+		{"GZIP", EncodingGzip},
+	}
+	for _, tt := range tests {
+		if got := p.negotiate(tt.accept); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+
+	for ct, want := range map[string]bool{
+		"application/json; charset=utf-8": true,
+		"application/problem+json":        true,
+		"text/html":                       true,
+		"text/event-stream":               false,
+		"image/png":                       false,
+		"":                                false,
+	} {
+		if got := p.compressible(ct); got != want {
+			t.Errorf("%q: got %v, want %v", ct, got, want)
+		}
+	}
+
+	for _, cfg := range []config.CompressionConfig{{Encodings: []string{"deflate"}}, {MinSizeBytes: -1}, {ContentTypes: []string{"text/["}}} {
+		if _, err := newCompressionPolicy(&store.ApiDefinition{Compression: &cfg}); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
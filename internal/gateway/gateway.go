@@ -1,14 +1,20 @@
 package gateway
 
 import (
+	"bufio"
 	"context"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,24 +27,28 @@ import (
 	"golang.org/x/time/rate"
 )
 
-type backendLatencyKey struct{}
-
-type backendLatencyHolder struct {
-	Ms int64
-}
-
-type timeoutTransport struct {
-	base    http.RoundTripper
-	timeout time.Duration
-}
-
-func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if t.timeout > 0 {
-		ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
-		defer cancel()
-		req = req.WithContext(ctx)
-	}
-	return t.base.RoundTrip(req)
+type proxyStateKey struct{}
+
+// proxyState carries per-request data between proxyHandler and the
+// transport chain.
+type proxyState struct {
+	pool                 *upstreamPool
+	retry                *retryPolicy
+	target               *upstreamTarget
+	backendMs            int64
+	upstreamProto        string
+	circuitOpen          bool
+	retries              int
+	retryBudgetExhausted bool
+	response             *responseRules
+	params               map[string]string
+	vars                 map[string]string
+	publicURL            *url.URL
+	timedOut             bool
+	grpc                 bool
+	grpcCode             string
+	transcode            *transcodeCall
+	websocket            *webSocket
 }
 
 type measuringTransport struct {
@@ -48,8 +58,8 @@ type measuringTransport struct {
 func (t *measuringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now()
 	resp, err := t.base.RoundTrip(req)
-	if holder, _ := req.Context().Value(backendLatencyKey{}).(*backendLatencyHolder); holder != nil {
-		holder.Ms = time.Since(start).Milliseconds()
+	if state, _ := req.Context().Value(proxyStateKey{}).(*proxyState); state != nil {
+		state.backendMs = time.Since(start).Milliseconds()
 	}
 	return resp, err
 }
@@ -90,6 +100,7 @@ func trafficEventFromRequest(r *http.Request, ts time.Time, action string, statu
 		Country:        r.Header.Get(HeaderGeoCountry),
 		IP:             remoteIP,
 		Action:         action,
+		Protocol:       r.Proto,
 	}
 }
 
@@ -98,8 +109,23 @@ type Gateway struct {
 	config           *config.Config
 	store            *store.Store
 	meter            *meter.Meter
-	proxy            *httputil.ReverseProxy
+	retryBudget      *retryBudget
 	handler          http.Handler
+	routes           *routeTable
+	defRoutesMu      sync.Mutex
+	defRoutes        map[int64]*routeTable
+	defRoutesRev     uint64
+	defRoutesStale   bool
+	health           *healthMonitor
+	breakers         *breakerRegistry
+	mirrorClient     *http.Client
+	mirrorSem        chan struct{}
+	wsConns          *connLimiter
+	active           atomic.Int64
+	draining         atomic.Bool
+	socketsMu        sync.Mutex
+	sockets          map[*webSocket]struct{}
+	cache            *responseCache
 	Hub              *hub.Broadcaster
 	securityMu       sync.Mutex
 	blacklist        map[string]bool
@@ -111,17 +137,23 @@ type Gateway struct {
 
 func New(cfg *config.Config, s *store.Store, m *meter.Meter, h *hub.Broadcaster) *Gateway {
 	g := &Gateway{
-		config: cfg,
-		store:  s,
-		meter:  m,
-		proxy:  &httputil.ReverseProxy{},
-		Hub:    h,
-	}
-	timeoutTrans := &timeoutTransport{
-		base:    http.DefaultTransport,
-		timeout: time.Duration(cfg.Gateway.BackendTimeoutSeconds) * time.Second,
-	}
-	g.proxy.Transport = &measuringTransport{base: timeoutTrans}
+		config:   cfg,
+		store:    s,
+		meter:    m,
+		Hub:      h,
+		health:   newHealthMonitor(),
+		breakers: newBreakerRegistry(),
+		mirrorClient: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		mirrorSem: make(chan struct{}, MaxInFlightMirrors),
+		wsConns:   newConnLimiter(),
+		sockets:   make(map[*webSocket]struct{}),
+		cache:     newResponseCache(cfg.Gateway.Cache),
+	}
+	g.retryBudget = newRetryBudget(cfg.Gateway.RetryBudget)
 	g.UpdateSecurity(cfg.Security)
 	g.rebuildHandler()
 	return g
@@ -172,29 +204,90 @@ func (g *Gateway) GetSecurity() config.SecurityConfig {
 	}
 }
 
+// Close stops the background health checks of the gateway and closes idle
+// backend connections.
+func (g *Gateway) Close() {
+	g.health.close()
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	g.routes.closeIdleConnections()
+	g.defRoutesMu.Lock()
+	for _, table := range g.defRoutes {
+		table.closeIdleConnections()
+	}
+	g.defRoutesMu.Unlock()
+}
+
 func (g *Gateway) Stats() (blocked, rateLimited int64) {
 	return atomic.LoadInt64(&g.blockedCount), atomic.LoadInt64(&g.rateLimitedCount)
 }
 
+// ActiveConns returns the number of requests being served, open WebSocket
+// connections included.
+func (g *Gateway) ActiveConns() int {
+	return int(g.active.Load())
+}
+
 func (g *Gateway) UpdateConfig(cfg *config.Config) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	g.config = cfg
-	if g.proxy.Transport != nil {
-		if tt, ok := g.proxy.Transport.(*timeoutTransport); ok {
-			tt.timeout = time.Duration(cfg.Gateway.BackendTimeoutSeconds) * time.Second
-		} else {
-			g.proxy.Transport = &timeoutTransport{
-				base:    http.DefaultTransport,
-				timeout: time.Duration(cfg.Gateway.BackendTimeoutSeconds) * time.Second,
-			}
-		}
-	}
+	g.retryBudget = newRetryBudget(cfg.Gateway.RetryBudget)
+	g.cache.resize(cfg.Gateway.Cache)
 	g.UpdateSecurity(cfg.Security)
 	g.rebuildHandler()
 }
 
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	state, _ := r.Context().Value(proxyStateKey{}).(*proxyState)
+	status, msg := http.StatusBadGateway, ""
+	switch {
+	case isTimeout(err) && r.Context().Err() != context.Canceled:
+		if state != nil {
+			state.timedOut = true
+		}
+		status, msg = http.StatusGatewayTimeout, "Gateway Timeout"
+	case errors.Is(err, errNoUpstream):
+		status, msg = http.StatusServiceUnavailable, "Service Unavailable: no healthy upstream"
+	case errors.Is(err, errCircuitOpen):
+		status, msg = http.StatusServiceUnavailable, "Service Unavailable: circuit open"
+	case errors.Is(err, errDecompressedTooLarge):
+		status, msg = http.StatusRequestEntityTooLarge, "Request Entity Too Large: decompressed body exceeds the limit"
+	default:
+		log.Printf("apimcore gateway: proxy error: %v", err)
+	}
+	if state != nil && (state.grpc || state.transcode != nil) {
+		code := grpcUnavailable
+		if status == http.StatusGatewayTimeout {
+			code = grpcDeadlineExceeded
+		}
+		if msg == "" {
+			msg = http.StatusText(status)
+		}
+		state.grpcCode = grpcCodeName(code)
+		if state.transcode != nil {
+			writeJSONError(w, status, code, msg)
+			return
+		}
+		writeGRPCError(w, code, msg)
+		return
+	}
+	if msg == "" {
+		w.WriteHeader(status)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
 func (g *Gateway) rebuildHandler() {
+	old := g.routes
+	g.routes = g.compileConfigRoutes()
+	old.closeIdleConnections()
+	g.defRoutesMu.Lock()
+	g.defRoutesStale = true
+	g.retainHealthChecks(g.defRoutes)
+	g.defRoutesMu.Unlock()
+
 	// Base handler is the proxy logic
 	base := http.HandlerFunc(g.proxyHandler)
 
@@ -255,130 +348,324 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler := g.handler
 	g.mu.RUnlock()
 
+	g.active.Add(1)
+	defer g.active.Add(-1)
 	handler.ServeHTTP(w, r)
 }
 
 func (g *Gateway) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	g.mu.RLock()
-	defer g.mu.RUnlock()
-
 	start := time.Now()
 	path := r.URL.Path
 	host := r.Host
-	targetApi, apiDef, sub := g.resolveRoute(host, path, r.Header.Get(HeaderAPIKey))
-	if targetApi == nil {
-		http.Error(w, "no route for path", http.StatusNotFound)
-		g.meter.Record("", "", r.Method, http.StatusNotFound, time.Since(start).Milliseconds(), 0, 0, 0, "")
+	upgrade := isWebSocketUpgrade(r)
+	cert := clientCertificate(r)
+	// Compiled routes are immutable: the lock only covers the lookup, so a
+	// reload swaps the tables without waiting for requests in flight.
+	g.mu.RLock()
+	target, apiDef, sub := g.resolveRoute(host, path, r.Method, r.Header.Get(HeaderAPIKey), cert, upgrade)
+	g.mu.RUnlock()
+	// Requests turned down before they are proxied are metered and
+	// reported like proxied ones, against whatever route, subscription and
+	// tenant are known by then.
+	var backendName, route string
+	var apiDefID int64
+	record := func(r *http.Request, status int, action, grpcStatus string) {
+		var subID int64
+		if sub != nil {
+			subID = sub.ID
+		}
+		tenant := requestTenant(r, sub)
+		elapsed := time.Since(start).Milliseconds()
+		g.meter.Record(meter.Request{Backend: backendName, PathPrefix: route, Method: r.Method, Status: status, GrpcStatus: grpcStatus, TotalMs: elapsed, SubscriptionID: subID, ApiDefinitionID: apiDefID, TenantID: tenant})
+		if g.Hub != nil {
+			ev := trafficEventFromRequest(r, start, action, status, elapsed, 0, backendName, tenant, "")
+			ev.Route = route
+			g.Hub.PublishTraffic(ev)
+		}
+	}
+	reject := func(w http.ResponseWriter, r *http.Request, status int, action, msg string) {
+		http.Error(w, msg, status)
+		record(r, status, action, "")
+	}
+	if target.route == nil {
+		if len(target.allow) > 0 {
+			w.Header().Set("Allow", allowHeader(target.allow))
+			reject(w, r, http.StatusMethodNotAllowed, "NO_ROUTE", "method not allowed")
+		} else {
+			reject(w, r, http.StatusNotFound, "NO_ROUTE", "no route for path")
+		}
 		return
 	}
 
-	var backendURL string
-	var apiDefID int64
-	var backendName string
-	if apiDef != nil {
-		backendURL = apiDef.BackendURL
-		apiDefID = apiDef.ID
-		backendName = apiDef.Name
+	// Definitions from the subscribed product override the config route.
+	match := target
+	if apiDef.route != nil {
+		match = apiDef
+	}
+	// Versions are only negotiated between definitions sharing the route;
+	// a lone version is a label.
+	requested, segment := "", ""
+	if len(match.versions) > 0 {
+		requested, segment = match.requestedVersion(r)
+	}
+	if requested != "" {
+		v := match.findVersion(requested)
+		if v == nil {
+			backendName, route = match.def.Name, target.def.Route()
+			if apiDef.route != nil {
+				apiDefID = match.def.ID
+			}
+			reject(w, r, http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("unknown API version %q; available versions: %s", requested, strings.Join(match.availableVersions(), ", ")))
+			return
+		}
+		match.route = v
+		if segment != "" {
+			stripVersionSegment(r, match.def.PathPrefix, segment)
+		}
 	} else {
-		backendURL = targetApi.BackendURL
-		backendName = targetApi.Name
+		match.route = match.selectVersion(r, sub)
 	}
-
-	targetURL, err := url.Parse(backendURL)
-	if err != nil {
-		http.Error(w, "bad gateway config", http.StatusInternalServerError)
-		g.meter.Record(backendName, targetApi.PathPrefix, r.Method, 502, time.Since(start).Milliseconds(), 0, 0, apiDefID, "")
+	for k := range match.deprecation {
+		w.Header().Set(k, match.deprecation.Get(k))
+	}
+	if apiDef.route != nil {
+		apiDefID = match.def.ID
+	}
+	def, params := match.def, match.params
+	backendName = def.Name
+	route = target.def.Route()
+	if match.mtls == MTLSRequired && (cert == nil || sub == nil) {
+		status, msg := http.StatusUnauthorized, "Unauthorized: client certificate required"
+		if cert != nil {
+			status, msg = http.StatusForbidden, "Forbidden: unknown client certificate"
+		}
+		reject(w, r, status, "BLOCKED", msg)
 		return
 	}
-
-	rec := &responseRecorder{ResponseWriter: w, status: 200}
-	if sub != nil && sub.TenantID != "" {
-		r.Header.Set(HeaderTenantID, sub.TenantID)
+	if match.mtls == MTLSOff {
+		setClientCertHeaders(r.Header, nil)
+	} else {
+		setClientCertHeaders(r.Header, cert)
 	}
 
-	var addHeaders map[string]string
-	var pathPrefixToStrip string
-	var stripPath bool
-	if apiDef != nil {
-		addHeaders = apiDef.AddHeaders
-		pathPrefixToStrip = apiDef.PathPrefix
-		stripPath = apiDef.StripPathPrefix
+	rec := &responseRecorder{ResponseWriter: w, status: 200, start: start}
+	var ws *webSocket
+	if upgrade {
+		policy := match.websocket
+		if sub != nil {
+			if !g.wsConns.acquire(backendName, sub.ID, policy.maxConnections) {
+				reject(w, r, http.StatusTooManyRequests, "CONN_LIMIT", "Too Many Requests: WebSocket connection limit reached")
+				return
+			}
+			defer g.wsConns.release(backendName, sub.ID)
+		}
+		ws = &webSocket{idle: policy.idle, onUpgrade: func() { g.meter.WebSocketOpened(backendName) }}
+		g.trackWebSocket(ws)
+		defer g.untrackWebSocket(ws)
+	}
+	// The tenant header only carries an authenticated tenant, never the
+	// one a client sent.
+	if tenant := requestTenant(r, sub); tenant != "" {
+		r.Header.Set(HeaderTenantID, tenant)
 	} else {
-		addHeaders = targetApi.AddHeaders
-		pathPrefixToStrip = targetApi.PathPrefix
-		stripPath = targetApi.StripPathPrefix
+		r.Header.Del(HeaderTenantID)
 	}
-	for k, v := range addHeaders {
-		r.Header.Set(k, v)
+
+	for k, v := range def.AddHeaders {
+		r.Header.Set(k, expandParams(v, params))
 	}
 
-	dest := *targetURL
-	g.proxy.Director = func(req *http.Request) {
-		if stripPath && pathPrefixToStrip != "" {
-			req.URL.Path = strings.TrimPrefix(req.URL.Path, pathPrefixToStrip)
-			if req.URL.Path == "" {
-				req.URL.Path = "/"
+	var vars map[string]string
+	if match.rewrite != nil && r.Header.Get(HeaderRequestID) == "" {
+		r.Header.Set(HeaderRequestID, newRequestID())
+	}
+	if match.rewrite != nil || match.response != nil {
+		vars = templateVars(r, params, sub)
+	}
+	rt := match.route
+	// Compression sits between the recorder and the client, so the cache
+	// and the usage record see the response before compression.
+	var compress *compressWriter
+	if p := rt.compression; p != nil && !upgrade && !(match.grpc && isGRPCRequest(r)) {
+		if p.decompress {
+			if err := decompressRequest(r, p.maxDecompressed); err != nil {
+				reject(w, r, http.StatusBadRequest, "BAD_REQUEST", "Bad Request: invalid request body encoding")
+				return
+			}
+		}
+		if r.Method != http.MethodHead && !def.Streaming {
+			compress = newCompressWriter(rec.ResponseWriter, p, r.Header.Get("Accept-Encoding"))
+			rec.ResponseWriter = compress
+		}
+	}
+	var shadow *mirrorRequest
+	if !upgrade {
+		shadow = g.startMirror(r, rt, func(u *url.URL, h http.Header) {
+			rt.rewriteRequest(u, h, params, vars)
+		})
+	}
+	if shadow != nil {
+		if shadow.capture != nil {
+			rec.capture = shadow.capture
+		}
+		defer func() { shadow.finish(rec.status, time.Since(start).Milliseconds()) }()
+	}
+	state := &proxyState{
+		pool:      match.upstreams,
+		retry:     match.retry,
+		response:  match.response,
+		params:    params,
+		vars:      vars,
+		grpc:      match.grpc && isGRPCRequest(r),
+		websocket: ws,
+	}
+	if match.transcoder != nil && !state.grpc && !upgrade {
+		call, err := match.transcoder.transcode(r, transcodePath(def, r.URL))
+		if err != nil {
+			var te *transcodeError
+			if !errors.As(err, &te) {
+				te = &transcodeError{http.StatusBadRequest, 3, err.Error()}
+			}
+			writeJSONError(rec, te.status, te.code, te.msg)
+			action := "BAD_REQUEST"
+			if te.status == http.StatusNotFound || te.status == http.StatusMethodNotAllowed {
+				action = "NO_ROUTE"
 			}
+			record(r, te.status, action, grpcCodeName(te.code))
+			return
 		}
-		req.URL.Scheme = dest.Scheme
-		req.URL.Host = dest.Host
-		req.Host = dest.Host
+		state.transcode = call
+		r.Header.Set("Te", "trailers")
+	}
+	if match.response != nil && match.response.rewriteLocation {
+		strippedPrefix := ""
+		if def.StripPathPrefix && def.RewritePath == "" {
+			strippedPrefix = def.PathPrefix
+		}
+		state.publicURL = publicURL(r, strippedPrefix)
+	}
+	ctx := context.WithValue(r.Context(), proxyStateKey{}, state)
+	// The total timeout would cut upgraded connections short; they are
+	// bounded by the WebSocket idle timeout instead.
+	if match.timeouts.total > 0 && !upgrade {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, match.timeouts.total)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+	cache := ""
+	if rt.cache != nil && !upgrade {
+		cache = g.serveCached(rec, r, rt, sub, path)
+		g.meter.RecordCache(backendName, cache)
+	} else {
+		rt.proxy.ServeHTTP(rec, r)
+	}
+	sentBytes := rec.written
+	if compress != nil {
+		compress.Close()
+		sentBytes = compress.sentBytes
 	}
-	holder := &backendLatencyHolder{}
-	r = r.WithContext(context.WithValue(r.Context(), backendLatencyKey{}, holder))
-	g.proxy.ServeHTTP(rec, r)
 
 	elapsed := time.Since(start).Milliseconds()
-	backendMs := holder.Ms
+	if ws != nil {
+		ws.close()
+		if ws.upgraded() {
+			// Usage and latency cover the handshake; the lifetime of the
+			// connection goes to the WebSocket metrics.
+			rec.status = http.StatusSwitchingProtocols
+			elapsed = ws.upgradedAt.Sub(start).Milliseconds()
+			rec.firstByte = ws.upgradedAt.Sub(start)
+			g.meter.RecordWebSocket(meter.WebSocket{
+				Backend:     backendName,
+				Duration:    time.Since(ws.upgradedAt),
+				BytesIn:     ws.bytesIn.Load(),
+				BytesOut:    ws.bytesOut.Load(),
+				MessagesIn:  ws.in.messages.Load(),
+				MessagesOut: ws.out.messages.Load(),
+			})
+		}
+	}
 	subID := int64(0)
 	tenantID := ""
 	if sub != nil {
 		subID = sub.ID
 		tenantID = sub.TenantID
 	}
-	g.meter.Record(backendName, targetApi.PathPrefix, r.Method, rec.status, elapsed, backendMs, subID, apiDefID, tenantID)
-
+	upstream := ""
+	if state.target != nil {
+		upstream = state.target.url.Host
+	}
+	status, grpcCode := rec.status, state.grpcCode
+	if state.grpc {
+		if code, ok := grpcStatus(rec.Header()); ok {
+			status, grpcCode = grpcToHTTPStatus(code), grpcCodeName(code)
+		}
+	}
+	g.meter.Record(meter.Request{
+		Backend:         backendName,
+		PathPrefix:      route,
+		Method:          r.Method,
+		Status:          status,
+		GrpcStatus:      grpcCode,
+		TotalMs:         elapsed,
+		BackendMs:       state.backendMs,
+		TTFBMs:          rec.ttfb().Milliseconds(),
+		HasTTFB:         true,
+		SubscriptionID:  subID,
+		ApiDefinitionID: apiDefID,
+		TenantID:        tenantID,
+		Upstream:        upstream,
+		Retries:         state.retries,
+		ResponseBytes:   rec.written,
+		SentBytes:       sentBytes,
+	})
+	if state.retryBudgetExhausted {
+		g.meter.IncrementRetryBudgetExhausted()
+	}
+
+	action := "ALLOWED"
+	switch {
+	case state.circuitOpen:
+		action = "CIRCUIT_OPEN"
+		g.meter.IncrementCircuitOpen(backendName)
+	case state.timedOut:
+		action = "TIMEOUT"
+	}
 	if g.Hub != nil {
-		g.Hub.PublishTraffic(trafficEventFromRequest(r, start, "ALLOWED", rec.status, elapsed, backendMs, backendName, tenantID, ""))
+		ev := trafficEventFromRequest(r, start, action, rec.status, elapsed, state.backendMs, backendName, tenantID, "")
+		ev.Route = route
+		ev.Params = params
+		ev.Upstream = upstream
+		ev.Version = def.Version
+		ev.UpstreamProto = state.upstreamProto
+		ev.Cache = cache
+		g.Hub.PublishTraffic(ev)
 	}
 
 	log.Printf("apimcore gateway: %s %s -> %s %d %dms", r.Method, path, backendName, rec.status, elapsed)
 }
 
-func (g *Gateway) resolveRoute(host, path, apiKey string) (targetApi *config.ApiConfig, apiDef *store.ApiDefinition, sub *store.Subscription) {
-	for i := range g.config.Products {
-		p := &g.config.Products[i]
-		for j := range p.Apis {
-			a := &p.Apis[j]
-			if a.Host != "" && matchHost(host, a.Host) && strings.HasPrefix(path, a.PathPrefix) {
-				targetApi = a
-				break
-			}
-		}
-		if targetApi != nil {
-			break
-		}
+// resolveRoute finds the config route of a request and the subscription
+// of the client, identified by its verified client certificate on APIs
+// with mtls enabled, otherwise by its API key. APIs requiring mTLS ignore
+// API keys.
+func (g *Gateway) resolveRoute(host, path, method, apiKey string, cert *x509.Certificate, upgrade bool) (target, apiDef routeMatch, sub *store.Subscription) {
+	target = g.routes.lookup(host, path, method, upgrade)
+	if target.route == nil {
+		return target, routeMatch{}, nil
 	}
-	if targetApi == nil {
-		for i := range g.config.Products {
-			p := &g.config.Products[i]
-			for j := range p.Apis {
-				a := &p.Apis[j]
-				if a.Host == "" && strings.HasPrefix(path, a.PathPrefix) {
-					targetApi = a
-					break
-				}
-			}
-			if targetApi != nil {
-				break
+
+	if cert != nil && target.mtls != MTLSOff {
+		if c := g.store.FindClientCertificate(certIdentity(cert)); c != nil && c.Active {
+			sub = g.store.GetSubscription(c.SubscriptionID)
+			if sub != nil && sub.Active {
+				apiDef = g.productRoutes(sub.ProductID).lookup(host, path, method, upgrade)
+				return target, apiDef, sub
 			}
+			sub = nil
 		}
 	}
-	if targetApi == nil {
-		return nil, nil, nil
-	}
-
-	if apiKey != "" {
+	if apiKey != "" && target.mtls != MTLSRequired {
 		hash := hashKey(apiKey)
 		prefix := apiKey
 		if len(prefix) > KeyPrefixLen {
@@ -392,43 +679,107 @@ func (g *Gateway) resolveRoute(host, path, apiKey string) (targetApi *config.Api
 			g.store.UpdateKeyLastUsed(k.ID, time.Now())
 			sub = g.store.GetSubscription(k.SubscriptionID)
 			if sub != nil && sub.Active {
-				defs := g.store.ListDefinitionsByProduct(sub.ProductID)
-				for i := range defs {
-					if defs[i].Host != "" && matchHost(host, defs[i].Host) && strings.HasPrefix(path, defs[i].PathPrefix) {
-						apiDef = &defs[i]
-						break
-					}
-				}
-				if apiDef == nil {
-					for i := range defs {
-						if defs[i].Host == "" && strings.HasPrefix(path, defs[i].PathPrefix) {
-							apiDef = &defs[i]
-							break
-						}
-					}
-				}
+				apiDef = g.productRoutes(sub.ProductID).lookup(host, path, method, upgrade)
 			}
 		}
 	}
-	return targetApi, apiDef, sub
+	return target, apiDef, sub
 }
 
-func matchHost(actual, target string) bool {
-	// Strip port if present
-	if h, _, err := net.SplitHostPort(actual); err == nil {
-		actual = h
+// compileConfigRoutes builds the routing table for every API declared in the
+// config file, in declaration order, and starts their health checks.
+// Invalid routes are logged and skipped.
+func (g *Gateway) compileConfigRoutes() *routeTable {
+	var defs []*store.ApiDefinition
+	products := make(map[*store.ApiDefinition]string)
+	for i := range g.config.Products {
+		p := &g.config.Products[i]
+		for _, a := range p.Apis {
+			d := store.DefinitionFromConfig(0, a)
+			products[d] = p.Slug
+			defs = append(defs, d)
+		}
+	}
+	table, errs := compileRoutes(defs)
+	for _, err := range errs {
+		log.Printf("apimcore gateway: skipping route: %v", err)
+	}
+	for _, rt := range table.routes {
+		rt.product = products[rt.def]
+		g.prepareRoute(rt)
+	}
+	return table
+}
+
+// prepareRoute attaches the gateway-wide runtime state to a compiled route:
+// health checks, circuit breakers, timeouts, and its own http.Transport and reverse proxy.
+// The transport chain is backend selection and retries, then per-attempt
+// latency measurement, then the http.Transport of the route.
+func (g *Gateway) prepareRoute(rt *route) {
+	g.health.attach(rt.upstreams, rt.def.HealthCheck, rt.tls)
+	g.breakers.attach(rt.upstreams, rt.def)
+	rt.timeouts = streamingTimeouts(resolveTimeouts(g.config.Gateway, rt.def.Timeouts), rt.def)
+	rt.transport = newRouteTransport(rt.timeouts, resolveConnectionPool(g.config.Gateway, rt.def.ConnectionPool), rt.protocols, rt.tls)
+	rt.proxy = &httputil.ReverseProxy{
+		Director: rt.direct,
+		Transport: &upstreamTransport{
+			budget: g.retryBudget,
+			base:   &measuringTransport{base: rt.transport},
+		},
+		ErrorHandler:   proxyErrorHandler,
+		ModifyResponse: modifyResponse,
+		FlushInterval:  flushInterval(rt.def),
 	}
+}
 
-	if actual == target {
-		return true
+// productRoutes returns the compiled routing table for the store definitions
+// of a product. Tables are rebuilt whenever the store definitions change.
+// Callers hold g.mu.
+func (g *Gateway) productRoutes(productID int64) *routeTable {
+	g.defRoutesMu.Lock()
+	defer g.defRoutesMu.Unlock()
+	rev := g.store.DefinitionsRevision()
+	if g.defRoutes == nil || rev != g.defRoutesRev || g.defRoutesStale {
+		defs := g.store.ListDefinitions()
+		sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+		byProduct := make(map[int64][]*store.ApiDefinition)
+		for i := range defs {
+			byProduct[defs[i].ProductID] = append(byProduct[defs[i].ProductID], &defs[i])
+		}
+		old := g.defRoutes
+		g.defRoutes = make(map[int64]*routeTable, len(byProduct))
+		for id, list := range byProduct {
+			table, errs := compileRoutes(list)
+			for _, err := range errs {
+				log.Printf("apimcore gateway: skipping product %d route: %v", id, err)
+			}
+			for _, rt := range table.routes {
+				g.prepareRoute(rt)
+			}
+			g.defRoutes[id] = table
+		}
+		g.defRoutesRev = rev
+		g.defRoutesStale = false
+		g.retainHealthChecks(g.defRoutes)
+		for _, table := range old {
+			table.closeIdleConnections()
+		}
 	}
-	if strings.HasPrefix(target, "*.") {
-		suffix := target[1:] // suffix including the dot (e.g. ".example.com")
-		if strings.HasSuffix(actual, suffix) {
-			return true
+	return g.defRoutes[productID]
+}
+
+func allowHeader(methods []string) string {
+	seen := make(map[string]bool, len(methods))
+	out := make([]string, 0, len(methods))
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
 		}
 	}
-	return false
+	sort.Strings(out)
+	return strings.Join(out, ", ")
 }
 
 func hashKey(key string) string {
@@ -436,12 +787,71 @@ func hashKey(key string) string {
 	return hex.EncodeToString(h[:])
 }
 
+// responseRecorder records the status and body size of a response and the
+// time its first bytes reached the client. It keeps the Flusher, Hijacker
+// and ReaderFrom behaviour of the underlying writer.
 type responseRecorder struct {
 	http.ResponseWriter
-	status int
+	status    int
+	written   int64
+	capture   io.Writer
+	start     time.Time
+	firstByte time.Duration
+}
+
+func (r *responseRecorder) markFirstByte() {
+	if r.firstByte == 0 {
+		r.firstByte = max(time.Since(r.start), 1)
+	}
+}
+
+// ttfb returns the time to first byte, or the time elapsed so far when
+// nothing has been sent yet.
+func (r *responseRecorder) ttfb() time.Duration {
+	if r.firstByte == 0 {
+		return time.Since(r.start)
+	}
+	return r.firstByte
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.markFirstByte()
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	if r.capture != nil {
+		_, _ = r.capture.Write(p[:n])
+	}
+	return n, err
 }
 
 func (r *responseRecorder) WriteHeader(code int) {
 	r.status = code
 	r.ResponseWriter.WriteHeader(code)
 }
+
+// ReadFrom keeps the io.ReaderFrom fast path of the client connection when
+// the response is not captured.
+func (r *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	src = &firstByteReader{r: src, mark: r.markFirstByte}
+	if rf, ok := r.ResponseWriter.(io.ReaderFrom); ok && r.capture == nil {
+		n, err := rf.ReadFrom(src)
+		r.written += n
+		return n, err
+	}
+	return io.Copy(struct{ io.Writer }{r}, src)
+}
+
+func (r *responseRecorder) Flush() {
+	r.markFirstByte()
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the client connection for the
+// methods the recorder does not implement, such as deadlines.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -1,13 +1,32 @@
 package gateway
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
 
 	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/hub"
 	"github.com/navantesolutions/apimcore/internal/meter"
 	"github.com/navantesolutions/apimcore/internal/store"
 )
@@ -202,6 +221,7 @@ func TestGateway_ServeHTTP(t *testing.T) {
 			},
 		})
 		s.PopulateFromConfig(cfg)
+		gw.UpdateConfig(cfg)
 
 		tests := []struct {
 			name   string
@@ -228,3 +248,2205 @@ func TestGateway_ServeHTTP(t *testing.T) {
 		}
 	})
 }
+
+func TestGateway_PathTemplates(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Path", r.URL.Path)
+		w.Header().Set("X-Backend-Order", r.Header.Get("X-Order-Id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "orders",
+				Apis: []config.ApiConfig{
+					{
+						Name:        "order-items",
+						Path:        "/orders/{id:[0-9]+}/items",
+						Methods:     []string{"GET"},
+						BackendURL:  backend.URL,
+						RewritePath: "/v1/items/{id}",
+						AddHeaders:  map[string]string{"X-Order-Id": "{id}"},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+
+	req := httptest.NewRequest("GET", "/orders/42/items", nil)
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Backend-Path"); got != "/v1/items/42" {
+		t.Errorf("expected rewritten path /v1/items/42, got %s", got)
+	}
+	if got := rec.Header().Get("X-Backend-Order"); got != "42" {
+		t.Errorf("expected X-Order-Id 42, got %s", got)
+	}
+
+	req = httptest.NewRequest("DELETE", "/orders/42/items", nil)
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("expected 405 with Allow: GET, got %d %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	req = httptest.NewRequest("GET", "/orders/abc/items", nil)
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for non-numeric id, got %d", rec.Code)
+	}
+}
+
+func TestGateway_Upstreams(t *testing.T) {
+	hits := make(map[string]int)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Served-By", name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	b1, b2 := newBackend("b1"), newBackend("b2")
+	defer b1.Close()
+	defer b2.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:       "balanced",
+						PathPrefix: "/lb",
+						Upstreams:  []config.UpstreamConfig{{URL: b1.URL}, {URL: b2.URL}},
+					},
+					{Name: "empty", PathPrefix: "/empty"},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest("GET", "/lb/x", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		hits[rec.Header().Get("X-Served-By")]++
+	}
+	if hits["b1"] != 5 || hits["b2"] != 5 {
+		t.Errorf("expected round-robin 5/5, got %v", hits)
+	}
+
+	usage := s.UsageSince(time.Time{})
+	if len(usage) == 0 || usage[len(usage)-1].Upstream == "" {
+		t.Errorf("expected upstream recorded in usage, got %+v", usage)
+	}
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/empty", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without upstreams, got %d", rec.Code)
+	}
+}
+
+func TestGateway_HealthChecks(t *testing.T) {
+	var b1Down atomic.Bool
+	newBackend := func(name string, down func() bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" && down() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Served-By", name)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	b1 := newBackend("b1", b1Down.Load)
+	b2 := newBackend("b2", func() bool { return true })
+	defer b1.Close()
+	defer b2.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:       "checked",
+						PathPrefix: "/hc",
+						Upstreams:  []config.UpstreamConfig{{URL: b1.URL}, {URL: b2.URL}},
+						HealthCheck: &config.HealthCheckConfig{
+							Path:               "/healthz",
+							IntervalSeconds:    3600,
+							HealthyThreshold:   1,
+							UnhealthyThreshold: 1,
+						},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	checkAll := func() {
+		gw.health.mu.Lock()
+		probes := make([]*healthProbe, 0, len(gw.health.probes))
+		for _, p := range gw.health.probes {
+			probes = append(probes, p)
+		}
+		gw.health.mu.Unlock()
+		for _, p := range probes {
+			p.check()
+		}
+	}
+	checkAll()
+
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest("GET", "/hc", nil))
+		if got := rec.Header().Get("X-Served-By"); got != "b1" {
+			t.Fatalf("expected only healthy b1 to serve, got %q (%d)", got, rec.Code)
+		}
+	}
+	if ok, reason := gw.Ready(); !ok {
+		t.Errorf("expected ready, got %s", reason)
+	}
+	statuses := gw.UpstreamHealth()
+	if len(statuses) != 2 || !statuses[0].Checked {
+		t.Fatalf("expected 2 checked upstreams, got %+v", statuses)
+	}
+
+	b1Down.Store(true)
+	checkAll()
+	if ok, _ := gw.Ready(); ok {
+		t.Error("expected not ready without healthy upstreams")
+	}
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/hc", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+
+	b1Down.Store(false)
+	checkAll()
+	if ok, _ := gw.Ready(); !ok {
+		t.Error("expected ready after recovery")
+	}
+}
+
+func TestGateway_CircuitBreaker(t *testing.T) {
+	var calls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:           "flaky",
+						PathPrefix:     "/flaky",
+						BackendURL:     backend.URL,
+						CircuitBreaker: &config.CircuitBreakerConfig{ConsecutiveFailures: 2, OpenSeconds: 60},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", Keys: []config.KeyConfig{{Name: "k", Value: "flaky-key"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest("GET", "/flaky", nil))
+		if rec.Code != http.StatusBadGateway {
+			t.Fatalf("request %d: expected upstream 502, got %d", i, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/flaky", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 from open circuit, got %d", rec.Code)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected the open circuit to shield the backend, got %d calls", n)
+	}
+	if statuses := gw.UpstreamHealth(); len(statuses) != 1 || statuses[0].Circuit != "open" {
+		t.Errorf("expected open circuit in upstream health, got %+v", statuses)
+	}
+
+	// The circuit survives a reload and also guards the store definition
+	// serving keyed traffic.
+	gw.UpdateConfig(cfg)
+	req := httptest.NewRequest("GET", "/flaky", nil)
+	req.Header.Set(HeaderAPIKey, "flaky-key")
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Errorf("expected keyed traffic to hit the open circuit after a reload, got %d after %d calls", rec.Code, calls.Load())
+	}
+	if statuses := gw.UpstreamHealth(); len(statuses) != 1 || statuses[0].Circuit != "open" {
+		t.Errorf("expected open circuit after a reload, got %+v", statuses)
+	}
+}
+
+func TestGateway_Retries(t *testing.T) {
+	var calls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if n%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Body", string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "safe", PathPrefix: "/safe", BackendURL: backend.URL, Retry: &config.RetryConfig{Attempts: 3, BackoffBaseMs: 1}},
+					{Name: "unsafe", PathPrefix: "/unsafe", BackendURL: backend.URL, Retry: &config.RetryConfig{Attempts: 3, BackoffBaseMs: 1, RetryNonIdempotent: true}},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := send("GET", "/safe", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected GET to succeed on retry, got %d", rec.Code)
+	}
+	calls.Store(0)
+	if rec := send("POST", "/safe", "payload"); rec.Code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("expected a single POST attempt, got %d after %d calls", rec.Code, calls.Load())
+	}
+	calls.Store(0)
+	rec := send("POST", "/unsafe", "payload")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Body") != "payload" {
+		t.Errorf("expected POST retry with replayed body, got %d %q", rec.Code, rec.Header().Get("X-Body"))
+	}
+
+	var retries int
+	for _, u := range s.UsageSince(time.Now().Add(-time.Minute)) {
+		retries += u.Retries
+	}
+	if retries != 2 {
+		t.Errorf("expected 2 retries in usage records, got %d", retries)
+	}
+}
+
+func TestGateway_CanaryVersions(t *testing.T) {
+	newBackend := func(version string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Version", version)
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	v1, v2 := newBackend("v1"), newBackend("v2")
+	defer v1.Close()
+	defer v2.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v1", BackendURL: v1.URL},
+					{
+						Name:       "catalog",
+						PathPrefix: "/catalog",
+						Version:    "v2",
+						BackendURL: v2.URL,
+						Canary: &config.CanaryConfig{
+							Weight:  20,
+							Headers: map[string]string{"X-Canary": "true"},
+							Plans:   []string{"beta"},
+						},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", Plan: "beta", Keys: []config.KeyConfig{{Name: "beta", Value: "beta-key"}}},
+		},
+	}
+	for i := 0; i < 200; i++ {
+		cfg.Subscriptions = append(cfg.Subscriptions, config.SubscriptionConfig{
+			DeveloperID: fmt.Sprintf("dev-%d", i),
+			ProductSlug: "p1",
+			Keys:        []config.KeyConfig{{Name: "k", Value: fmt.Sprintf("consumer-key-%03d", i)}},
+		})
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+
+	send := func(key string, header map[string]string) string {
+		req := httptest.NewRequest("GET", "/catalog/items", nil)
+		if key != "" {
+			req.Header.Set(HeaderAPIKey, key)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		return rec.Header().Get("X-Version")
+	}
+
+	if got := send("", map[string]string{"X-Canary": "true"}); got != "v2" {
+		t.Errorf("canary header: got %q, want v2", got)
+	}
+	if got := send("beta-key", nil); got != "v2" {
+		t.Errorf("beta plan: got %q, want v2", got)
+	}
+	if ev := <-h.TrafficChan(); ev.Version != "v2" {
+		t.Errorf("expected version v2 in traffic event, got %q", ev.Version)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("consumer-key-%03d", i)
+		first := send(key, nil)
+		for j := 0; j < 3; j++ {
+			if got := send(key, nil); got != first {
+				t.Fatalf("%s flipped from %s to %s", key, first, got)
+			}
+		}
+		counts[first]++
+	}
+	if counts["v2"] < 20 || counts["v2"] > 60 {
+		t.Errorf("expected about 20%% of consumers on v2, got %v", counts)
+	}
+
+	byVersion := s.UsageByVersionSince(time.Now().Add(-time.Minute))
+	if byVersion["v2"] == 0 || byVersion["v1"] == 0 {
+		t.Errorf("expected usage for both versions, got %v", byVersion)
+	}
+}
+
+func TestGateway_VersionNegotiation(t *testing.T) {
+	newBackend := func(version string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Version", version)
+			w.Header().Set("X-Path", r.URL.EscapedPath())
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	v1, v2 := newBackend("v1"), newBackend("v2")
+	defer v1.Close()
+	defer v2.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:       "catalog",
+						PathPrefix: "/catalog",
+						Version:    "v1",
+						BackendURL: v1.URL,
+						Deprecation: &config.DeprecationConfig{
+							Date:   "2026-01-01",
+							Sunset: "2026-12-31",
+							Link:   "https://docs.example.com/migrate",
+						},
+					},
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v2", BackendURL: v2.URL},
+					{Name: "labelled", PathPrefix: "/labelled", Version: "v1", BackendURL: v1.URL},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		header  map[string]string
+		status  int
+		version string
+		gotPath string
+	}{
+		{"Default Is First Declared", "/catalog/items", nil, http.StatusOK, "v1", "/catalog/items"},
+		{"Accept-Version", "/catalog/items", map[string]string{"Accept-Version": "2"}, http.StatusOK, "v2", "/catalog/items"},
+		{"Api-Version", "/catalog/items", map[string]string{"Api-Version": "V2"}, http.StatusOK, "v2", "/catalog/items"},
+		{"Media Type Parameter", "/catalog/items", map[string]string{"Accept": "text/html, application/json; version=v2"}, http.StatusOK, "v2", "/catalog/items"},
+		{"Path Segment", "/catalog/v2/items", nil, http.StatusOK, "v2", "/catalog/items"},
+		{"Path Segment Wins", "/catalog/v1", map[string]string{"Accept-Version": "v2"}, http.StatusOK, "v1", "/catalog/"},
+		{"Unknown Version", "/catalog/items", map[string]string{"Accept-Version": "v9"}, http.StatusBadRequest, "", ""},
+		{"Unknown Path Segment Is A Resource", "/catalog/v9/items", nil, http.StatusOK, "v1", "/catalog/v9/items"},
+		{"Escaped Path Kept", "/catalog/v2/a%2Fb", nil, http.StatusOK, "v2", "/catalog/a%2Fb"},
+		{"Lone Version Is A Label", "/labelled/v1/items", map[string]string{"Accept-Version": "v9"}, http.StatusOK, "v1", "/labelled/v1/items"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if rec.Header().Get("X-Version") != tt.version || rec.Header().Get("X-Path") != tt.gotPath {
+				t.Errorf("expected %s at %q, got %s at %q", tt.version, tt.gotPath, rec.Header().Get("X-Version"), rec.Header().Get("X-Path"))
+			}
+			if tt.status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "v1, v2") {
+				t.Errorf("expected available versions in body, got %q", rec.Body.String())
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/catalog/v1/items", nil))
+	if got := rec.Header().Get("Deprecation"); got != "@1767225600" {
+		t.Errorf("Deprecation: got %q", got)
+	}
+	if got := rec.Header().Get("Sunset"); got != "Thu, 31 Dec 2026 00:00:00 GMT" {
+		t.Errorf("Sunset: got %q", got)
+	}
+	if got := rec.Header().Get("Link"); got != `<https://docs.example.com/migrate>; rel="deprecation"` {
+		t.Errorf("Link: got %q", got)
+	}
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/catalog/v2/items", nil))
+	if rec.Header().Get("Deprecation") != "" {
+		t.Error("expected no Deprecation header on v2")
+	}
+}
+
+func TestGateway_Rejections(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v1", BackendURL: backend.URL},
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v2", BackendURL: backend.URL},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", TenantID: "acme", Keys: []config.KeyConfig{{Name: "k", Value: "reject-key"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		status int
+		action string
+		tenant string
+	}{
+		{"Unknown Version", "/catalog/items", map[string]string{HeaderAPIKey: "reject-key", "Accept-Version": "v9"}, http.StatusBadRequest, "BAD_REQUEST", "acme"},
+		{"No Route", "/nowhere", map[string]string{HeaderAPIKey: "reject-key"}, http.StatusNotFound, "NO_ROUTE", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			gw.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, rec.Code)
+			}
+			ev := <-h.TrafficChan()
+			if ev.Status != tt.status || ev.Action != tt.action || ev.TenantID != tt.tenant {
+				t.Errorf("expected a %s event for %s with status %d, got %s for %q with %d", tt.action, tt.tenant, tt.status, ev.Action, ev.TenantID, ev.Status)
+			}
+		})
+	}
+
+	usage := s.UsageSince(time.Now().Add(-time.Minute))
+	if len(usage) != len(tests) {
+		t.Fatalf("expected %d usage records, got %d", len(tests), len(usage))
+	}
+	if u := usage[0]; u.StatusCode != http.StatusBadRequest || u.SubscriptionID == 0 || u.TenantID != "acme" || u.Path != "/catalog" {
+		t.Errorf("expected the rejected request metered against the subscription, got %+v", u)
+	}
+}
+
+func TestGateway_Mirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(HeaderMirror) != "" {
+			t.Error("primary received a mirrored request")
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer primary.Close()
+	release := make(chan struct{})
+	shadowBodies := make(chan string, 2)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- r.URL.Path + " " + string(body)
+		if r.URL.Query().Get("break") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write(body)
+	}))
+	defer shadow.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "orders",
+						PathPrefix:      "/orders",
+						StripPathPrefix: true,
+						BackendURL:      primary.URL,
+						Mirror:          &config.MirrorConfig{URL: shadow.URL, Compare: true},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	for _, target := range []string{"/orders/1", "/orders/2?break=1"} {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest("POST", target, strings.NewReader("payload")))
+		if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+			t.Fatalf("%s: client response affected by mirror: %d %q", target, rec.Code, rec.Body.String())
+		}
+	}
+	close(release)
+	got := map[string]bool{<-shadowBodies: true, <-shadowBodies: true}
+	if !got["/1 payload"] || !got["/2 payload"] {
+		t.Errorf("expected stripped paths and bodies on the shadow, got %v", got)
+	}
+
+	var results []store.MirrorResult
+	for i := 0; i < 100 && len(results) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		results = s.MirrorResultsSince(time.Now().Add(-time.Minute))
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 mirror results, got %d", len(results))
+	}
+	diffs := 0
+	for _, m := range results {
+		if !m.Compared || m.PrimaryStatus != http.StatusOK {
+			t.Errorf("unexpected result %+v", m)
+		}
+		if m.Diff != "" {
+			diffs++
+			if m.ShadowStatus != http.StatusInternalServerError || !strings.Contains(m.Diff, "status 200 vs 500") {
+				t.Errorf("unexpected diff %+v", m)
+			}
+		}
+	}
+	if diffs != 1 {
+		t.Errorf("expected 1 diff, got %d", diffs)
+	}
+	if usage := s.UsageSince(time.Now().Add(-time.Minute)); len(usage) != 2 {
+		t.Errorf("expected mirrored requests kept out of usage, got %d records", len(usage))
+	}
+}
+
+func TestGateway_Rewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Uri", r.URL.RequestURI())
+		for _, h := range []string{"X-Legacy", "X-Modern", "Cookie", "X-Client", "X-Sub", "X-Tenant", "X-Request-Id", "X-Trace"} {
+			w.Header()["Got-"+h] = r.Header.Values(h)
+		}
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "orders",
+						PathPrefix:      "/shop",
+						StripPathPrefix: true,
+						BackendURL:      backend.URL,
+						Rewrite: &config.RewriteConfig{
+							Path: []config.PathRewriteConfig{
+								{Regex: `^/orders/([0-9]+)$`, Replacement: "/v2/orders/$1/{tenant_id}"},
+								{Regex: `^/orders/(?P<id>.+)$`, Replacement: "/legacy/${id}"},
+							},
+							RequestHeaders: config.HeaderRulesConfig{
+								Rename: map[string]string{"X-Legacy": "X-Modern"},
+								Remove: []string{"cookie"},
+								Set: map[string]string{
+									"X-Client": "{client_ip}",
+									"X-Sub":    "{subscription_id}",
+									"X-Tenant": "{tenant_id}",
+								},
+								Add: map[string]string{"X-Trace": "rid={request_id}"},
+							},
+							AddQuery: map[string]string{"tenant": "{tenant_id}"},
+						},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", TenantID: "acme", Keys: []config.KeyConfig{{Name: "k", Value: "rewrite-key"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	send := func(path string) http.Header {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.1.2.3:4567"
+		req.Header.Set(HeaderAPIKey, "rewrite-key")
+		req.Header.Set("X-Legacy", "v")
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Trace", "client")
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rec.Code)
+		}
+		return rec.Header()
+	}
+
+	h := send("/shop/orders/42?x=1")
+	if got := h.Get("X-Uri"); got != "/v2/orders/42/acme?tenant=acme&x=1" {
+		t.Errorf("regex rewrite: got %q", got)
+	}
+	if got := send("/shop/orders/abc").Get("X-Uri"); got != "/legacy/abc?tenant=acme" {
+		t.Errorf("first matching rule only: got %q", got)
+	}
+	if h.Get("Got-X-Legacy") != "" || h.Get("Got-X-Modern") != "v" {
+		t.Errorf("rename: got legacy=%q modern=%q", h.Get("Got-X-Legacy"), h.Get("Got-X-Modern"))
+	}
+	if h.Get("Got-Cookie") != "" {
+		t.Error("expected Cookie to be removed")
+	}
+	if h.Get("Got-X-Client") != "10.1.2.3" || h.Get("Got-X-Tenant") != "acme" || h.Get("Got-X-Sub") == "" {
+		t.Errorf("templates: client=%q tenant=%q sub=%q", h.Get("Got-X-Client"), h.Get("Got-X-Tenant"), h.Get("Got-X-Sub"))
+	}
+	rid := h.Get("Got-X-Request-Id")
+	if trace := h.Values("Got-X-Trace"); rid == "" || len(trace) != 2 || trace[1] != "rid="+rid {
+		t.Errorf("expected generated request id appended to X-Trace, got %q (id %q)", trace, rid)
+	}
+
+	req := withClaims(httptest.NewRequest("GET", "/", nil), map[string]any{"sub": "user-1", "level": float64(3)})
+	vars := templateVars(req, map[string]string{"id": "7"}, nil)
+	if vars["claim.sub"] != "user-1" || vars["claim.level"] != "3" || vars["id"] != "7" {
+		t.Errorf("unexpected template vars %v", vars)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(HeaderTenantID, "spoofed")
+	if vars := templateVars(req, nil, nil); vars["tenant_id"] != "" {
+		t.Errorf("expected client tenant header to be ignored, got %q", vars["tenant_id"])
+	}
+	req = withClaims(req, map[string]any{"tenant_id": "acme"})
+	if vars := templateVars(req, nil, nil); vars["tenant_id"] != "acme" {
+		t.Errorf("expected tenant from claims, got %q", vars["tenant_id"])
+	}
+}
+
+func TestGateway_ResponseRules(t *testing.T) {
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Debug-Id", "abc")
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("Location", backendURL+"/home?x=1")
+			w.WriteHeader(http.StatusFound)
+		case "/external":
+			w.Header().Set("Location", "https://idp.example.com/auth")
+			w.WriteHeader(http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	backendURL = backend.URL
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "app",
+						PathPrefix:      "/app",
+						StripPathPrefix: true,
+						BackendURL:      backend.URL,
+						Response: &config.ResponseConfig{
+							Headers: config.HeaderRulesConfig{
+								Remove: []string{"Server", "x-powered-by"},
+								Rename: map[string]string{"X-Debug-Id": "X-Trace-Id"},
+								Set:    map[string]string{"X-Served-By": "apimcore", "X-Client": "{client_ip}"},
+							},
+							RewriteLocation: true,
+							StatusMap:       map[int]int{http.StatusInternalServerError: http.StatusBadGateway},
+						},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://api.example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.9:1234"
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("/app/login")
+	if got := rec.Header().Get("Location"); got != "http://api.example.com/app/home?x=1" {
+		t.Errorf("Location: got %q", got)
+	}
+	if rec.Header().Get("Server") != "" || rec.Header().Get("X-Powered-By") != "" {
+		t.Errorf("expected leaked headers removed, got %v", rec.Header())
+	}
+	if rec.Header().Get("X-Debug-Id") != "" || rec.Header().Get("X-Trace-Id") != "abc" {
+		t.Errorf("expected X-Debug-Id renamed, got %v", rec.Header())
+	}
+	if rec.Header().Get("X-Served-By") != "apimcore" || rec.Header().Get("X-Client") != "10.0.0.9" {
+		t.Errorf("expected headers set, got %v", rec.Header())
+	}
+	if got := send("/app/external").Header().Get("Location"); got != "https://idp.example.com/auth" {
+		t.Errorf("external Location rewritten to %q", got)
+	}
+	if rec := send("/app/fail"); rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 500 remapped to 502, got %d", rec.Code)
+	}
+}
+
+func TestGateway_Timeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(1200 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{Timeouts: config.TimeoutsConfig{TotalSeconds: 1}},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "strict", PathPrefix: "/strict", BackendURL: backend.URL},
+					{Name: "patient", PathPrefix: "/patient", BackendURL: backend.URL, Timeouts: &config.TimeoutsConfig{TotalSeconds: 5}},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/strict", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 from the inherited total timeout, got %d", rec.Code)
+	}
+	if ev := <-h.TrafficChan(); ev.Action != "TIMEOUT" {
+		t.Errorf("expected TIMEOUT action, got %q", ev.Action)
+	}
+
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/patient", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the API timeout to override the gateway one, got %d", rec.Code)
+	}
+}
+
+func TestGateway_RouteIsolationUnderReload(t *testing.T) {
+	const routes = 8
+	cfg := &config.Config{Products: []config.ProductConfig{{Slug: "p1"}}}
+	for i := 0; i < routes; i++ {
+		name := fmt.Sprintf("svc%d", i)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s:%s", name, r.URL.Path)
+		}))
+		defer backend.Close()
+		cfg.Products[0].Apis = append(cfg.Products[0].Apis, config.ApiConfig{
+			Name:            name,
+			PathPrefix:      "/" + name,
+			BackendURL:      backend.URL,
+			StripPathPrefix: true,
+		})
+	}
+	s := store.NewStore()
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	stop := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				gw.UpdateConfig(cfg)
+			}
+		}
+	}()
+
+	var failures atomic.Int64
+	done := make(chan struct{})
+	for w := 0; w < 16; w++ {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for n := 0; n < 100; n++ {
+				name := fmt.Sprintf("svc%d", (w+n)%routes)
+				path := fmt.Sprintf("/item/%d-%d", w, n)
+				rec := httptest.NewRecorder()
+				gw.ServeHTTP(rec, httptest.NewRequest("GET", "/"+name+path, nil))
+				if want := name + ":" + path; rec.Code != http.StatusOK || rec.Body.String() != want {
+					if failures.Add(1) == 1 {
+						t.Errorf("got %d %q, want %q", rec.Code, rec.Body.String(), want)
+					}
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < 16; w++ {
+		<-done
+	}
+	close(stop)
+	<-reloaded
+	if n := failures.Load(); n > 0 {
+		t.Errorf("%d requests reached the wrong backend or path", n)
+	}
+}
+
+func TestGateway_Protocols(t *testing.T) {
+	h2cOnly := new(http.Protocols)
+	h2cOnly.SetUnencryptedHTTP2(true)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Proto", r.Proto)
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{H2C: true},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "h1", PathPrefix: "/h1", BackendURL: backend.URL},
+					{Name: "h2c", PathPrefix: "/h2c", BackendURL: backend.URL, Protocol: "h2c"},
+					{Name: "bad", PathPrefix: "/bad", BackendURL: backend.URL, Protocol: "h2"},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+	gwSrv, err := NewServer(cfg.Gateway, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = gwSrv
+	srv.Start()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{Protocols: h2cOnly}}
+
+	for _, tc := range []struct{ path, proto string }{{"/h1", "HTTP/1.1"}, {"/h2c", "HTTP/2.0"}} {
+		resp, err := client.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Proto != "HTTP/2.0" {
+			t.Errorf("%s: expected an h2c listener, got %s", tc.path, resp.Proto)
+		}
+		if got := resp.Header.Get("X-Backend-Proto"); got != tc.proto {
+			t.Errorf("%s: backend saw %s, want %s", tc.path, got, tc.proto)
+		}
+		ev := <-h.TrafficChan()
+		if ev.Protocol != "HTTP/2.0" || ev.UpstreamProto != tc.proto {
+			t.Errorf("%s: traffic event protocols %q -> %q", tc.path, ev.Protocol, ev.UpstreamProto)
+		}
+	}
+	resp, err := client.Get(srv.URL + "/bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the h2 route over plain http to be skipped, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_GRPC(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			t.Errorf("backend got %s with TE %q", r.Proto, r.Header.Get("Te"))
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path == "/greet.Greeter/Missing" {
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "no such greeting")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{H2C: true},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "greeter", PathPrefix: "/greet.Greeter", BackendURL: backend.URL, Protocol: "grpc"},
+					{Name: "down", PathPrefix: "/down.Service", BackendURL: down.URL, Protocol: "grpc"},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+	gwSrv, err := NewServer(cfg.Gateway, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = gwSrv
+	srv.Start()
+	defer srv.Close()
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+
+	call := func(method string) *http.Response {
+		req, _ := http.NewRequest("POST", srv.URL+method, strings.NewReader("\x00\x00\x00\x00\x00"))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := call("/greet.Greeter/SayHello")
+	if resp.StatusCode != http.StatusOK || resp.Trailer.Get("Grpc-Status") != "5" || resp.Trailer.Get("Grpc-Message") != "no such greeting" {
+		t.Errorf("expected trailers to reach the client, got %d %v", resp.StatusCode, resp.Trailer)
+	}
+	if resp := call("/greet.Greeter/Missing"); resp.Header.Get("Grpc-Status") != "12" {
+		t.Errorf("expected trailers-only response, got %v", resp.Header)
+	}
+	if resp := call("/down.Service/Ping"); resp.StatusCode != http.StatusOK || resp.Header.Get("Grpc-Status") != "14" {
+		t.Errorf("expected UNAVAILABLE for a dead backend, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	got := make(map[string]int)
+	for _, u := range s.UsageSince(time.Now().Add(-time.Minute)) {
+		got[u.GrpcStatus] = u.StatusCode
+	}
+	want := map[string]int{"NotFound": 404, "Unimplemented": 501, "Unavailable": 503}
+	for code, status := range want {
+		if got[code] != status {
+			t.Errorf("usage for %s: got status %d, want %d (all: %v)", code, got[code], status, got)
+		}
+	}
+}
+
+func TestGateway_Transcoding(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/greet.v1.Greeter/SayHello" || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("backend got %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		frame, _ := io.ReadAll(r.Body)
+		var name string
+		var times uint64
+		for b := frame[5:]; len(b) > 0; {
+			num, typ, n := protowire.ConsumeTag(b)
+			b = b[n:]
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				v, n := protowire.ConsumeString(b)
+				name, b = v, b[n:]
+			case num == 2 && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(b)
+				times, b = v, b[n:]
+			default:
+				t.Fatalf("unexpected field %d", num)
+			}
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if name == "nobody" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "nobody%20here")
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		reply := protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), fmt.Sprintf("hello %s x%d", name, times))
+		out := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(reply)))
+		w.Write(append(out, reply...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "greeter",
+						PathPrefix:      "/greeter",
+						StripPathPrefix: true,
+						BackendURL:      backend.URL,
+						Protocol:        "grpc",
+						Transcoding:     &config.TranscodingConfig{DescriptorSet: writeGreeterDescriptorSet(t)},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/greeter/v1/greetings/alice?times=2", "", http.StatusOK, `{"message":"hello alice x2"}`},
+		{"POST", "/greeter/v1/greetings", `{"name":"bob"}`, http.StatusOK, `{"message":"hello bob x0"}`},
+		{"GET", "/greeter/v1/greetings/nobody", "", http.StatusNotFound, `{"code":5,"message":"nobody here","details":[]}`},
+		{"DELETE", "/greeter/v1/greetings/alice", "", http.StatusMethodNotAllowed, `{"code":12,"message":"method not allowed","details":[]}`},
+		{"GET", "/greeter/v1/greetings/alice?times=many", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d (%s)", tt.method, tt.path, rec.Code, tt.status, rec.Body.String())
+			continue
+		}
+		if got := strings.ReplaceAll(rec.Body.String(), " ", ""); tt.want != "" && got != strings.ReplaceAll(tt.want, " ", "") {
+			t.Errorf("%s %s: body %s, want %s", tt.method, tt.path, rec.Body.String(), tt.want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: content type %q", tt.method, tt.path, ct)
+		}
+	}
+
+	codes := make(map[string]int)
+	for _, u := range s.UsageSince(time.Now().Add(-time.Minute)) {
+		codes[u.GrpcStatus]++
+	}
+	if codes["OK"] != 2 || codes["NotFound"] != 1 || codes["InvalidArgument"] != 1 {
+		t.Errorf("unexpected gRPC codes in usage: %v", codes)
+	}
+	// Requests that cannot be transcoded are reported like the others.
+	actions := make(map[string]int)
+	for range tests {
+		actions[(<-h.TrafficChan()).Action]++
+	}
+	if actions["ALLOWED"] != 3 || actions["NO_ROUTE"] != 1 || actions["BAD_REQUEST"] != 1 {
+		t.Errorf("unexpected traffic actions: %v", actions)
+	}
+}
+
+// wsFrame encodes a final text frame, masked as clients must send it.
+func wsFrame(payload string, masked bool) []byte {
+	frame := []byte{0x81, byte(len(payload))}
+	data := []byte(payload)
+	if masked {
+		frame[1] |= 0x80
+		key := []byte{1, 2, 3, 4}
+		frame = append(frame, key...)
+		for i := range data {
+			data[i] ^= key[i%4]
+		}
+	}
+	return append(frame, data...)
+}
+
+// readWSFrame reads one short frame and returns its unmasked payload.
+func readWSFrame(r *bufio.Reader) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+	var key [4]byte
+	if head[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return "", err
+		}
+	}
+	data := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	if head[1]&0x80 != 0 {
+		for i := range data {
+			data[i] ^= key[i%4]
+		}
+	}
+	return string(data), nil
+}
+
+func metricValue(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			if m.GetGauge() != nil {
+				return m.GetGauge().GetValue()
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestGateway_WebSocket(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			w.Header().Set("X-Api", r.Header.Get("X-Api"))
+			return
+		}
+		if r.Header.Get("X-Api") != "chat-ws" {
+			http.Error(w, "upgrade routed to "+r.Header.Get("X-Api"), http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		for {
+			msg, err := readWSFrame(brw.Reader)
+			if err != nil {
+				return
+			}
+			conn.Write(wsFrame(msg, false))
+		}
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{Timeouts: config.TimeoutsConfig{TotalSeconds: 1}},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "chat", PathPrefix: "/chat", BackendURL: backend.URL, AddHeaders: map[string]string{"X-Api": "chat"}},
+					{
+						Name:       "chat-ws",
+						PathPrefix: "/chat",
+						BackendURL: backend.URL,
+						AddHeaders: map[string]string{"X-Api": "chat-ws"},
+						WebSocket:  &config.WebSocketConfig{IdleTimeoutSeconds: 1, MaxConnectionsPerSubscription: 1},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", Keys: []config.KeyConfig{{Name: "k", Value: "ws-key"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	reg := prometheus.NewRegistry()
+	gw := New(cfg, s, meter.New(s, reg), nil)
+	defer gw.Close()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest("GET", "/chat", nil))
+	if got := rec.Header().Get("X-Api"); got != "chat" {
+		t.Errorf("plain requests should keep the first route, got %q", got)
+	}
+
+	dial := func() (net.Conn, *bufio.Reader, int) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: gw\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nX-Api-Key: ws-key\r\n\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, resp.StatusCode
+	}
+
+	conn, br, status := dial()
+	defer conn.Close()
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", status)
+	}
+	if n := gw.ActiveConns(); n != 1 {
+		t.Errorf("expected 1 active connection, got %d", n)
+	}
+	if extra, _, status := dial(); status != http.StatusTooManyRequests {
+		t.Errorf("expected the second connection of the subscription to be refused, got %d", status)
+	} else {
+		extra.Close()
+	}
+
+	// Messages keep the connection alive past the total timeout.
+	for _, msg := range []string{"one", "two", "three"} {
+		conn.Write(wsFrame(msg, true))
+		if got, err := readWSFrame(br); err != nil || got != msg {
+			t.Fatalf("echo of %q: got %q, %v", msg, got, err)
+		}
+		time.Sleep(600 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var netErr net.Error
+	if _, err := readWSFrame(br); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); gw.ActiveConns() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := gw.ActiveConns(); n != 0 {
+		t.Errorf("expected no active connection after close, got %d", n)
+	}
+
+	if got := metricValue(t, reg, "apim_websocket_messages_total", map[string]string{"direction": "in"}); got != 3 {
+		t.Errorf("expected 3 messages in, got %v", got)
+	}
+	if got := metricValue(t, reg, "apim_websocket_messages_total", map[string]string{"direction": "out"}); got != 3 {
+		t.Errorf("expected 3 messages out, got %v", got)
+	}
+	if got := metricValue(t, reg, "apim_websocket_bytes_total", map[string]string{"direction": "in"}); got != 3*6+11 {
+		t.Errorf("expected 29 bytes in, got %v", got)
+	}
+	if got := metricValue(t, reg, "apim_websocket_connections", nil); got != 0 {
+		t.Errorf("expected no open connection in metrics, got %v", got)
+	}
+	upgrades := 0
+	for _, u := range s.UsageSince(time.Now().Add(-time.Minute)) {
+		if u.StatusCode == http.StatusSwitchingProtocols {
+			upgrades++
+		}
+	}
+	if upgrades != 1 {
+		t.Errorf("expected one upgrade in usage, got %d", upgrades)
+	}
+
+	again, _, status := dial()
+	defer again.Close()
+	if status != http.StatusSwitchingProtocols {
+		t.Errorf("expected the limit to be released after close, got %d", status)
+	}
+}
+
+func TestGateway_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first, second := `{"n":1}`+"\n", `{"n":2}`+"\n"
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Length", fmt.Sprint(len(first)+len(second)))
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, second)
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{Timeouts: config.TimeoutsConfig{TotalSeconds: 1}},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "feed", PathPrefix: "/feed", BackendURL: backend.URL, Streaming: true},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	got := make(chan string, 1)
+	go func() {
+		line, _ := br.ReadString('\n')
+		got <- line
+	}()
+	select {
+	case line := <-got:
+		if line != `{"n":1}`+"\n" {
+			t.Errorf("unexpected first line %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first line was not flushed to the client")
+	}
+	close(release)
+	if rest, _ := io.ReadAll(br); string(rest) != `{"n":2}`+"\n" {
+		t.Errorf("unexpected rest of stream %q", rest)
+	}
+
+	var usage []store.RequestUsage
+	for deadline := time.Now().Add(time.Second); len(usage) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		usage = s.UsageSince(time.Now().Add(-time.Minute))
+	}
+	if len(usage) != 1 {
+		t.Fatalf("expected one usage record, got %d", len(usage))
+	}
+	if u := usage[0]; u.ResponseTimeMs-u.TTFBMs < 200 {
+		t.Errorf("expected TTFB well below total latency, got ttfb=%dms total=%dms", u.TTFBMs, u.ResponseTimeMs)
+	}
+
+	var w http.ResponseWriter = &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	_, flusher := w.(http.Flusher)
+	_, hijacker := w.(http.Hijacker)
+	_, readerFrom := w.(io.ReaderFrom)
+	if !flusher || !hijacker || !readerFrom {
+		t.Errorf("recorder lost interfaces: flusher=%v hijacker=%v readerFrom=%v", flusher, hijacker, readerFrom)
+	}
+}
+
+func TestGateway_MTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{HeaderTenantID, HeaderClientCertSubject, HeaderClientCertSAN, HeaderClientCertFingerprint} {
+			w.Header().Set("Got-"+h, r.Header.Get(h))
+		}
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	server, serverCert := writeTestCert(t, dir, "server", "api.example.com")
+	partner, partnerCert := writeTestCert(t, dir, "partner", "partner.example.com")
+	stranger, _ := writeTestCert(t, dir, "stranger", "stranger.example.com")
+	s := store.NewStore()
+	cfg := &config.Config{
+		Gateway: config.GatewayConfig{
+			TLS: &config.TLSConfig{
+				Certificates:  []config.CertificateConfig{server},
+				ClientCAFiles: []string{partner.CertFile, stranger.CertFile},
+			},
+		},
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "partner", PathPrefix: "/partner", BackendURL: backend.URL, MTLS: MTLSRequired},
+					{Name: "plain", PathPrefix: "/plain", BackendURL: backend.URL},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{
+				DeveloperID:        "acme",
+				ProductSlug:        "p1",
+				TenantID:           "acme",
+				Keys:               []config.KeyConfig{{Name: "k", Value: "acme-key"}},
+				ClientCertificates: []config.ClientCertificateConfig{{Name: "partner", SAN: "partner.example.com"}},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), h)
+	defer gw.Close()
+	gwSrv, err := NewServer(cfg.Gateway, gw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gwSrv.ServeTLS(ln, "", "")
+	defer gwSrv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert)
+	send := func(path string, client *config.CertificateConfig, header http.Header) *http.Response {
+		t.Helper()
+		tc := &tls.Config{RootCAs: roots, ServerName: "api.example.com"}
+		if client != nil {
+			pair, err := tls.LoadX509KeyPair(client.CertFile, client.KeyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.Certificates = []tls.Certificate{pair}
+		}
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: tc}}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send("/partner", &partner, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for the partner certificate, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Got-" + HeaderTenantID); got != "acme" {
+		t.Errorf("expected the certificate to map to the acme subscription, got tenant %q", got)
+	}
+	fp, _, _ := certIdentity(partnerCert)
+	if resp.Header.Get("Got-"+HeaderClientCertSAN) != "partner.example.com" || resp.Header.Get("Got-"+HeaderClientCertFingerprint) != fp {
+		t.Errorf("unexpected identity headers %v", resp.Header)
+	}
+	if resp := send("/partner", nil, http.Header{HeaderAPIKey: {"acme-key"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a certificate, got %d", resp.StatusCode)
+	}
+	if resp := send("/partner", &stranger, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for an unmapped certificate, got %d", resp.StatusCode)
+	}
+	resp = send("/plain", &partner, http.Header{HeaderClientCertSubject: {"CN=admin"}})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Got-"+HeaderClientCertSubject) != "" {
+		t.Errorf("expected forged identity headers to be dropped, got %d %q", resp.StatusCode, resp.Header.Get("Got-"+HeaderClientCertSubject))
+	}
+	for _, want := range []int{http.StatusOK, http.StatusUnauthorized, http.StatusForbidden, http.StatusOK} {
+		ev := <-h.TrafficChan()
+		action := "ALLOWED"
+		if want != http.StatusOK {
+			action = "BLOCKED"
+		}
+		if ev.Status != want || ev.Action != action || ev.Route != ev.Path {
+			t.Errorf("expected a %s event with status %d, got %s %d on %q", action, want, ev.Action, ev.Status, ev.Route)
+		}
+	}
+}
+
+func TestGateway_Shutdown(t *testing.T) {
+	var arrived atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			io.Copy(io.Discard, brw)
+			return
+		}
+		if r.URL.Path == "/late" {
+			w.Write([]byte("late"))
+			return
+		}
+		arrived.Add(1)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "slow", PathPrefix: "/slow", BackendURL: backend.URL},
+					{Name: "events", PathPrefix: "/events", BackendURL: backend.URL, WebSocket: &config.WebSocketConfig{}},
+					{Name: "late", PathPrefix: "/late", BackendURL: backend.URL},
+				},
+			},
+		},
+		Gateway: config.GatewayConfig{ShutdownDelaySeconds: 1},
+	}
+	s.PopulateFromConfig(cfg)
+	start := func() (*Gateway, *http.Server, string) {
+		gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+		t.Cleanup(gw.Close)
+		srv, err := NewServer(config.GatewayConfig{}, gw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		return gw, srv, ln.Addr().String()
+	}
+
+	gw, srv, addr := start()
+	const n = 20
+	results := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			resp, err := http.Get("http://" + addr + "/slow")
+			if err != nil {
+				results <- err
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "done" {
+				err = fmt.Errorf("got %d %q", resp.StatusCode, body)
+			}
+			results <- err
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); arrived.Load() < n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d requests reached the backend", arrived.Load(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- gw.Shutdown(ctx, srv) }()
+	// Readiness fails first; requests on new connections are still served
+	// until the shutdown delay ends.
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if ok, _ := gw.Ready(); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the gateway not to be ready once shutting down")
+		}
+	}
+	lateConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the listener to accept connections during the shutdown delay: %v", err)
+	}
+	lateConn.SetDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprint(lateConn, "GET /late HTTP/1.1\r\nHost: gw\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(lateConn), nil)
+	if err != nil {
+		t.Fatalf("expected a request during the shutdown delay to be served: %v", err)
+	}
+	if body, _ := io.ReadAll(io.LimitReader(resp.Body, 4)); resp.StatusCode != http.StatusOK || string(body) != "late" {
+		t.Errorf("expected a request during the shutdown delay to be proxied, got %d %q", resp.StatusCode, body)
+	}
+	lateConn.Close()
+	refused := false
+	for deadline := time.Now().Add(3 * time.Second); !refused && time.Now().Before(deadline); {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			refused = true
+		} else {
+			conn.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if !refused {
+		t.Error("expected new connections to be refused while draining")
+	}
+	if ok, reason := gw.Ready(); ok || reason != "shutting down" {
+		t.Errorf("expected the gateway not to be ready while draining, got %v %q", ok, reason)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned with requests in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("request dropped during shutdown: %v", err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+
+	// WebSocket connections are drained until the deadline, then closed.
+	cfg.Gateway.ShutdownDelaySeconds = 0
+	gw, srv, addr = start()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /events HTTP/1.1\r\nHost: gw\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := gw.Shutdown(ctx, srv); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the open WebSocket to outlast the deadline, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("expected the WebSocket to be closed at the deadline, got %v", err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); gw.ActiveConns() != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := gw.ActiveConns(); n != 0 {
+		t.Errorf("expected no active connection after shutdown, got %d", n)
+	}
+}
+
+func TestGateway_Cache(t *testing.T) {
+	var calls atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/items":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Etag", `"v1"`)
+		case "/validated":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/lang":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		fmt.Fprintf(w, "%s %s %s", r.URL.Path, r.Header.Get("Accept-Language"), r.Header.Get(HeaderTenantID))
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "catalog",
+						PathPrefix:      "/catalog",
+						StripPathPrefix: true,
+						BackendURL:      backend.URL,
+						Cache:           &config.CacheConfig{DefaultTTLSeconds: 60},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "a", ProductSlug: "p1", TenantID: "tenant-a", Keys: []config.KeyConfig{{Name: "k", Value: "key-tenant-a"}}},
+			{DeveloperID: "b", ProductSlug: "p1", TenantID: "tenant-b", Keys: []config.KeyConfig{{Name: "k", Value: "key-tenant-b"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	reg := prometheus.NewRegistry()
+	h := hub.NewBroadcaster()
+	gw := New(cfg, s, meter.New(s, reg), h)
+	defer gw.Close()
+
+	send := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/catalog"+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, cache, body string, wantCalls int64) {
+		t.Helper()
+		if got := rec.Header().Get(HeaderCache); got != cache {
+			t.Errorf("X-Cache: got %q, want %q", got, cache)
+		}
+		if body != "" && rec.Body.String() != body {
+			t.Errorf("body: got %q, want %q", rec.Body.String(), body)
+		}
+		if got := calls.Load(); got != wantCalls {
+			t.Errorf("backend calls: got %d, want %d", got, wantCalls)
+		}
+	}
+
+	expect(send("GET", "/items", nil), CacheMiss, "/items  ", 1)
+	if ev := <-h.TrafficChan(); ev.Cache != CacheMiss {
+		t.Errorf("expected a MISS traffic event, got %q", ev.Cache)
+	}
+	rec := send("GET", "/items", nil)
+	expect(rec, CacheHit, "/items  ", 1)
+	if rec.Header().Get("Age") == "" {
+		t.Error("expected an Age header on a cache hit")
+	}
+	if ev := <-h.TrafficChan(); ev.Cache != CacheHit {
+		t.Errorf("expected a HIT traffic event, got %q", ev.Cache)
+	}
+	if rec := send("GET", "/items", map[string]string{"If-None-Match": `"v1"`}); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+	expect(send("HEAD", "/items", nil), CacheHit, "", 1)
+	expect(send("GET", "/items", map[string]string{"Cache-Control": "no-store"}), CacheBypass, "", 2)
+
+	// Subscriptions do not share responses by default.
+	expect(send("GET", "/items", map[string]string{HeaderAPIKey: "key-tenant-a"}), CacheMiss, "/items  tenant-a", 3)
+	expect(send("GET", "/items", map[string]string{HeaderAPIKey: "key-tenant-b"}), CacheMiss, "/items  tenant-b", 4)
+	expect(send("GET", "/items", map[string]string{HeaderAPIKey: "key-tenant-a"}), CacheHit, "/items  tenant-a", 4)
+
+	expect(send("GET", "/validated", nil), CacheMiss, "/validated  ", 5)
+	expect(send("GET", "/validated", nil), CacheRevalidated, "/validated  ", 6)
+
+	expect(send("GET", "/lang", map[string]string{"Accept-Language": "en"}), CacheMiss, "/lang en ", 7)
+	expect(send("GET", "/lang", map[string]string{"Accept-Language": "fr"}), CacheMiss, "/lang fr ", 8)
+	expect(send("GET", "/lang", map[string]string{"Accept-Language": "en"}), CacheHit, "/lang en ", 8)
+
+	expect(send("GET", "/private", nil), CacheMiss, "", 9)
+	expect(send("GET", "/private", nil), CacheMiss, "", 10)
+
+	expect(send("GET", "/defaults", nil), CacheMiss, "", 11)
+	expect(send("GET", "/defaults", nil), CacheHit, "", 11)
+	expect(send("POST", "/defaults", nil), CacheBypass, "", 12)
+	expect(send("GET", "/defaults", nil), CacheMiss, "", 13)
+
+	if n := gw.PurgeCache("", "/catalog/lang"); n != 2 {
+		t.Errorf("expected 2 purged responses, got %d", n)
+	}
+	expect(send("GET", "/lang", map[string]string{"Accept-Language": "en"}), CacheMiss, "/lang en ", 14)
+	expect(send("GET", "/items", nil), CacheHit, "", 14)
+
+	if got := metricValue(t, reg, "apim_cache_requests_total", map[string]string{"backend": "catalog", "result": "hit"}); got != 7 {
+		t.Errorf("expected 7 cache hits in metrics, got %v", got)
+	}
+}
+
+func TestGateway_CompressionFlush(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, `{"n":1}`+"\n")
+		w.(http.Flusher).Flush()
+		// Hold the response open like a long poll.
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:        "feed",
+						PathPrefix:  "/feed",
+						BackendURL:  backend.URL,
+						Compression: &config.CompressionConfig{ContentTypes: []string{"application/x-ndjson"}},
+					},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	// The request is cancelled once the test returns, so a response held
+	// back by the gateway cannot block the backend forever.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/feed", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	type result struct {
+		encoding, line string
+		err            error
+	}
+	got := make(chan result, 1)
+	go func() {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		got <- result{encoding: resp.Header.Get("Content-Encoding"), line: line}
+	}()
+	select {
+	case res := <-got:
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.encoding != "" || res.line != `{"n":1}`+"\n" {
+			t.Errorf("expected the first line sent uncompressed, got %q encoded %q", res.line, res.encoding)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first line was held back by compression")
+	}
+}
+
+func TestGateway_CacheTenantScope(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(w, r.Header.Get(HeaderTenantID))
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "catalog", PathPrefix: "/catalog", BackendURL: backend.URL, Cache: &config.CacheConfig{Scope: CacheScopeTenant}},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	// Requests go straight to the proxy handler, as if the JWT middleware
+	// had validated their token.
+	send := func(claims map[string]any, cache, body string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/catalog/items", nil)
+		if claims != nil {
+			req.Header.Set("Authorization", "Bearer token")
+			req = withClaims(req, claims)
+		}
+		rec := httptest.NewRecorder()
+		gw.proxyHandler(rec, req)
+		if got := rec.Header().Get(HeaderCache); got != cache || rec.Body.String() != body {
+			t.Errorf("got %s %q, want %s %q", got, rec.Body.String(), cache, body)
+		}
+	}
+	send(map[string]any{"tenant_id": "a"}, CacheMiss, "a")
+	send(map[string]any{"tenant_id": "b"}, CacheMiss, "b")
+	send(map[string]any{"tenant_id": "a"}, CacheHit, "a")
+	send(map[string]any{"sub": "no-tenant"}, CacheBypass, "")
+	send(nil, CacheMiss, "")
+	send(nil, CacheHit, "")
+}
+
+func TestGateway_CacheVersions(t *testing.T) {
+	var calls atomic.Int64
+	backend := func(version string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, version)
+		}))
+	}
+	v1, v2 := backend("v1"), backend("v2")
+	defer v1.Close()
+	defer v2.Close()
+
+	s := store.NewStore()
+	cache := &config.CacheConfig{DefaultTTLSeconds: 60}
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v1", BackendURL: v1.URL, Cache: cache},
+					{Name: "catalog", PathPrefix: "/catalog", Version: "v2", BackendURL: v2.URL, Cache: cache},
+				},
+			},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	send := func(version, cache, body string, wantCalls int64) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/catalog/items", nil)
+		req.Header.Set("Accept-Version", version)
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		if got := rec.Header().Get(HeaderCache); got != cache || rec.Body.String() != body {
+			t.Errorf("%s: got %s %q, want %s %q", version, got, rec.Body.String(), cache, body)
+		}
+		if got := calls.Load(); got != wantCalls {
+			t.Errorf("%s: backend calls: got %d, want %d", version, got, wantCalls)
+		}
+	}
+	send("v1", CacheMiss, "v1", 1)
+	send("v2", CacheMiss, "v2", 2)
+	send("v1", CacheHit, "v1", 2)
+	send("v2", CacheHit, "v2", 2)
+}
+
+func TestGateway_Compression(t *testing.T) {
+	payload := strings.Repeat(`{"id":1,"name":"widget"},`, 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Etag", `"v1"`)
+			io.WriteString(w, payload)
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":1}`)
+		case "/chunked":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"id":1}`)
+			w.(http.Flusher).Flush()
+			io.WriteString(w, `{"id":2}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, payload)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, "already compressed")
+		case "/echo":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "%s:", r.Header.Get("Content-Encoding"))
+			io.Copy(w, r.Body)
+		}
+	}))
+	defer backend.Close()
+
+	s := store.NewStore()
+	cfg := &config.Config{
+		Products: []config.ProductConfig{
+			{
+				Slug: "p1",
+				Apis: []config.ApiConfig{
+					{
+						Name:            "catalog",
+						PathPrefix:      "/catalog",
+						StripPathPrefix: true,
+						BackendURL:      backend.URL,
+						Compression:     &config.CompressionConfig{DecompressRequests: true, MaxDecompressedBytes: 4096},
+					},
+				},
+			},
+		},
+		Subscriptions: []config.SubscriptionConfig{
+			{DeveloperID: "dev1", ProductSlug: "p1", TenantID: "acme", Keys: []config.KeyConfig{{Name: "k", Value: "compression-key"}}},
+		},
+	}
+	s.PopulateFromConfig(cfg)
+	gw := New(cfg, s, meter.New(s, prometheus.NewRegistry()), nil)
+	defer gw.Close()
+
+	send := func(method, path, acceptEncoding string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/catalog"+path, body)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		gw.ServeHTTP(rec, req)
+		return rec
+	}
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		EncodingGzip:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		EncodingBrotli: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		EncodingZstd:   func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+	for enc, decode := range decoders {
+		rec := send("GET", "/items", enc, nil)
+		if got := rec.Header().Get("Content-Encoding"); got != enc {
+			t.Errorf("%s: got Content-Encoding %q", enc, got)
+			continue
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" || rec.Header().Get("Etag") != `W/"v1"` {
+			t.Errorf("%s: unexpected headers %v", enc, rec.Header())
+		}
+		if rec.Body.Len() >= len(payload) {
+			t.Errorf("%s: body not compressed: %d bytes", enc, rec.Body.Len())
+		}
+		r, err := decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", enc, err)
+		}
+		if got, _ := io.ReadAll(r); string(got) != payload {
+			t.Errorf("%s: body does not decode to the original", enc)
+		}
+	}
+
+	for _, tt := range []struct{ path, accept string }{
+		{"/items", ""},
+		{"/small", "gzip"},
+		{"/chunked", "gzip"},
+		{"/image", "gzip"},
+	} {
+		if rec := send("GET", tt.path, tt.accept, nil); rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s with %q: expected an uncompressed response", tt.path, tt.accept)
+		}
+	}
+	if rec := send("GET", "/chunked", "gzip", nil); rec.Body.String() != `{"id":1}{"id":2}` {
+		t.Errorf("expected a small chunked response sent as is, got %q", rec.Body.String())
+	}
+	if rec := send("GET", "/encoded", "br", nil); rec.Header().Get("Content-Encoding") != "gzip" || rec.Body.String() != "already compressed" {
+		t.Errorf("expected an encoded response to pass through, got %v %q", rec.Header(), rec.Body.String())
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	io.WriteString(zw, "hello")
+	zw.Close()
+	req := httptest.NewRequest("POST", "/catalog/echo", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Body.String() != ":hello" {
+		t.Errorf("expected the request body to be decompressed, got %q", rec.Body.String())
+	}
+	req = httptest.NewRequest("POST", "/catalog/echo", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(HeaderAPIKey, "compression-key")
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid gzip body, got %d", rec.Code)
+	}
+
+	if !slices.ContainsFunc(s.UsageSince(time.Now().Add(-time.Minute)), func(u store.RequestUsage) bool {
+		return u.StatusCode == http.StatusBadRequest && u.TenantID == "acme" && u.SubscriptionID != 0
+	}) {
+		t.Error("expected the rejected body to be recorded with its subscription")
+	}
+
+	body.Reset()
+	zw = gzip.NewWriter(&body)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	req = httptest.NewRequest("POST", "/catalog/echo", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body decompressing past the limit, got %d", rec.Code)
+	}
+
+	responseBytes, sentBytes, _ := s.ResponseBytesSince(time.Now().Add(-time.Minute))
+	if responseBytes <= sentBytes {
+		t.Errorf("expected usage to show compression savings, got response=%d sent=%d", responseBytes, sentBytes)
+	}
+}
@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used by the gateway itself.
+const (
+	grpcDeadlineExceeded = 4
+	grpcUnavailable      = 14
+)
+
+var grpcCodeNames = [...]string{
+	"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded",
+	"NotFound", "AlreadyExists", "PermissionDenied", "ResourceExhausted",
+	"FailedPrecondition", "Aborted", "OutOfRange", "Unimplemented",
+	"Internal", "Unavailable", "DataLoss", "Unauthenticated",
+}
+
+// grpcHTTPStatus maps gRPC codes to the HTTP status recorded in usage and
+// metrics, following the mapping of the gRPC HTTP/JSON gateways.
+var grpcHTTPStatus = [...]int{
+	http.StatusOK, 499, http.StatusInternalServerError, http.StatusBadRequest,
+	http.StatusGatewayTimeout, http.StatusNotFound, http.StatusConflict,
+	http.StatusForbidden, http.StatusTooManyRequests, http.StatusBadRequest,
+	http.StatusConflict, http.StatusBadRequest, http.StatusNotImplemented,
+	http.StatusInternalServerError, http.StatusServiceUnavailable,
+	http.StatusInternalServerError, http.StatusUnauthorized,
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus returns the grpc-status of a proxied response, read from its
+// trailers or, for trailers-only responses, its headers.
+func grpcStatus(h http.Header) (int, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil || code < 0 {
+		return 0, false
+	}
+	return code, true
+}
+
+func grpcCodeName(code int) string {
+	if code < len(grpcCodeNames) {
+		return grpcCodeNames[code]
+	}
+	return fmt.Sprintf("Code(%d)", code)
+}
+
+func grpcToHTTPStatus(code int) int {
+	if code < len(grpcHTTPStatus) {
+		return grpcHTTPStatus[code]
+	}
+	return http.StatusInternalServerError
+}
+
+// writeGRPCError answers a gRPC request with a trailers-only response.
+func writeGRPCError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	h.Set("Grpc-Message", url.PathEscape(msg))
+	w.WriteHeader(http.StatusOK)
+}
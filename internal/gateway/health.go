@@ -0,0 +1,336 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const (
+	DefaultHealthCheckPath           = "/"
+	DefaultHealthCheckInterval       = 10 * time.Second
+	DefaultHealthCheckTimeout        = 2 * time.Second
+	DefaultHealthyThreshold          = 2
+	DefaultUnhealthyThreshold        = 3
+	healthCheckMaxDrain        int64 = 4 << 10
+)
+
+// UpstreamHealth is the health state of one upstream target as reported by
+// the admin API and the TUI.
+type UpstreamHealth struct {
+	Api       string    `json:"api"`
+	Product   string    `json:"product,omitempty"`
+	Upstream  string    `json:"upstream"`
+	Checked   bool      `json:"checked"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Circuit   string    `json:"circuit"`
+}
+
+// targetHealth is the health state shared by every upstream target probing
+// the same URL with the same health check. Targets start healthy so that
+// traffic flows before the first probe completes.
+type targetHealth struct {
+	healthy atomic.Bool
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	lastError string
+}
+
+func newTargetHealth() *targetHealth {
+	h := &targetHealth{}
+	h.healthy.Store(true)
+	return h
+}
+
+func (h *targetHealth) snapshot() (healthy bool, lastCheck time.Time, lastError string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy.Load(), h.lastCheck, h.lastError
+}
+
+// healthProbe periodically checks one upstream URL and flips its health
+// state after enough consecutive successes or failures.
+type healthProbe struct {
+	url                string
+	expectedStatus     int
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+	client             *http.Client
+	tls                *upstreamTLS
+	tlsConfig          *tls.Config
+	health             *targetHealth
+	stop               chan struct{}
+	successes          int
+	failures           int
+}
+
+func newHealthProbe(baseURL string, hc *config.HealthCheckConfig, u *upstreamTLS) *healthProbe {
+	p := &healthProbe{
+		url:                baseURL + hc.Path,
+		expectedStatus:     hc.ExpectedStatus,
+		interval:           time.Duration(hc.IntervalSeconds) * time.Second,
+		timeout:            time.Duration(hc.TimeoutSeconds) * time.Second,
+		healthyThreshold:   hc.HealthyThreshold,
+		unhealthyThreshold: hc.UnhealthyThreshold,
+		tls:                u,
+		health:             newTargetHealth(),
+		stop:               make(chan struct{}),
+	}
+	if hc.Path == "" {
+		p.url = baseURL + DefaultHealthCheckPath
+	}
+	if p.interval <= 0 {
+		p.interval = DefaultHealthCheckInterval
+	}
+	if p.timeout <= 0 {
+		p.timeout = DefaultHealthCheckTimeout
+	}
+	if p.healthyThreshold <= 0 {
+		p.healthyThreshold = DefaultHealthyThreshold
+	}
+	if p.unhealthyThreshold <= 0 {
+		p.unhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	p.client = &http.Client{
+		Timeout: p.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return p
+}
+
+func (p *healthProbe) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	p.check()
+	for {
+		select {
+		case <-ticker.C:
+			p.check()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *healthProbe) check() {
+	err := p.probe()
+	h := p.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		p.successes = 0
+		p.failures++
+		if p.failures >= p.unhealthyThreshold && h.healthy.Load() {
+			h.healthy.Store(false)
+			log.Printf("apimcore gateway: upstream %s is unhealthy: %v", p.url, err)
+		}
+		return
+	}
+	h.lastError = ""
+	p.failures = 0
+	p.successes++
+	if p.successes >= p.healthyThreshold && !h.healthy.Load() {
+		h.healthy.Store(true)
+		log.Printf("apimcore gateway: upstream %s is healthy again", p.url)
+	}
+}
+
+func (p *healthProbe) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "apimcore-health-check")
+	if tc := p.tls.clientConfig(); tc != p.tlsConfig {
+		if old, ok := p.client.Transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+		p.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tc}
+		p.tlsConfig = tc
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.CopyN(io.Discard, resp.Body, healthCheckMaxDrain)
+	resp.Body.Close()
+	if p.expectedStatus > 0 {
+		if resp.StatusCode != p.expectedStatus {
+			return fmt.Errorf("status %d, want %d", resp.StatusCode, p.expectedStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d, want 2xx", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthMonitor owns the running health probes. Probes are shared by every
+// target with the same URL and health check, so the config route and the
+// store definition of an API do not probe the backend twice.
+type healthMonitor struct {
+	mu     sync.Mutex
+	probes map[string]*healthProbe
+}
+
+func newHealthMonitor() *healthMonitor {
+	return &healthMonitor{probes: make(map[string]*healthProbe)}
+}
+
+func probeKey(baseURL string, hc *config.HealthCheckConfig, u *upstreamTLS) string {
+	if u == nil {
+		return fmt.Sprintf("%s|%+v", baseURL, *hc)
+	}
+	return fmt.Sprintf("%s|%+v|%+v", baseURL, *hc, u.cfg)
+}
+
+// attach starts (or reuses) the probes for every target of the pool. Probes
+// connect to https upstreams with the upstream TLS settings of the API.
+func (m *healthMonitor) attach(pool *upstreamPool, hc *config.HealthCheckConfig, u *upstreamTLS) {
+	if pool == nil || hc == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range pool.targets {
+		base := t.url.Scheme + "://" + t.url.Host
+		key := probeKey(base, hc, u)
+		p := m.probes[key]
+		if p == nil {
+			p = newHealthProbe(base, hc, u)
+			m.probes[key] = p
+			go p.run()
+		}
+		t.health = p.health
+		t.healthKey = key
+	}
+}
+
+// retain stops every probe not used by the given routes.
+func (m *healthMonitor) retain(routes []*route) {
+	used := make(map[string]bool)
+	for _, rt := range routes {
+		if rt.upstreams == nil {
+			continue
+		}
+		for _, t := range rt.upstreams.targets {
+			if t.healthKey != "" {
+				used[t.healthKey] = true
+			}
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, p := range m.probes {
+		if !used[key] {
+			close(p.stop)
+			delete(m.probes, key)
+		}
+	}
+}
+
+// close stops every probe.
+func (m *healthMonitor) close() {
+	m.retain(nil)
+}
+
+// retainHealthChecks stops the probes and drops the circuit breakers no
+// longer referenced by the config routes or the compiled store
+// definitions. Callers hold g.mu and, when passing g.defRoutes,
+// g.defRoutesMu.
+func (g *Gateway) retainHealthChecks(defRoutes map[int64]*routeTable) {
+	routes := append([]*route(nil), g.routes.routes...)
+	for _, t := range defRoutes {
+		routes = append(routes, t.routes...)
+	}
+	g.health.retain(routes)
+	g.breakers.retain(routes)
+}
+
+// UpstreamHealth returns the health state of the upstreams of every API
+// declared in the config file.
+func (g *Gateway) UpstreamHealth() []UpstreamHealth {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var out []UpstreamHealth
+	for _, rt := range g.routes.routes {
+		if rt.upstreams == nil {
+			continue
+		}
+		for _, t := range rt.upstreams.targets {
+			s := UpstreamHealth{
+				Api:      rt.def.Name,
+				Product:  rt.product,
+				Upstream: t.url.String(),
+				Healthy:  true,
+				Circuit:  g.breakers.state(rt.def.Name, t.url.String()).String(),
+			}
+			if t.health != nil {
+				s.Checked = true
+				s.Healthy, s.LastCheck, s.LastError = t.health.snapshot()
+			}
+			out = append(out, s)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Product != out[j].Product {
+			return out[i].Product < out[j].Product
+		}
+		return out[i].Api < out[j].Api
+	})
+	return out
+}
+
+// Ready reports whether every product with upstreams has at least one
+// healthy target. The reason lists the products without one. A gateway
+// shutting down is never ready.
+func (g *Gateway) Ready() (bool, string) {
+	if g.draining.Load() {
+		return false, "shutting down"
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	hasTargets := make(map[string]bool)
+	healthy := make(map[string]bool)
+	for _, rt := range g.routes.routes {
+		if rt.upstreams == nil {
+			continue
+		}
+		for _, t := range rt.upstreams.targets {
+			hasTargets[rt.product] = true
+			if t.healthy() {
+				healthy[rt.product] = true
+			}
+		}
+	}
+	var down []string
+	for product := range hasTargets {
+		if !healthy[product] {
+			down = append(down, product)
+		}
+	}
+	if len(down) == 0 {
+		return true, ""
+	}
+	sort.Strings(down)
+	return false, fmt.Sprintf("no healthy upstream for products: %v", down)
+}
@@ -75,6 +75,7 @@ func (g *Gateway) JWTMiddleware() Middleware {
 			if tenantID, ok := claims["tenant_id"].(string); ok {
 				r.Header.Set(HeaderTenantID, tenantID)
 			}
+			r = withClaims(r, claims)
 
 			next.ServeHTTP(w, r)
 		})
@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+const (
+	HeaderMirror              = "X-Mirror"
+	DefaultMirrorTimeout      = 10 * time.Second
+	DefaultMirrorMaxBodyBytes = 1 << 20
+	MaxInFlightMirrors        = 256
+)
+
+// mirror is the compiled mirror configuration of an API.
+type mirror struct {
+	target     *url.URL
+	percentage float64
+	compare    bool
+	timeout    time.Duration
+	maxBody    int64
+}
+
+func newMirror(cfg *config.MirrorConfig) (*mirror, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("mirror %q: %w", cfg.URL, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("mirror %q: absolute URL required", cfg.URL)
+	}
+	m := &mirror{
+		target:     target,
+		percentage: cfg.Percentage,
+		compare:    cfg.Compare,
+		timeout:    time.Duration(cfg.TimeoutSeconds) * time.Second,
+		maxBody:    cfg.MaxBodyBytes,
+	}
+	if m.percentage <= 0 {
+		m.percentage = 100
+	}
+	if m.timeout <= 0 {
+		m.timeout = DefaultMirrorTimeout
+	}
+	if m.maxBody <= 0 {
+		m.maxBody = DefaultMirrorMaxBodyBytes
+	}
+	return m, nil
+}
+
+func (m *mirror) sample() bool {
+	return m.percentage >= 100 || rand.Float64()*100 < m.percentage
+}
+
+// mirrorRequest is a shadow request in flight. The primary response is
+// handed over with finish once the client has been served.
+type mirrorRequest struct {
+	primary chan primaryResult
+	capture *captureBuffer
+}
+
+type primaryResult struct {
+	status int
+	ms     int64
+}
+
+// startMirror sends a copy of r to the mirror of rt in the background. The
+// request body is buffered so both backends receive it; requests with a
+// body larger than the mirror limit are not mirrored. It returns nil when
+// the request is not mirrored.
+func (g *Gateway) startMirror(r *http.Request, rt *route, rewrite func(*url.URL, http.Header)) *mirrorRequest {
+	m := rt.mirror
+	if m == nil || !m.sample() {
+		return nil
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, replay, ok, err := bufferBody(r.Body, m.maxBody)
+		if err != nil {
+			return nil
+		}
+		if !ok {
+			r.Body = replay
+			return nil
+		}
+		body = buf
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	select {
+	case g.mirrorSem <- struct{}{}:
+	default:
+		return nil
+	}
+
+	method := r.Method
+	u := *r.URL
+	header := r.Header.Clone()
+	rewrite(&u, header)
+	u.Scheme = m.target.Scheme
+	u.Host = m.target.Host
+	header.Set(HeaderMirror, "true")
+	mr := &mirrorRequest{primary: make(chan primaryResult, 1)}
+	if m.compare {
+		mr.capture = &captureBuffer{limit: m.maxBody}
+	}
+	res := store.MirrorResult{
+		ApiDefinitionID: rt.def.ID,
+		Api:             rt.def.Name,
+		Method:          r.Method,
+		Path:            r.URL.Path,
+		Target:          m.target.Host,
+	}
+	go func() {
+		defer func() { <-g.mirrorSem }()
+		shadow := g.sendMirror(m, method, u.String(), header, body, &res)
+		p := <-mr.primary
+		res.PrimaryStatus, res.PrimaryMs = p.status, p.ms
+		if m.compare && res.Error == "" {
+			res.Compared = true
+			res.Diff = diffResponses(res.PrimaryStatus, res.ShadowStatus, mr.capture, shadow)
+		}
+		g.store.RecordMirror(res)
+	}()
+	return mr
+}
+
+func (g *Gateway) sendMirror(m *mirror, method, target string, header http.Header, body []byte, res *store.MirrorResult) *captureBuffer {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		res.Error = err.Error()
+		return nil
+	}
+	req.Header = header
+	start := time.Now()
+	resp, err := g.mirrorClient.Do(req)
+	if err != nil {
+		res.ShadowMs = time.Since(start).Milliseconds()
+		res.Error = err.Error()
+		return nil
+	}
+	defer resp.Body.Close()
+	shadow := &captureBuffer{limit: m.maxBody}
+	if !m.compare {
+		shadow.limit = 0
+	}
+	_, err = io.Copy(shadow, resp.Body)
+	res.ShadowMs = time.Since(start).Milliseconds()
+	res.ShadowStatus = resp.StatusCode
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return shadow
+}
+
+// finish hands the primary response over to the shadow request. It is safe
+// to call on a nil mirrorRequest.
+func (mr *mirrorRequest) finish(status int, ms int64) {
+	if mr == nil {
+		return
+	}
+	mr.primary <- primaryResult{status: status, ms: ms}
+}
+
+// diffResponses summarizes the differences between the primary and shadow
+// responses. It returns "" when they match.
+func diffResponses(primaryStatus, shadowStatus int, primary, shadow *captureBuffer) string {
+	var diffs []string
+	if primaryStatus != shadowStatus {
+		diffs = append(diffs, fmt.Sprintf("status %d vs %d", primaryStatus, shadowStatus))
+	}
+	switch {
+	case primary.truncated || shadow.truncated:
+		diffs = append(diffs, fmt.Sprintf("body not compared: larger than %d bytes", primary.limit))
+	case !bytes.Equal(primary.buf.Bytes(), shadow.buf.Bytes()):
+		diffs = append(diffs, fmt.Sprintf("body differs: %d vs %d bytes", primary.buf.Len(), shadow.buf.Len()))
+	}
+	return strings.Join(diffs, "; ")
+}
+
+// captureBuffer keeps the first limit bytes written to it and remembers
+// whether more were written.
+type captureBuffer struct {
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - int64(c.buf.Len()); room > 0 {
+		if int64(len(p)) > room {
+			c.buf.Write(p[:room])
+			c.truncated = true
+		} else {
+			c.buf.Write(p)
+		}
+	} else if len(p) > 0 && c.limit > 0 {
+		c.truncated = true
+	}
+	return len(p), nil
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	MTLSOff      = "off"
+	MTLSOptional = "optional"
+	MTLSRequired = "required"
+
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertSAN         = "X-Client-Cert-San"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+// mtlsPolicy validates the mtls setting of an API; empty means off.
+func mtlsPolicy(s string) (string, error) {
+	switch p := strings.ToLower(s); p {
+	case "", MTLSOff:
+		return MTLSOff, nil
+	case MTLSOptional, MTLSRequired:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown mtls policy %q", s)
+	}
+}
+
+// clientCertificate returns the client certificate of r once verified
+// against the client CAs of the listener, or nil.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// certIdentity returns the values a client certificate is matched on:
+// SHA-256 fingerprint, subject and SANs.
+func certIdentity(cert *x509.Certificate) (fingerprint, subject string, sans []string) {
+	sum := sha256.Sum256(cert.Raw)
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return hex.EncodeToString(sum[:]), cert.Subject.String(), sans
+}
+
+// setClientCertHeaders forwards the identity of cert to the backend. The
+// headers are always removed from the client request first, so they
+// cannot be forged.
+func setClientCertHeaders(h http.Header, cert *x509.Certificate) {
+	h.Del(HeaderClientCertSubject)
+	h.Del(HeaderClientCertSAN)
+	h.Del(HeaderClientCertFingerprint)
+	if cert == nil {
+		return
+	}
+	fingerprint, subject, sans := certIdentity(cert)
+	h.Set(HeaderClientCertSubject, subject)
+	h.Set(HeaderClientCertFingerprint, fingerprint)
+	if len(sans) > 0 {
+		h.Set(HeaderClientCertSAN, strings.Join(sans, ","))
+	}
+}
+
+// loadCertPool reads PEM certificate bundles into a pool.
+func loadCertPool(files []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", f)
+		}
+	}
+	return pool, nil
+}
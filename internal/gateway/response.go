@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+// responseRules is the compiled response block of an API, applied to
+// backend responses from ReverseProxy.ModifyResponse: status remapping,
+// Location rewriting, then header rules.
+type responseRules struct {
+	headers         *headerRules
+	rewriteLocation bool
+	status          map[int]int
+}
+
+func newResponseRules(cfg *config.ResponseConfig) (*responseRules, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	for from, to := range cfg.StatusMap {
+		if from < 100 || from > 999 || to < 100 || to > 999 {
+			return nil, fmt.Errorf("invalid status mapping %d -> %d", from, to)
+		}
+	}
+	return &responseRules{
+		headers:         newHeaderRules(cfg.Headers),
+		rewriteLocation: cfg.RewriteLocation,
+		status:          cfg.StatusMap,
+	}, nil
+}
+
+// modifyResponse applies the response rules of the route serving resp.
+func modifyResponse(resp *http.Response) error {
+	state, _ := resp.Request.Context().Value(proxyStateKey{}).(*proxyState)
+	if state == nil {
+		return nil
+	}
+	if state.websocket != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		state.websocket.upgrade(resp)
+	}
+	if state.transcode != nil {
+		code, err := state.transcode.transcodeResponse(resp)
+		if err != nil {
+			return err
+		}
+		state.grpcCode = grpcCodeName(code)
+	}
+	if state.response == nil {
+		return nil
+	}
+	rules := state.response
+	if to, ok := rules.status[resp.StatusCode]; ok {
+		resp.StatusCode = to
+		resp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+	}
+	if rules.rewriteLocation && state.publicURL != nil {
+		if loc := resp.Header.Get("Location"); loc != "" {
+			resp.Header.Set("Location", publicLocation(loc, resp.Request.URL.Host, state))
+		}
+	}
+	rules.headers.apply(resp.Header, state.vars)
+	return nil
+}
+
+// publicLocation rewrites a Location pointing at one of the backends of the
+// route to the public scheme and host the client used, restoring the
+// stripped path prefix. Other locations are returned unchanged.
+func publicLocation(loc, backendHost string, state *proxyState) string {
+	u, err := url.Parse(loc)
+	if err != nil || u.Host == "" {
+		return loc
+	}
+	internal := strings.EqualFold(u.Host, backendHost)
+	if !internal && state.pool != nil {
+		for _, t := range state.pool.targets {
+			if strings.EqualFold(u.Host, t.url.Host) {
+				internal = true
+				break
+			}
+		}
+	}
+	if !internal {
+		return loc
+	}
+	u.Scheme = state.publicURL.Scheme
+	u.Host = state.publicURL.Host
+	if prefix := state.publicURL.Path; prefix != "" {
+		u.Path = strings.TrimSuffix(prefix, "/") + u.Path
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// publicURL returns the scheme and host the client used to reach the
+// gateway, with the path prefix stripped before forwarding, if any.
+func publicURL(r *http.Request, strippedPrefix string) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host, Path: strippedPrefix}
+}
@@ -0,0 +1,236 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const (
+	DefaultRetryBackoffBase           = 25 * time.Millisecond
+	DefaultRetryBackoffMax            = 250 * time.Millisecond
+	DefaultRetryMaxBodyBytes          = 1 << 20
+	DefaultRetryBudgetRatio           = 0.2
+	DefaultRetryBudgetMinPerSec       = 10
+	DefaultRetryBudgetWindow          = 10 * time.Second
+	retryDrainBytes             int64 = 4 << 10
+)
+
+// Error classes accepted in retry.retry_on_errors.
+const (
+	RetryOnConnectFailure = "connect_failure"
+	RetryOnReset          = "reset"
+	RetryOnTimeout        = "timeout"
+)
+
+var (
+	defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	defaultRetryErrors   = []string{RetryOnConnectFailure, RetryOnReset}
+)
+
+// retryPolicy is the compiled retry configuration of an API.
+type retryPolicy struct {
+	attempts      int
+	statuses      map[int]bool
+	errors        map[string]bool
+	nonIdempotent bool
+	backoffBase   time.Duration
+	backoffMax    time.Duration
+	maxBodyBytes  int64
+}
+
+func newRetryPolicy(cfg *config.RetryConfig) (*retryPolicy, error) {
+	if cfg == nil || cfg.Attempts <= 1 {
+		return nil, nil
+	}
+	p := &retryPolicy{
+		attempts:      cfg.Attempts,
+		statuses:      make(map[int]bool),
+		errors:        make(map[string]bool),
+		nonIdempotent: cfg.RetryNonIdempotent,
+		backoffBase:   time.Duration(cfg.BackoffBaseMs) * time.Millisecond,
+		backoffMax:    time.Duration(cfg.BackoffMaxMs) * time.Millisecond,
+		maxBodyBytes:  cfg.MaxBodyBytes,
+	}
+	statuses, errs := cfg.RetryOnStatus, cfg.RetryOnErrors
+	if statuses == nil {
+		statuses = defaultRetryStatuses
+	}
+	if errs == nil {
+		errs = defaultRetryErrors
+	}
+	for _, s := range statuses {
+		p.statuses[s] = true
+	}
+	for _, e := range errs {
+		switch e {
+		case RetryOnConnectFailure, RetryOnReset, RetryOnTimeout:
+			p.errors[e] = true
+		default:
+			return nil, fmt.Errorf("unknown retry_on_errors value %q", e)
+		}
+	}
+	if p.backoffBase <= 0 {
+		p.backoffBase = DefaultRetryBackoffBase
+	}
+	if p.backoffMax <= 0 {
+		p.backoffMax = DefaultRetryBackoffMax
+	}
+	if p.maxBodyBytes <= 0 {
+		p.maxBodyBytes = DefaultRetryMaxBodyBytes
+	}
+	return p, nil
+}
+
+// allows reports whether requests with the given method may be retried.
+func (p *retryPolicy) allows(method string) bool {
+	if p == nil {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return p.nonIdempotent
+}
+
+// retryableError reports whether err belongs to a retryable error class.
+func (p *retryPolicy) retryableError(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return p.errors[RetryOnConnectFailure]
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.errors[RetryOnConnectFailure]
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT) {
+		return p.errors[RetryOnTimeout]
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return p.errors[RetryOnTimeout]
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return p.errors[RetryOnReset]
+	}
+	return false
+}
+
+// backoff returns the delay before retry n (1-based): exponential growth
+// capped at backoffMax, with the upper half randomized.
+func (p *retryPolicy) backoff(n int) time.Duration {
+	d := p.backoffBase << (n - 1)
+	if d <= 0 || d > p.backoffMax {
+		d = p.backoffMax
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// retryBudget caps retries gateway-wide to a share of the requests seen in
+// the current window, so a failing backend does not multiply its own load.
+// A minimum number of retries per second is always allowed so that low
+// traffic APIs can still retry.
+type retryBudget struct {
+	ratio     float64
+	minPerSec int
+	window    time.Duration
+	now       func() time.Time
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func newRetryBudget(cfg config.RetryBudgetConfig) *retryBudget {
+	b := &retryBudget{
+		ratio:     cfg.Ratio,
+		minPerSec: cfg.MinRetriesPerSecond,
+		window:    time.Duration(cfg.WindowSeconds) * time.Second,
+		now:       time.Now,
+	}
+	if b.ratio <= 0 {
+		b.ratio = DefaultRetryBudgetRatio
+	}
+	if b.minPerSec <= 0 {
+		b.minPerSec = DefaultRetryBudgetMinPerSec
+	}
+	if b.window <= 0 {
+		b.window = DefaultRetryBudgetWindow
+	}
+	return b
+}
+
+func (b *retryBudget) roll() {
+	if now := b.now(); now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request counts one original request.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+// withdraw reserves one retry, or reports false when the budget is spent.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	limit := max(int(b.ratio*float64(b.requests)), b.minPerSec*int(b.window/time.Second))
+	if b.retries >= limit {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// bufferBody reads up to limit bytes of body so it can be replayed on
+// retries. When the body is larger, ok is false and replay returns a body
+// streaming the bytes already read followed by the rest.
+func bufferBody(body io.ReadCloser, limit int64) (buf []byte, replay io.ReadCloser, ok bool, err error) {
+	buf, err = io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}, false, nil
+	}
+	body.Close()
+	return buf, nil, true, nil
+}
+
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.CopyN(io.Discard, body, retryDrainBytes)
+	body.Close()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
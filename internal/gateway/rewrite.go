@@ -0,0 +1,215 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// requestRewrite is the compiled rewrite block of an API. It is applied to
+// the outgoing request after strip_path_prefix and rewrite_path, in this
+// order: the first matching path rule, header rules, then query parameters.
+type requestRewrite struct {
+	path    []pathRule
+	headers *headerRules
+	query   [][2]string
+}
+
+type pathRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// headerRules renames, removes, sets and adds headers, in that order.
+type headerRules struct {
+	rename [][2]string
+	remove []string
+	set    [][2]string
+	add    [][2]string
+}
+
+func newRequestRewrite(cfg *config.RewriteConfig) (*requestRewrite, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	rw := &requestRewrite{headers: newHeaderRules(cfg.RequestHeaders)}
+	for _, p := range cfg.Path {
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite path %q: %w", p.Regex, err)
+		}
+		rw.path = append(rw.path, pathRule{re: re, replacement: p.Replacement})
+	}
+	rw.query = sortedPairs(cfg.AddQuery, false)
+	return rw, nil
+}
+
+func newHeaderRules(cfg config.HeaderRulesConfig) *headerRules {
+	h := &headerRules{
+		rename: sortedPairs(cfg.Rename, true),
+		set:    sortedPairs(cfg.Set, true),
+		add:    sortedPairs(cfg.Add, true),
+	}
+	for _, name := range cfg.Remove {
+		h.remove = append(h.remove, http.CanonicalHeaderKey(name))
+	}
+	if len(h.rename)+len(h.remove)+len(h.set)+len(h.add) == 0 {
+		return nil
+	}
+	return h
+}
+
+// sortedPairs returns the entries of m sorted by key so that rules apply in
+// a stable order.
+func sortedPairs(m map[string]string, canonical bool) [][2]string {
+	out := make([][2]string, 0, len(m))
+	for k, v := range m {
+		if canonical {
+			k = http.CanonicalHeaderKey(k)
+		}
+		out = append(out, [2]string{k, v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// apply rewrites the path and query of u and the headers h. Values are
+// expanded with vars.
+func (rw *requestRewrite) apply(u *url.URL, h http.Header, vars map[string]string) {
+	if rw == nil {
+		return
+	}
+	for _, p := range rw.path {
+		if p.re.MatchString(u.Path) {
+			u.Path = expandParams(p.re.ReplaceAllString(u.Path, p.replacement), vars)
+			u.RawPath = ""
+			break
+		}
+	}
+	rw.headers.apply(h, vars)
+	if len(rw.query) > 0 {
+		q := u.Query()
+		for _, kv := range rw.query {
+			q.Add(kv[0], expandParams(kv[1], vars))
+		}
+		u.RawQuery = q.Encode()
+	}
+}
+
+// rewriteRequest applies rewrite_path or strip_path_prefix, then the
+// rewrite block of rt, to an outgoing request.
+func (rt *route) rewriteRequest(u *url.URL, h http.Header, params, vars map[string]string) {
+	if rt.def.RewritePath != "" {
+		u.Path = expandParams(rt.def.RewritePath, params)
+		u.RawPath = ""
+	} else if rt.def.StripPathPrefix && rt.def.PathPrefix != "" {
+		u.Path = strings.TrimPrefix(u.Path, rt.def.PathPrefix)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	rt.rewrite.apply(u, h, vars)
+}
+
+// direct is the Director of the reverse proxy of rt.
+func (rt *route) direct(req *http.Request) {
+	if state, _ := req.Context().Value(proxyStateKey{}).(*proxyState); state != nil {
+		rt.rewriteRequest(req.URL, req.Header, state.params, state.vars)
+		if state.transcode != nil {
+			state.transcode.prepare(req)
+		}
+	}
+}
+
+func (hr *headerRules) apply(h http.Header, vars map[string]string) {
+	if hr == nil {
+		return
+	}
+	for _, kv := range hr.rename {
+		if vs, ok := h[kv[0]]; ok {
+			delete(h, kv[0])
+			h[http.CanonicalHeaderKey(kv[1])] = vs
+		}
+	}
+	for _, name := range hr.remove {
+		h.Del(name)
+	}
+	for _, kv := range hr.set {
+		h.Set(kv[0], expandParams(kv[1], vars))
+	}
+	for _, kv := range hr.add {
+		h.Add(kv[0], expandParams(kv[1], vars))
+	}
+}
+
+type jwtClaimsKey struct{}
+
+// templateVars returns the values available to rewrite templates: path
+// parameters, then client_ip, tenant_id, subscription_id, request_id and
+// claim.<name> for every claim of a validated JWT.
+func templateVars(r *http.Request, params map[string]string, sub *store.Subscription) map[string]string {
+	vars := make(map[string]string, len(params)+4)
+	for k, v := range params {
+		vars[k] = v
+	}
+	vars["client_ip"] = clientIP(r)
+	vars["tenant_id"] = requestTenant(r, sub)
+	vars["request_id"] = r.Header.Get(HeaderRequestID)
+	vars["subscription_id"] = ""
+	if sub != nil {
+		vars["subscription_id"] = strconv.FormatInt(sub.ID, 10)
+	}
+	if claims, ok := r.Context().Value(jwtClaimsKey{}).(jwt.MapClaims); ok {
+		for name, v := range claims {
+			vars["claim."+name] = claimString(v)
+		}
+	}
+	return vars
+}
+
+// requestTenant returns the tenant of the subscription, or else the
+// tenant_id claim of a validated JWT.
+func requestTenant(r *http.Request, sub *store.Subscription) string {
+	if sub != nil && sub.TenantID != "" {
+		return sub.TenantID
+	}
+	if claims, ok := r.Context().Value(jwtClaimsKey{}).(jwt.MapClaims); ok {
+		if tenant, ok := claims["tenant_id"].(string); ok {
+			return tenant
+		}
+	}
+	return ""
+}
+
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func withClaims(r *http.Request, claims jwt.MapClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims))
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,456 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// routeTable is a compiled routing table. Hosts are resolved first (exact,
+// then the longest matching "*." wildcard, then host-less routes) and each
+// host owns a radix tree of path prefixes where the longest prefix wins.
+// Lookup cost depends on the length of the host and path, not on the number
+// of routes.
+type routeTable struct {
+	exact    map[string]*pathTree
+	wildcard *hostNode
+	any      *pathTree
+	routes   []*route
+}
+
+type hostNode struct {
+	children map[string]*hostNode
+	paths    *pathTree
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		exact:    make(map[string]*pathTree),
+		wildcard: &hostNode{},
+		any:      &pathTree{},
+	}
+}
+
+// route is a compiled API definition together with the runtime state
+// attached to it. Later definitions of the same route with another version
+// are attached to the first one as versions instead of being shadowed.
+type route struct {
+	def         *store.ApiDefinition
+	product     string
+	upstreams   *upstreamPool
+	retry       *retryPolicy
+	versions    []*route
+	deprecation http.Header
+	mirror      *mirror
+	rewrite     *requestRewrite
+	response    *responseRules
+	timeouts    timeouts
+	transport   *routeTransport
+	proxy       *httputil.ReverseProxy
+	protocols   *http.Protocols
+	grpc        bool
+	transcoder  *transcoder
+	websocket   *webSocketPolicy
+	mtls        string
+	tls         *upstreamTLS
+	cache       *cachePolicy
+	compression *compressionPolicy
+}
+
+// routeMatch is the result of a routing table lookup. When no route accepts
+// the request method but some route matched the path, route is nil and
+// allow lists the methods those routes accept.
+type routeMatch struct {
+	*route
+	params map[string]string
+	allow  []string
+}
+
+// compileRoutes builds a routing table from API definitions. Definitions
+// that cannot be compiled are skipped and reported in the returned errors.
+// When two definitions share the same host and path, the first one
+// accepting the request method wins.
+func compileRoutes(defs []*store.ApiDefinition) (*routeTable, []error) {
+	t := newRouteTable()
+	var errs []error
+	for _, d := range defs {
+		if err := t.insert(d); err != nil {
+			errs = append(errs, fmt.Errorf("api %q: %w", d.Name, err))
+		}
+	}
+	return t, errs
+}
+
+func (t *routeTable) insert(d *store.ApiDefinition) error {
+	var tmpl *pathTemplate
+	if d.Path != "" {
+		var err error
+		if tmpl, err = parsePathTemplate(d.Path); err != nil {
+			return err
+		}
+	}
+	pool, err := newUpstreamPool(d)
+	if err != nil {
+		return err
+	}
+	retry, err := newRetryPolicy(d.Retry)
+	if err != nil {
+		return err
+	}
+	deprecation, err := deprecationHeaders(d.Deprecation)
+	if err != nil {
+		return err
+	}
+	mirror, err := newMirror(d.Mirror)
+	if err != nil {
+		return err
+	}
+	rewrite, err := newRequestRewrite(d.Rewrite)
+	if err != nil {
+		return err
+	}
+	response, err := newResponseRules(d.Response)
+	if err != nil {
+		return err
+	}
+	protocols, err := upstreamProtocols(d.Protocol, pool)
+	if err != nil {
+		return err
+	}
+	grpc := strings.EqualFold(d.Protocol, ProtocolGRPC)
+	if d.Transcoding != nil && !grpc {
+		return fmt.Errorf("api %q: transcoding requires protocol %s", d.Name, ProtocolGRPC)
+	}
+	transcoder, err := newTranscoder(d.Transcoding)
+	if err != nil {
+		return err
+	}
+	mtls, err := mtlsPolicy(d.MTLS)
+	if err != nil {
+		return err
+	}
+	upstreamTLS, err := newUpstreamTLS(d.UpstreamTLS, pool)
+	if err != nil {
+		return err
+	}
+	cache, err := newCachePolicy(d)
+	if err != nil {
+		return err
+	}
+	compression, err := newCompressionPolicy(d)
+	if err != nil {
+		return err
+	}
+	rt := &route{
+		def:         d,
+		upstreams:   pool,
+		retry:       retry,
+		deprecation: deprecation,
+		mirror:      mirror,
+		rewrite:     rewrite,
+		response:    response,
+		protocols:   protocols,
+		grpc:        grpc,
+		transcoder:  transcoder,
+		websocket:   newWebSocketPolicy(d.WebSocket),
+		mtls:        mtls,
+		tls:         upstreamTLS,
+		cache:       cache,
+		compression: compression,
+	}
+	t.routes = append(t.routes, rt)
+	host := strings.ToLower(strings.TrimSpace(d.Host))
+	var tree *pathTree
+	switch {
+	case host == "" || host == "*":
+		tree = t.any
+	case strings.HasPrefix(host, "*."):
+		n := t.wildcard
+		labels := strings.Split(host[2:], ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			if n.children == nil {
+				n.children = make(map[string]*hostNode)
+			}
+			child := n.children[labels[i]]
+			if child == nil {
+				child = &hostNode{}
+				n.children[labels[i]] = child
+			}
+			n = child
+		}
+		if n.paths == nil {
+			n.paths = &pathTree{}
+		}
+		tree = n.paths
+	default:
+		tree = t.exact[host]
+		if tree == nil {
+			tree = &pathTree{}
+			t.exact[host] = tree
+		}
+	}
+	if tmpl != nil {
+		tree.insertTemplate(tmpl, rt)
+	} else {
+		tree.insert(d.PathPrefix, rt)
+	}
+	return nil
+}
+
+// versionOf reports whether rt is another version of the route primary:
+// same methods, both versioned, different versions.
+func versionOf(primary, rt *route) bool {
+	a, b := primary.def, rt.def
+	return a.Version != "" && b.Version != "" && a.Version != b.Version && slices.EqualFunc(a.Methods, b.Methods, strings.EqualFold)
+}
+
+// lookup returns the route serving a request for host, path and method;
+// upgrade is set for WebSocket upgrade requests.
+func (t *routeTable) lookup(host, path, method string, upgrade bool) routeMatch {
+	if t == nil {
+		return routeMatch{}
+	}
+	host = normalizeHost(host)
+	var allow []string
+	if tree := t.exact[host]; tree != nil {
+		if m := tree.lookup(path, method, upgrade, &allow); m.route != nil {
+			return m
+		}
+	}
+	for _, tree := range t.wildcardTrees(host) {
+		if m := tree.lookup(path, method, upgrade, &allow); m.route != nil {
+			return m
+		}
+	}
+	if m := t.any.lookup(path, method, upgrade, &allow); m.route != nil {
+		return m
+	}
+	return routeMatch{allow: allow}
+}
+
+// wildcardTrees returns the path trees of every wildcard matching host,
+// ordered from the most specific (longest suffix) to the least specific.
+// A wildcard requires at least one label in front of its suffix, so
+// "*.example.com" does not match "example.com".
+func (t *routeTable) wildcardTrees(host string) []*pathTree {
+	if host == "" || len(t.wildcard.children) == 0 {
+		return nil
+	}
+	var matches []*pathTree
+	n := t.wildcard
+	rest := host
+	for {
+		idx := strings.LastIndexByte(rest, '.')
+		if idx < 0 {
+			break
+		}
+		label := rest[idx+1:]
+		rest = rest[:idx]
+		n = n.children[label]
+		if n == nil {
+			break
+		}
+		if n.paths != nil {
+			matches = append(matches, n.paths)
+		}
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// pathTree is a radix tree keyed by path prefix. Prefixes are matched byte
+// by byte like strings.HasPrefix, so "/api" also matches "/apiv2". Path
+// templates are stored under their literal prefix and take precedence over
+// prefix routes ending at the same node.
+type pathTree struct {
+	root pathNode
+}
+
+type pathNode struct {
+	label     string
+	indices   []byte
+	children  []*pathNode
+	routes    []*route
+	templates []templateRoute
+}
+
+type templateRoute struct {
+	tmpl  *pathTemplate
+	route *route
+}
+
+// maxTreeDepth bounds the node stack kept on the goroutine stack during
+// lookups; deeper trees fall back to a heap allocation.
+const maxTreeDepth = 16
+
+func (t *pathTree) insert(prefix string, rt *route) {
+	n := t.node(prefix)
+	for _, primary := range n.routes {
+		if versionOf(primary, rt) {
+			primary.versions = append(primary.versions, rt)
+			return
+		}
+	}
+	n.routes = append(n.routes, rt)
+}
+
+func (t *pathTree) insertTemplate(tmpl *pathTemplate, rt *route) {
+	n := t.node(tmpl.literalPrefix())
+	for _, tr := range n.templates {
+		if tr.tmpl.raw == tmpl.raw && versionOf(tr.route, rt) {
+			tr.route.versions = append(tr.route.versions, rt)
+			return
+		}
+	}
+	i := len(n.templates)
+	for i > 0 && tmpl.moreSpecific(n.templates[i-1].tmpl) {
+		i--
+	}
+	n.templates = slices.Insert(n.templates, i, templateRoute{tmpl: tmpl, route: rt})
+}
+
+// node returns the node for prefix, creating and splitting nodes as needed.
+func (t *pathTree) node(prefix string) *pathNode {
+	n := &t.root
+	rest := prefix
+	for rest != "" {
+		i := n.childIndex(rest[0])
+		if i < 0 {
+			child := &pathNode{label: rest}
+			n.addChild(child)
+			return child
+		}
+		child := n.children[i]
+		common := commonPrefixLen(rest, child.label)
+		if common < len(child.label) {
+			split := &pathNode{
+				label:    child.label[:common],
+				indices:  []byte{child.label[common]},
+				children: []*pathNode{child},
+			}
+			child.label = child.label[common:]
+			n.children[i] = split
+			child = split
+		}
+		n = child
+		rest = rest[common:]
+	}
+	return n
+}
+
+// lookup walks path down the tree and tries the deepest nodes first. Routes
+// that match the path but not the method add their methods to allow. For
+// WebSocket upgrades, routes declaring a websocket block win over the other
+// routes of the same node.
+func (t *pathTree) lookup(path, method string, upgrade bool, allow *[]string) routeMatch {
+	var stack [maxTreeDepth]*pathNode
+	nodes := append(stack[:0], &t.root)
+	n := &t.root
+	rest := path
+	for rest != "" {
+		i := n.childIndex(rest[0])
+		if i < 0 {
+			break
+		}
+		child := n.children[i]
+		if !strings.HasPrefix(rest, child.label) {
+			break
+		}
+		rest = rest[len(child.label):]
+		n = child
+		nodes = append(nodes, n)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		if upgrade {
+			if m, ok := n.match(path, method, true, nil); ok {
+				return m
+			}
+		}
+		if m, ok := n.match(path, method, false, allow); ok {
+			return m
+		}
+	}
+	return routeMatch{}
+}
+
+// match returns the first route of n accepting path and method. With
+// webSocket set, only routes declaring a websocket block are tried.
+func (n *pathNode) match(path, method string, webSocket bool, allow *[]string) (routeMatch, bool) {
+	for _, tr := range n.templates {
+		if webSocket && tr.route.def.WebSocket == nil {
+			continue
+		}
+		params, ok := tr.tmpl.match(path)
+		if !ok {
+			continue
+		}
+		if methodAllowed(tr.route.def.Methods, method) {
+			return routeMatch{route: tr.route, params: params}, true
+		}
+		if allow != nil {
+			*allow = append(*allow, tr.route.def.Methods...)
+		}
+	}
+	for _, rt := range n.routes {
+		if webSocket && rt.def.WebSocket == nil {
+			continue
+		}
+		if methodAllowed(rt.def.Methods, method) {
+			return routeMatch{route: rt}, true
+		}
+		if allow != nil {
+			*allow = append(*allow, rt.def.Methods...)
+		}
+	}
+	return routeMatch{}, false
+}
+
+func methodAllowed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *pathNode) childIndex(c byte) int {
+	for i, b := range n.indices {
+		if b == c {
+			return i
+		}
+	}
+	return -1
+}
+
+func (n *pathNode) addChild(child *pathNode) {
+	n.indices = append(n.indices, child.label[0])
+	n.children = append(n.children, child)
+}
+
+func commonPrefixLen(a, b string) int {
+	n := min(len(a), len(b))
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
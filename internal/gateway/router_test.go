@@ -0,0 +1,223 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func TestRouteTable_Lookup(t *testing.T) {
+	defs := []*store.ApiDefinition{
+		{Name: "root", PathPrefix: "/"},
+		{Name: "api", PathPrefix: "/api"},
+		{Name: "api-v2", PathPrefix: "/api/v2"},
+		{Name: "api-dup", PathPrefix: "/api"},
+		{Name: "star", Host: "*", PathPrefix: "/star"},
+		{Name: "exact", Host: "api.example.com", PathPrefix: "/"},
+		{Name: "exact-orders", Host: "API.example.com", PathPrefix: "/orders"},
+		{Name: "wild", Host: "*.example.com", PathPrefix: "/"},
+		{Name: "wild-deep", Host: "*.eu.example.com", PathPrefix: "/"},
+		{Name: "wild-users", Host: "*.example.com", PathPrefix: "/users"},
+	}
+	table, errs := compileRoutes(defs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		want string
+	}{
+		{"Longest Prefix Wins", "other.com", "/api/v2/items", "api-v2"},
+		{"Declared First Wins On Duplicate", "other.com", "/api/v1", "api"},
+		{"Byte Prefix Semantics", "other.com", "/apiv3", "api"},
+		{"Host-less Fallback", "other.com", "/anything", "root"},
+		{"Star Host Is Host-less", "other.com", "/star/1", "star"},
+		{"Exact Host", "api.example.com", "/x", "exact"},
+		{"Exact Host Case And Port", "Api.Example.com:8080", "/orders/1", "exact-orders"},
+		{"Exact Before Wildcard", "api.example.com", "/users", "exact"},
+		{"Wildcard", "shop.example.com", "/x", "wild"},
+		{"Wildcard Longest Path", "shop.example.com", "/users/1", "wild-users"},
+		{"Longest Wildcard Suffix", "a.eu.example.com", "/users", "wild-deep"},
+		{"Wildcard Needs Subdomain", "example.com", "/api", "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := table.lookup(tt.host, tt.path, http.MethodGet, false)
+			if m.route == nil {
+				t.Fatalf("%s%s: no route, want %s", tt.host, tt.path, tt.want)
+			}
+			if m.def.Name != tt.want {
+				t.Errorf("%s%s: got %s, want %s", tt.host, tt.path, m.def.Name, tt.want)
+			}
+		})
+	}
+
+	narrow, _ := compileRoutes(defs[1:3])
+	if m := narrow.lookup("x", "/other", http.MethodGet, false); m.route != nil {
+		t.Errorf("expected no route, got %s", m.def.Name)
+	}
+}
+
+func TestRouteTable_Templates(t *testing.T) {
+	defs := []*store.ApiDefinition{
+		{Name: "orders", PathPrefix: "/orders"},
+		{Name: "order-items", Path: "/orders/{id}/items", Methods: []string{"GET"}},
+		{Name: "order-items-write", Path: "/orders/{id}/items", Methods: []string{"post", "PUT"}},
+		{Name: "order-numeric", Path: "/orders/{id:[0-9]+}"},
+		{Name: "order-any", Path: "/orders/{id}"},
+		{Name: "order-latest", Path: "/orders/latest"},
+		{Name: "files", Path: "/files/{bucket}/{key...}"},
+	}
+	table, errs := compileRoutes(defs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+		params map[string]string
+	}{
+		{"Template With Method", "GET", "/orders/42/items", "order-items", map[string]string{"id": "42"}},
+		{"Same Template Other Method", "POST", "/orders/42/items", "order-items-write", map[string]string{"id": "42"}},
+		{"Literal Beats Parameter", "GET", "/orders/latest", "order-latest", nil},
+		{"Regexp Beats Plain Parameter", "GET", "/orders/42", "order-numeric", map[string]string{"id": "42"}},
+		{"Regexp Mismatch", "GET", "/orders/abc", "order-any", map[string]string{"id": "abc"}},
+		{"Prefix Fallback", "GET", "/orders/42/items/7", "orders", nil},
+		{"Catch-all", "GET", "/files/img/a/b.png", "files", map[string]string{"bucket": "img", "key": "a/b.png"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := table.lookup("", tt.path, tt.method, false)
+			if m.route == nil || m.def.Name != tt.want {
+				t.Fatalf("%s %s: got %+v, want %s", tt.method, tt.path, m.route, tt.want)
+			}
+			if len(m.params) != len(tt.params) {
+				t.Fatalf("params: got %v, want %v", m.params, tt.params)
+			}
+			for k, v := range tt.params {
+				if m.params[k] != v {
+					t.Errorf("param %s: got %q, want %q", k, m.params[k], v)
+				}
+			}
+		})
+	}
+
+	strict, _ := compileRoutes(defs[1:3])
+	m := strict.lookup("", "/orders/1/items", http.MethodDelete, false)
+	if m.route != nil || len(m.allow) != 3 {
+		t.Errorf("expected method mismatch with 3 allowed methods, got %+v", m)
+	}
+
+	for _, bad := range []string{"orders/{id}", "/a/{id", "/a/x{id}", "/{rest...}/a", "/{id}/{id}", "/{id:[}"} {
+		if _, errs := compileRoutes([]*store.ApiDefinition{{Name: "bad", Path: bad}}); len(errs) != 1 {
+			t.Errorf("%s: expected a compile error", bad)
+		}
+	}
+}
+
+func TestRouteTable_Versions(t *testing.T) {
+	defs := []*store.ApiDefinition{
+		{Name: "v1", PathPrefix: "/catalog", Version: "v1"},
+		{Name: "v2", PathPrefix: "/catalog", Version: "v2"},
+		{Name: "unversioned", PathPrefix: "/catalog"},
+		{Name: "v3-get", PathPrefix: "/catalog", Version: "v3", Methods: []string{"GET"}},
+		{Name: "t1", Path: "/orders/{id}", Version: "v1"},
+		{Name: "t2", Path: "/orders/{id}", Version: "v2"},
+	}
+	table, errs := compileRoutes(defs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	m := table.lookup("", "/catalog", http.MethodPost, false)
+	if m.def.Name != "v1" || len(m.versions) != 1 || m.versions[0].def.Name != "v2" {
+		t.Errorf("expected v1 with version v2, got %s with %d versions", m.def.Name, len(m.versions))
+	}
+	if m := table.lookup("", "/orders/1", http.MethodGet, false); m.def.Name != "t1" || len(m.versions) != 1 {
+		t.Errorf("expected template t1 with one version, got %s with %d versions", m.def.Name, len(m.versions))
+	}
+	if len(table.routes) != len(defs) {
+		t.Errorf("expected every definition compiled, got %d", len(table.routes))
+	}
+}
+
+func TestRouteTable_WebSocketUpgrade(t *testing.T) {
+	ws := &config.WebSocketConfig{}
+	defs := []*store.ApiDefinition{
+		{Name: "chat", PathPrefix: "/chat"},
+		{Name: "chat-ws", PathPrefix: "/chat", WebSocket: ws},
+		{Name: "history", PathPrefix: "/chat/history"},
+		{Name: "room", Path: "/rooms/{id}"},
+		{Name: "room-ws", Path: "/rooms/{id}", WebSocket: ws},
+	}
+	table, errs := compileRoutes(defs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		path    string
+		upgrade bool
+		want    string
+	}{
+		{"/chat", false, "chat"},
+		{"/chat", true, "chat-ws"},
+		{"/chat/history", true, "history"},
+		{"/rooms/1", false, "room"},
+		{"/rooms/1", true, "room-ws"},
+	}
+	for _, tt := range tests {
+		m := table.lookup("", tt.path, http.MethodGet, tt.upgrade)
+		if m.route == nil || m.def.Name != tt.want {
+			t.Errorf("%s (upgrade %v): got %+v, want %s", tt.path, tt.upgrade, m.route, tt.want)
+		}
+	}
+}
+
+func TestExpandParams(t *testing.T) {
+	params := map[string]string{"id": "42", "tenant": "acme"}
+	got := expandParams("/internal/{tenant}/orders/{id}?x={unknown}", params)
+	if want := "/internal/acme/orders/42?x={unknown}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func benchmarkDefinitions(n int) []*store.ApiDefinition {
+	defs := make([]*store.ApiDefinition, 0, n)
+	for i := 0; i < n; i++ {
+		d := &store.ApiDefinition{
+			Name:       fmt.Sprintf("api-%d", i),
+			PathPrefix: fmt.Sprintf("/svc%d/v%d", i/10, i%10),
+		}
+		switch i % 3 {
+		case 1:
+			d.Host = fmt.Sprintf("tenant%d.example.com", i%50)
+		case 2:
+			d.Host = fmt.Sprintf("*.region%d.example.com", i%20)
+		}
+		defs = append(defs, d)
+	}
+	return defs
+}
+
+func BenchmarkRouteTable_Lookup(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		table, _ := compileRoutes(benchmarkDefinitions(n))
+		path := fmt.Sprintf("/svc%d/v%d/orders/42", (n-1)/10, (n-1)%10)
+		b.Run(fmt.Sprintf("apis=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if table.lookup("edge.region3.example.com", path, http.MethodGet, false).route == nil {
+					b.Fatal("no route")
+				}
+			}
+		})
+	}
+}
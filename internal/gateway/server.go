@@ -0,0 +1,31 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+// NewServer returns the HTTP server of the gateway listener. HTTP/1.1 is
+// always served; with h2c, clients may also speak cleartext HTTP/2 with
+// prior knowledge. With a tls section the server terminates TLS, offering
+// HTTP/2 through ALPN: start it with ListenAndServeTLS("", "") or
+// ServeTLS(ln, "", "").
+func NewServer(cfg config.GatewayConfig, h http.Handler) (*http.Server, error) {
+	srv := &http.Server{Addr: cfg.Listen, Handler: h}
+	if cfg.H2C {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if cfg.TLS != nil {
+		tc, stop, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tc
+		srv.RegisterOnShutdown(stop)
+	}
+	return srv, nil
+}
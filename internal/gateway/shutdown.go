@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	drainPollInterval      = 50 * time.Millisecond
+)
+
+// ShutdownTimeout returns how long a shutdown may drain connections.
+func ShutdownTimeout(cfg config.GatewayConfig) time.Duration {
+	if cfg.ShutdownTimeoutSeconds > 0 {
+		return time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+	}
+	return DefaultShutdownTimeout
+}
+
+// ShutdownDelay returns how long a shutdown keeps accepting connections
+// after Ready starts failing, so that load balancers stop routing to the
+// gateway before its listener closes.
+func ShutdownDelay(cfg config.GatewayConfig) time.Duration {
+	if cfg.ShutdownDelaySeconds > 0 {
+		return time.Duration(cfg.ShutdownDelaySeconds) * time.Second
+	}
+	return 0
+}
+
+// Shutdown gracefully stops srv, the server of the gateway: Ready starts
+// failing, new requests are still served for the shutdown delay, then the
+// listener stops accepting connections, and requests in flight and open
+// WebSocket connections are drained until ctx expires. WebSocket
+// connections still open then are closed and the context error is returned;
+// the caller should Close srv to cut the remaining requests.
+func (g *Gateway) Shutdown(ctx context.Context, srv *http.Server) error {
+	g.draining.Store(true)
+	g.mu.RLock()
+	delay := ShutdownDelay(g.config.Gateway)
+	g.mu.RUnlock()
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Shutdown(ctx) }()
+	err := g.drain(ctx)
+	if serr := <-errc; err == nil {
+		err = serr
+	}
+	return err
+}
+
+// drain waits until no request is being served. Upgraded WebSocket
+// connections are hijacked from the server, so srv.Shutdown does not wait
+// for them; they are counted as requests until they close.
+func (g *Gateway) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for g.active.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			g.socketsMu.Lock()
+			for ws := range g.sockets {
+				ws.disconnect()
+			}
+			g.socketsMu.Unlock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) trackWebSocket(ws *webSocket) {
+	g.socketsMu.Lock()
+	g.sockets[ws] = struct{}{}
+	g.socketsMu.Unlock()
+}
+
+func (g *Gateway) untrackWebSocket(ws *webSocket) {
+	g.socketsMu.Lock()
+	delete(g.sockets, ws)
+	g.socketsMu.Unlock()
+}
@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"io"
+	"time"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// flushInterval returns the ReverseProxy flush interval of an API.
+// Streaming APIs flush after every write. Server-sent events and responses
+// of unknown length are always flushed immediately by ReverseProxy.
+func flushInterval(d *store.ApiDefinition) time.Duration {
+	if d.Streaming {
+		return -1
+	}
+	return time.Duration(d.FlushIntervalMs) * time.Millisecond
+}
+
+// streamingTimeouts drops the inherited total timeout of a streaming API,
+// which would cut long-lived streams short. A total timeout set on the API
+// itself still applies.
+func streamingTimeouts(t timeouts, d *store.ApiDefinition) timeouts {
+	if d.Streaming && (d.Timeouts == nil || d.Timeouts.TotalSeconds == 0) {
+		t.total = 0
+	}
+	return t
+}
+
+// firstByteReader calls mark once the first bytes have been read from r.
+type firstByteReader struct {
+	r    io.Reader
+	mark func()
+}
+
+func (f *firstByteReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.mark != nil {
+		f.mark()
+		f.mark = nil
+	}
+	return n, err
+}
@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pathTemplate is a compiled route path such as "/orders/{id}/items".
+// Segments can be literals, named parameters ("{id}"), parameters
+// constrained by a regular expression ("{id:[0-9]+}") or, as the last
+// segment only, a catch-all capturing the rest of the path ("{rest...}").
+type pathTemplate struct {
+	raw      string
+	segments []templateSegment
+}
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentRegexp
+	segmentParam
+	segmentCatchAll
+)
+
+type templateSegment struct {
+	kind    segmentKind
+	literal string
+	name    string
+	re      *regexp.Regexp
+}
+
+func parsePathTemplate(raw string) (*pathTemplate, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", raw)
+	}
+	parts := strings.Split(raw[1:], "/")
+	t := &pathTemplate{raw: raw, segments: make([]templateSegment, 0, len(parts))}
+	seen := make(map[string]bool)
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("path template %q: parameter must span a whole segment: %q", raw, part)
+			}
+			t.segments = append(t.segments, templateSegment{kind: segmentLiteral, literal: part})
+			continue
+		}
+		if !strings.HasSuffix(part, "}") {
+			return nil, fmt.Errorf("path template %q: unterminated parameter %q", raw, part)
+		}
+		inner := part[1 : len(part)-1]
+		seg := templateSegment{kind: segmentParam, name: inner}
+		if name, ok := strings.CutSuffix(inner, "..."); ok {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("path template %q: catch-all {%s} must be the last segment", raw, inner)
+			}
+			seg = templateSegment{kind: segmentCatchAll, name: name}
+		} else if name, expr, ok := strings.Cut(inner, ":"); ok {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("path template %q: parameter %s: %w", raw, name, err)
+			}
+			seg = templateSegment{kind: segmentRegexp, name: name, re: re}
+		}
+		if seg.name == "" {
+			return nil, fmt.Errorf("path template %q: empty parameter name", raw)
+		}
+		if seen[seg.name] {
+			return nil, fmt.Errorf("path template %q: duplicate parameter %s", raw, seg.name)
+		}
+		seen[seg.name] = true
+		t.segments = append(t.segments, seg)
+	}
+	return t, nil
+}
+
+// literalPrefix returns the part of the template before its first
+// parameter. It is the key under which the template is stored in the radix
+// tree.
+func (t *pathTemplate) literalPrefix() string {
+	if i := strings.IndexByte(t.raw, '{'); i >= 0 {
+		return t.raw[:i]
+	}
+	return t.raw
+}
+
+// match reports whether path matches the template and returns the captured
+// parameters.
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	rest := path[1:]
+	var params map[string]string
+	for i, seg := range t.segments {
+		if seg.kind == segmentCatchAll {
+			if params == nil {
+				params = make(map[string]string, len(t.segments))
+			}
+			params[seg.name] = rest
+			return params, true
+		}
+		var part string
+		last := i == len(t.segments)-1
+		if idx := strings.IndexByte(rest, '/'); idx >= 0 {
+			if last {
+				return nil, false
+			}
+			part, rest = rest[:idx], rest[idx+1:]
+		} else {
+			if !last {
+				return nil, false
+			}
+			part, rest = rest, ""
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if part != seg.literal {
+				return nil, false
+			}
+		case segmentRegexp, segmentParam:
+			if part == "" || (seg.re != nil && !seg.re.MatchString(part)) {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string, len(t.segments))
+			}
+			params[seg.name] = part
+		}
+	}
+	return params, true
+}
+
+// moreSpecific orders templates sharing the same literal prefix: segment by
+// segment, literals beat constrained parameters, which beat plain
+// parameters, which beat catch-alls. Longer templates win ties.
+func (t *pathTemplate) moreSpecific(o *pathTemplate) bool {
+	for i := 0; i < len(t.segments) && i < len(o.segments); i++ {
+		if a, b := t.segments[i].kind, o.segments[i].kind; a != b {
+			return a < b
+		}
+	}
+	return len(t.segments) > len(o.segments)
+}
+
+// expandParams replaces "{name}" placeholders in s with captured route
+// parameters. Unknown placeholders are left untouched.
+func expandParams(s string, params map[string]string) string {
+	if len(params) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			break
+		}
+		end += open
+		b.WriteString(s[:open])
+		if v, ok := params[s[open+1:end]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[open : end+1])
+		}
+		s = s[end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
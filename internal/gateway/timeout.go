@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const (
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// timeouts are the resolved timeouts of an API. Zero disables a timeout.
+type timeouts struct {
+	dial           time.Duration
+	tlsHandshake   time.Duration
+	responseHeader time.Duration
+	idle           time.Duration
+	total          time.Duration
+}
+
+// resolveTimeouts merges the timeouts of an API over the gateway timeouts
+// and the built-in defaults. The gateway total defaults to
+// backend_timeout_seconds.
+func resolveTimeouts(gw config.GatewayConfig, api *config.TimeoutsConfig) timeouts {
+	t := timeouts{
+		dial:         DefaultDialTimeout,
+		tlsHandshake: DefaultTLSHandshakeTimeout,
+		idle:         DefaultIdleConnTimeout,
+		total:        time.Duration(gw.BackendTimeoutSeconds) * time.Second,
+	}
+	t.merge(gw.Timeouts)
+	if api != nil {
+		t.merge(*api)
+	}
+	return t
+}
+
+func (t *timeouts) merge(c config.TimeoutsConfig) {
+	set := func(d *time.Duration, seconds int) {
+		if seconds > 0 {
+			*d = time.Duration(seconds) * time.Second
+		}
+	}
+	set(&t.dial, c.DialSeconds)
+	set(&t.tlsHandshake, c.TLSHandshakeSeconds)
+	set(&t.responseHeader, c.ResponseHeaderSeconds)
+	set(&t.idle, c.IdleSeconds)
+	set(&t.total, c.TotalSeconds)
+}
+
+// isTimeout reports whether err comes from a backend timeout rather than
+// from the client going away.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,242 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const DefaultCertReloadInterval = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the listener TLS configuration. Certificates are
+// picked by SNI and reloaded in the background until stop is called.
+func newTLSConfig(cfg *config.TLSConfig) (tc *tls.Config, stop func(), err error) {
+	tc = &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("tls: unknown min_version %q", cfg.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	for _, name := range cfg.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	if len(cfg.ClientCAFiles) > 0 {
+		pool, err := loadCertPool(cfg.ClientCAFiles)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls: client_ca_files: %w", err)
+		}
+		// The mtls policy of each API decides whether a certificate is
+		// required; the handshake only rejects invalid ones.
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	certs, err := loadCertificates(cfg.Certificates)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc.GetCertificate = certs.get
+	interval := DefaultCertReloadInterval
+	if cfg.ReloadIntervalSeconds > 0 {
+		interval = time.Duration(cfg.ReloadIntervalSeconds) * time.Second
+	}
+	return tc, certs.watch(interval), nil
+}
+
+// cipherSuite returns the ID of a secure cipher suite from its Go name.
+func cipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if strings.EqualFold(cs.Name, name) {
+			return cs.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("tls: unknown or insecure cipher suite %q", name)
+}
+
+// certificateSet selects the certificate of a connection by server name:
+// exact names first, then wildcards, then the first certificate of the
+// configuration.
+type certificateSet struct {
+	mu       sync.RWMutex
+	files    []config.CertificateConfig
+	modTimes []time.Time
+	exact    map[string]*tls.Certificate
+	wildcard map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func loadCertificates(files []config.CertificateConfig) (*certificateSet, error) {
+	if len(files) == 0 {
+		return nil, errors.New("tls: no certificates")
+	}
+	s := &certificateSet{files: files}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads every certificate pair and swaps them in at once, so a failed
+// reload keeps the certificates in use.
+func (s *certificateSet) load() error {
+	exact := make(map[string]*tls.Certificate)
+	wildcard := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	modTimes := make([]time.Time, len(s.files))
+	for i, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: certificate %s: %w", f.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("tls: certificate %s: %w", f.CertFile, err)
+			}
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+		hosts := f.Hosts
+		if len(hosts) == 0 {
+			hosts = cert.Leaf.DNSNames
+		}
+		for _, h := range hosts {
+			h = strings.ToLower(strings.TrimSuffix(h, "."))
+			if suffix, ok := strings.CutPrefix(h, "*."); ok {
+				if wildcard[suffix] == nil {
+					wildcard[suffix] = &cert
+				}
+			} else if exact[h] == nil {
+				exact[h] = &cert
+			}
+		}
+		modTimes[i] = latestModTime(f.CertFile, f.KeyFile)
+	}
+	s.mu.Lock()
+	s.exact, s.wildcard, s.fallback, s.modTimes = exact, wildcard, fallback, modTimes
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certificateSet) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert := s.exact[name]; cert != nil {
+		return cert, nil
+	}
+	// As in certificate validation, a wildcard covers exactly one label.
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := s.wildcard[name[i+1:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return s.fallback, nil
+}
+
+// changed reports whether a certificate or key file was modified since the
+// last load.
+func (s *certificateSet) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, f := range s.files {
+		if !latestModTime(f.CertFile, f.KeyFile).Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates whenever their files change and returns a
+// function stopping the watch.
+func (s *certificateSet) watch(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !s.changed() {
+					continue
+				}
+				if err := s.load(); err != nil {
+					log.Printf("apimcore gateway: keeping current certificates: %v", err)
+					continue
+				}
+				log.Printf("apimcore gateway: reloaded TLS certificates")
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func latestModTime(paths ...string) time.Time {
+	var latest time.Time
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// NewRedirectServer returns a plain HTTP server redirecting every request
+// to the HTTPS listener of the gateway, or nil when tls.redirect_listen is
+// not set.
+func NewRedirectServer(cfg config.GatewayConfig) *http.Server {
+	if cfg.TLS == nil || cfg.TLS.RedirectListen == "" {
+		return nil
+	}
+	_, port, _ := net.SplitHostPort(cfg.Listen)
+	return &http.Server{
+		Addr:              cfg.TLS.RedirectListen,
+		Handler:           redirectHandler(port),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// redirectHandler redirects to the same host and path on HTTPS, on port
+// unless it is empty or 443.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
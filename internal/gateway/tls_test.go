@@ -0,0 +1,180 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+// writeTestCert writes a self-signed certificate for hosts and its key to
+// dir and returns the parsed certificate.
+func writeTestCert(t *testing.T, dir, name string, hosts ...string) (config.CertificateConfig, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := config.CertificateConfig{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	if err := os.WriteFile(cc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cc, cert
+}
+
+func TestCertificateSet(t *testing.T) {
+	dir := t.TempDir()
+	api, apiCert := writeTestCert(t, dir, "api", "api.example.com")
+	wild, wildCert := writeTestCert(t, dir, "wild", "*.example.org")
+	legacy, legacyCert := writeTestCert(t, dir, "legacy", "internal.local")
+	legacy.Hosts = []string{"legacy.example.net"}
+	certs, err := loadCertificates([]config.CertificateConfig{api, wild, legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial := func(name string) *big.Int {
+		cert, err := certs.get(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf.SerialNumber
+	}
+	tests := []struct {
+		name string
+		want *x509.Certificate
+	}{
+		{"api.example.com", apiCert},
+		{"API.example.com.", apiCert},
+		{"shop.example.org", wildCert},
+		{"example.org", apiCert},
+		{"a.b.example.org", apiCert},
+		{"legacy.example.net", legacyCert},
+		{"internal.local", apiCert},
+		{"", apiCert},
+	}
+	for _, tt := range tests {
+		if got := serial(tt.name); got.Cmp(tt.want.SerialNumber) != 0 {
+			t.Errorf("%q: got certificate %v, want %v", tt.name, got, tt.want.SerialNumber)
+		}
+	}
+
+	if certs.changed() {
+		t.Error("expected no change right after loading")
+	}
+	_, renewed := writeTestCert(t, dir, "api", "api.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(api.CertFile, future, future)
+	if !certs.changed() {
+		t.Fatal("expected the renewed certificate to be detected")
+	}
+	if err := certs.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial("api.example.com"); got.Cmp(renewed.SerialNumber) != 0 {
+		t.Errorf("expected the renewed certificate, got %v", got)
+	}
+
+	os.WriteFile(wild.KeyFile, []byte("broken"), 0o600)
+	if err := certs.load(); err == nil {
+		t.Error("expected an error for a broken key")
+	}
+	if got := serial("shop.example.org"); got.Cmp(wildCert.SerialNumber) != 0 {
+		t.Errorf("expected the current certificates to be kept after a failed reload, got %v", got)
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	api, apiCert := writeTestCert(t, dir, "api", "api.example.com")
+	cfg := config.GatewayConfig{
+		Listen: "127.0.0.1:8443",
+		TLS: &config.TLSConfig{
+			Certificates:   []config.CertificateConfig{api},
+			MinVersion:     "1.3",
+			RedirectListen: ":8080",
+		},
+	}
+	srv, err := NewServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(apiCert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "api.example.com"},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS.Version != tls.VersionTLS13 || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Errorf("expected TLS 1.3 and HTTP/2, got %x and %s", resp.TLS.Version, resp.Header.Get("X-Proto"))
+	}
+
+	old := &tls.Config{RootCAs: roots, ServerName: "api.example.com", MaxVersion: tls.VersionTLS12}
+	if conn, err := tls.Dial("tcp", ln.Addr().String(), old); err == nil {
+		conn.Close()
+		t.Error("expected TLS 1.2 to be refused below min_version")
+	}
+
+	if _, err := NewServer(config.GatewayConfig{TLS: &config.TLSConfig{Certificates: []config.CertificateConfig{api}, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}}, nil); err == nil {
+		t.Error("expected an error for an insecure cipher suite")
+	}
+
+	redirect := NewRedirectServer(cfg)
+	rec := httptest.NewRecorder()
+	redirect.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "http://api.example.com:8080/orders?id=1", nil))
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://api.example.com:8443/orders?id=1" {
+		t.Errorf("unexpected redirect %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
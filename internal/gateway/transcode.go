@@ -0,0 +1,639 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// DefaultTranscodeMaxBodyBytes caps the JSON body of a transcoded request
+// and the gRPC body of its response, matching the default gRPC message size
+// limit.
+const DefaultTranscodeMaxBodyBytes = 4 << 20
+
+// transcoder maps REST/JSON requests to the gRPC methods of a descriptor set
+// through their google.api.http annotations.
+type transcoder struct {
+	rules []*httpRule
+}
+
+// httpRule is one compiled google.api.http binding of a gRPC method.
+type httpRule struct {
+	verb         string
+	segments     []ruleSegment
+	custom       string
+	body         string
+	responseBody string
+	method       protoreflect.MethodDescriptor
+	path         string
+	types        *dynamicpb.Types
+}
+
+const (
+	wildcardNone = iota
+	wildcardOne
+	wildcardMulti
+)
+
+// ruleSegment is one path segment of an HTTP rule template: a literal, "*"
+// or "**", captured into field when it belongs to a variable.
+type ruleSegment struct {
+	literal  string
+	wildcard int
+	field    string
+}
+
+// transcodeCall is the gRPC request built from a REST request.
+type transcodeCall struct {
+	rule  *httpRule
+	frame []byte
+}
+
+// transcodeError is a REST request that cannot be transcoded.
+type transcodeError struct {
+	status int
+	code   int
+	msg    string
+}
+
+func (e *transcodeError) Error() string { return e.msg }
+
+func newTranscoder(cfg *config.TranscodingConfig) (*transcoder, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(cfg.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("transcoding: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("transcoding %s: %w", cfg.DescriptorSet, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("transcoding %s: %w", cfg.DescriptorSet, err)
+	}
+	types := dynamicpb.NewTypes(files)
+	services := make(map[string]bool, len(cfg.Services))
+	for _, s := range cfg.Services {
+		services[s] = true
+	}
+	tc := &transcoder{}
+	for _, f := range set.File {
+		fd, err := files.FindFileByPath(f.GetName())
+		if err != nil {
+			return nil, fmt.Errorf("transcoding %s: %w", cfg.DescriptorSet, err)
+		}
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+			if len(services) > 0 && !services[string(sd.FullName())] {
+				continue
+			}
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				rule, _ := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+				if rule == nil {
+					continue
+				}
+				for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+					hr, err := newHTTPRule(r, md, types)
+					if err != nil {
+						return nil, fmt.Errorf("transcoding %s: %w", md.FullName(), err)
+					}
+					tc.rules = append(tc.rules, hr)
+				}
+			}
+		}
+	}
+	if len(tc.rules) == 0 {
+		return nil, fmt.Errorf("transcoding %s: no method with a google.api.http annotation", cfg.DescriptorSet)
+	}
+	return tc, nil
+}
+
+func newHTTPRule(r *annotations.HttpRule, md protoreflect.MethodDescriptor, types *dynamicpb.Types) (*httpRule, error) {
+	var verb, tmpl string
+	switch p := r.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		verb, tmpl = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		verb, tmpl = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		verb, tmpl = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		verb, tmpl = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		verb, tmpl = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		verb, tmpl = strings.ToUpper(p.Custom.GetKind()), p.Custom.GetPath()
+	default:
+		return nil, errors.New("http rule without pattern")
+	}
+	segments, custom, err := parseHTTPTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range segments {
+		if s.field != "" && findField(md.Input(), s.field) == nil {
+			return nil, fmt.Errorf("template %q: unknown field %q", tmpl, s.field)
+		}
+	}
+	if b := r.GetBody(); b != "" && b != "*" && findField(md.Input(), b) == nil {
+		return nil, fmt.Errorf("unknown body field %q", b)
+	}
+	if b := r.GetResponseBody(); b != "" && findField(md.Output(), b) == nil {
+		return nil, fmt.Errorf("unknown response_body field %q", b)
+	}
+	return &httpRule{
+		verb:         verb,
+		segments:     segments,
+		custom:       custom,
+		body:         r.GetBody(),
+		responseBody: r.GetResponseBody(),
+		method:       md,
+		path:         fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name()),
+		types:        types,
+	}, nil
+}
+
+// parseHTTPTemplate parses a google.api.http path template such as
+// "/v1/{name=shelves/*}/books/{book}:publish" into its segments and custom
+// verb.
+func parseHTTPTemplate(tmpl string) ([]ruleSegment, string, error) {
+	t, ok := strings.CutPrefix(tmpl, "/")
+	if !ok {
+		return nil, "", fmt.Errorf("template %q: must start with /", tmpl)
+	}
+	custom := ""
+	if i := strings.LastIndexByte(t, ':'); i >= 0 && !strings.ContainsAny(t[i:], "/}") {
+		t, custom = t[:i], t[i+1:]
+	}
+	var segments []ruleSegment
+	for t != "" {
+		if t[0] == '{' {
+			end := strings.IndexByte(t, '}')
+			if end < 0 {
+				return nil, "", fmt.Errorf("template %q: unclosed variable", tmpl)
+			}
+			field, pattern, ok := strings.Cut(t[1:end], "=")
+			if !ok {
+				pattern = "*"
+			}
+			for _, p := range strings.Split(pattern, "/") {
+				s, err := parseRuleSegment(p)
+				if err != nil {
+					return nil, "", fmt.Errorf("template %q: %w", tmpl, err)
+				}
+				s.field = field
+				segments = append(segments, s)
+			}
+			t = t[end+1:]
+		} else {
+			end := strings.IndexByte(t, '/')
+			if end < 0 {
+				end = len(t)
+			}
+			s, err := parseRuleSegment(t[:end])
+			if err != nil {
+				return nil, "", fmt.Errorf("template %q: %w", tmpl, err)
+			}
+			segments = append(segments, s)
+			t = t[end:]
+		}
+		if t != "" {
+			if t[0] != '/' || len(t) == 1 {
+				return nil, "", fmt.Errorf("template %q: invalid segment separator", tmpl)
+			}
+			t = t[1:]
+		}
+	}
+	for i, s := range segments {
+		if s.wildcard == wildcardMulti && i != len(segments)-1 {
+			return nil, "", fmt.Errorf("template %q: ** must be the last segment", tmpl)
+		}
+	}
+	return segments, custom, nil
+}
+
+func parseRuleSegment(s string) (ruleSegment, error) {
+	switch {
+	case s == "*":
+		return ruleSegment{wildcard: wildcardOne}, nil
+	case s == "**":
+		return ruleSegment{wildcard: wildcardMulti}, nil
+	case s == "" || strings.ContainsAny(s, "{}*="):
+		return ruleSegment{}, fmt.Errorf("invalid segment %q", s)
+	}
+	return ruleSegment{literal: s}, nil
+}
+
+// matchPath matches an escaped request path against the template of hr and
+// returns the path variables.
+func (hr *httpRule) matchPath(escapedPath string) (map[string]string, bool) {
+	p := strings.TrimPrefix(escapedPath, "/")
+	if hr.custom != "" {
+		var ok bool
+		if p, ok = strings.CutSuffix(p, ":"+hr.custom); !ok {
+			return nil, false
+		}
+	}
+	var parts []string
+	if p != "" {
+		parts = strings.Split(p, "/")
+	}
+	captured := make(map[string][]string)
+	n := 0
+	for _, s := range hr.segments {
+		if s.wildcard == wildcardMulti {
+			for ; n < len(parts); n++ {
+				part, err := url.PathUnescape(parts[n])
+				if err != nil {
+					return nil, false
+				}
+				if s.field != "" {
+					captured[s.field] = append(captured[s.field], part)
+				}
+			}
+			break
+		}
+		if n >= len(parts) {
+			return nil, false
+		}
+		part, err := url.PathUnescape(parts[n])
+		if err != nil || (s.wildcard == wildcardNone && part != s.literal) {
+			return nil, false
+		}
+		if s.field != "" {
+			captured[s.field] = append(captured[s.field], part)
+		}
+		n++
+	}
+	if n != len(parts) {
+		return nil, false
+	}
+	vars := make(map[string]string, len(captured))
+	for field, parts := range captured {
+		vars[field] = strings.Join(parts, "/")
+	}
+	return vars, true
+}
+
+// transcode builds the gRPC call for a REST request to path. Path
+// variables take precedence over query parameters, which take precedence
+// over the body.
+func (tc *transcoder) transcode(r *http.Request, path string) (*transcodeCall, error) {
+	pathMatched := false
+	for _, rule := range tc.rules {
+		vars, ok := rule.matchPath(path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if rule.verb != r.Method {
+			continue
+		}
+		msg := dynamicpb.NewMessage(rule.method.Input())
+		if err := rule.decodeRequest(msg, r, vars); err != nil {
+			return nil, err
+		}
+		payload, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, &transcodeError{http.StatusBadRequest, 3, err.Error()}
+		}
+		frame := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+		return &transcodeCall{rule: rule, frame: append(frame, payload...)}, nil
+	}
+	if pathMatched {
+		return nil, &transcodeError{http.StatusMethodNotAllowed, 12, "method not allowed"}
+	}
+	return nil, &transcodeError{http.StatusNotFound, 5, "no gRPC method bound to " + path}
+}
+
+func (hr *httpRule) decodeRequest(msg *dynamicpb.Message, r *http.Request, vars map[string]string) error {
+	if hr.body != "" && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, DefaultTranscodeMaxBodyBytes+1))
+		if err != nil && !errors.Is(err, errDecompressedTooLarge) {
+			return &transcodeError{http.StatusBadRequest, 3, err.Error()}
+		}
+		if err != nil || len(body) > DefaultTranscodeMaxBodyBytes {
+			return &transcodeError{http.StatusRequestEntityTooLarge, 8, "request body too large"}
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if hr.body != "*" {
+				// Nest the body under its field path so protojson decodes
+				// scalar, repeated and message fields alike.
+				names := strings.Split(hr.body, ".")
+				for i := len(names) - 1; i >= 0; i-- {
+					body = []byte(fmt.Sprintf("{%q:%s}", names[i], body))
+				}
+			}
+			if err := (protojson.UnmarshalOptions{Resolver: hr.types}).Unmarshal(body, msg); err != nil {
+				return &transcodeError{http.StatusBadRequest, 3, err.Error()}
+			}
+		}
+	}
+	if hr.body != "*" {
+		for key, values := range r.URL.Query() {
+			if _, ok := vars[key]; ok {
+				continue
+			}
+			if err := setField(msg, key, values); err != nil {
+				return &transcodeError{http.StatusBadRequest, 3, err.Error()}
+			}
+		}
+	}
+	for field, value := range vars {
+		if err := setField(msg, field, []string{value}); err != nil {
+			return &transcodeError{http.StatusBadRequest, 3, err.Error()}
+		}
+	}
+	return nil
+}
+
+// prepare turns the outgoing request into the gRPC call.
+func (c *transcodeCall) prepare(req *http.Request) {
+	req.Method = http.MethodPost
+	req.URL.Path = c.rule.path
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.Body = io.NopCloser(bytes.NewReader(c.frame))
+	req.ContentLength = int64(len(c.frame))
+	req.Header.Del("Content-Length")
+	req.Header.Set("Content-Type", "application/grpc")
+}
+
+// transcodeResponse replaces the gRPC response of a transcoded call with its
+// JSON form, or with a JSON error carrying the HTTP status of the gRPC
+// code. It returns the gRPC code.
+func (c *transcodeCall) transcodeResponse(resp *http.Response) (int, error) {
+	data, err := io.ReadAll(io.LimitReader(resp.Body, DefaultTranscodeMaxBodyBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > DefaultTranscodeMaxBodyBytes {
+		return 0, fmt.Errorf("gRPC response body exceeds %d bytes", DefaultTranscodeMaxBodyBytes)
+	}
+	code, ok := grpcStatus(resp.Trailer)
+	source := resp.Trailer
+	if !ok {
+		code, ok = grpcStatus(resp.Header)
+		source = resp.Header
+	}
+	if !ok {
+		return 0, fmt.Errorf("gRPC upstream answered %s without grpc-status", resp.Status)
+	}
+	status := grpcToHTTPStatus(code)
+	var out []byte
+	if code != 0 {
+		msg, _ := url.PathUnescape(source.Get("Grpc-Message"))
+		out = jsonError(code, msg)
+	} else if out, err = c.rule.decodeResponse(data); err != nil {
+		return 0, err
+	}
+	for _, h := range []string{"Trailer", "Grpc-Status", "Grpc-Message", "Grpc-Encoding", "Grpc-Accept-Encoding"} {
+		resp.Header.Del(h)
+	}
+	resp.Trailer = nil
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	resp.ContentLength = int64(len(out))
+	resp.Body = io.NopCloser(bytes.NewReader(out))
+	return code, nil
+}
+
+// decodeResponse converts the gRPC messages of a response body to JSON.
+// Server-streaming methods produce one JSON document per line.
+func (hr *httpRule) decodeResponse(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, errors.New("truncated gRPC message")
+		}
+		if data[0] != 0 {
+			return nil, errors.New("compressed gRPC messages are not supported")
+		}
+		size := binary.BigEndian.Uint32(data[1:5])
+		if uint64(len(data)-5) < uint64(size) {
+			return nil, errors.New("truncated gRPC message")
+		}
+		msg := dynamicpb.NewMessage(hr.method.Output())
+		if err := proto.Unmarshal(data[5:5+size], msg); err != nil {
+			return nil, err
+		}
+		data = data[5+size:]
+		doc, err := protojson.MarshalOptions{Resolver: hr.types}.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		if hr.responseBody != "" {
+			if doc, err = selectField(doc, hr.responseBody); err != nil {
+				return nil, err
+			}
+		}
+		if out != nil {
+			out = append(out, '\n')
+		}
+		out = append(out, doc...)
+	}
+	if out == nil {
+		out = []byte("{}")
+	}
+	return out, nil
+}
+
+// selectField extracts the response_body field path from a JSON document.
+func selectField(doc []byte, path string) ([]byte, error) {
+	for _, name := range strings.Split(path, ".") {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(doc, &fields); err != nil {
+			return nil, err
+		}
+		v, ok := fields[jsonFieldName(name)]
+		if !ok {
+			return []byte("null"), nil
+		}
+		doc = v
+	}
+	return doc, nil
+}
+
+// jsonFieldName converts a proto field name to its lowerCamelCase JSON name.
+func jsonFieldName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func findField(md protoreflect.MessageDescriptor, path string) protoreflect.FieldDescriptor {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil
+		}
+		if i == len(names)-1 {
+			return fd
+		}
+		if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return nil
+		}
+		md = fd.Message()
+	}
+	return nil
+}
+
+// setField sets the field at path, creating intermediate messages, from
+// string values taken from the path or query string.
+func setField(msg protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		fd := findField(msg.Descriptor(), name)
+		if fd == nil || fd.Message() == nil || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("unknown field %q", path)
+		}
+		msg = msg.Mutable(fd).Message()
+	}
+	fd := findField(msg.Descriptor(), names[len(names)-1])
+	if fd == nil || fd.IsMap() || len(values) == 0 {
+		return fmt.Errorf("unknown field %q", path)
+	}
+	if fd.IsList() {
+		list := msg.Mutable(fd).List()
+		for _, s := range values {
+			v, err := parseFieldValue(msg, fd, s)
+			if err != nil {
+				return fmt.Errorf("field %q: %w", path, err)
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+	v, err := parseFieldValue(msg, fd, values[len(values)-1])
+	if err != nil {
+		return fmt.Errorf("field %q: %w", path, err)
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+func parseFieldValue(parent protoreflect.Message, fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(n)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(n), err
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.BytesKind:
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), err
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		// Well-known types such as Timestamp or StringValue have a JSON
+		// string form; other values are taken as JSON.
+		var m protoreflect.Message
+		if fd.IsList() {
+			m = parent.Mutable(fd).List().NewElement().Message()
+		} else {
+			m = parent.NewField(fd).Message()
+		}
+		if err := protojson.Unmarshal([]byte(strconv.Quote(s)), m.Interface()); err != nil {
+			if err := protojson.Unmarshal([]byte(s), m.Interface()); err != nil {
+				return protoreflect.Value{}, err
+			}
+		}
+		return protoreflect.ValueOfMessage(m), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %s", fd.Kind())
+}
+
+// jsonError is the JSON body of a gRPC error, in the format of the gRPC
+// HTTP/JSON gateways.
+func jsonError(code int, msg string) []byte {
+	b, _ := json.Marshal(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Details []any  `json:"details"`
+	}{code, msg, []any{}})
+	return b
+}
+
+func writeJSONError(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(jsonError(code, msg))
+}
+
+// transcodePath returns the escaped request path matched against the HTTP
+// rules, without the path prefix when strip_path_prefix is set.
+func transcodePath(def *store.ApiDefinition, u *url.URL) string {
+	p := u.EscapedPath()
+	if def.StripPathPrefix && def.PathPrefix != "" {
+		p = strings.TrimPrefix(p, strings.TrimSuffix(def.PathPrefix, "/"))
+	}
+	return p
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeGreeterDescriptorSet writes the descriptor set of a greet.v1.Greeter
+// service with google.api.http bindings, as protoc --include_imports would.
+func writeGreeterDescriptorSet(t *testing.T) string {
+	t.Helper()
+	httpRule := &annotations.HttpRule{
+		Pattern: &annotations.HttpRule_Get{Get: "/v1/greetings/{name}"},
+		AdditionalBindings: []*annotations.HttpRule{
+			{Pattern: &annotations.HttpRule_Post{Post: "/v1/greetings"}, Body: "*"},
+		},
+	}
+	opts := &descriptorpb.MethodOptions{}
+	proto.SetExtension(opts, annotations.E_Http, httpRule)
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+	}
+	greet := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("greet/v1/greet.proto"),
+		Package:    proto.String("greet.v1"),
+		Dependency: []string{"google/api/annotations.proto"},
+		Syntax:     proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("HelloRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("times", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			}},
+			{Name: proto.String("HelloReply"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".greet.v1.HelloRequest"),
+				OutputType: proto.String(".greet.v1.HelloReply"),
+				Options:    opts,
+			}},
+		}},
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+		protodesc.ToFileDescriptorProto(annotations.File_google_api_http_proto),
+		protodesc.ToFileDescriptorProto(annotations.File_google_api_annotations_proto),
+		greet,
+	}}
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "greet.pb")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHTTPRuleTemplates(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		path string
+		want map[string]string
+	}{
+		{"/v1/greetings/{name}", "/v1/greetings/alice", map[string]string{"name": "alice"}},
+		{"/v1/greetings/{name}", "/v1/greetings/al%20ice", map[string]string{"name": "al ice"}},
+		{"/v1/greetings/{name}", "/v1/greetings/alice/extra", nil},
+		{"/v1/{name=shelves/*}/books/{book}:publish", "/v1/shelves/s1/books/b2:publish", map[string]string{"name": "shelves/s1", "book": "b2"}},
+		{"/v1/{name=shelves/*}/books/{book}:publish", "/v1/shelves/s1/books/b2", nil},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c.txt", map[string]string{"path": "a/b/c.txt"}},
+		{"/v1/*/items", "/v1/any/items", map[string]string{}},
+	}
+	for _, tt := range tests {
+		segments, custom, err := parseHTTPTemplate(tt.tmpl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.tmpl, err)
+		}
+		rule := &httpRule{segments: segments, custom: custom}
+		got, ok := rule.matchPath(tt.path)
+		if ok != (tt.want != nil) || (ok && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("%s on %s = %v, %v; want %v", tt.tmpl, tt.path, got, ok, tt.want)
+		}
+	}
+	for _, bad := range []string{"v1/items", "/v1/{name", "/v1/**/items", "/v1//items"} {
+		if _, _, err := parseHTTPTemplate(bad); err == nil {
+			t.Errorf("expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestTranscodeResponseLimit(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Grpc-Status": {"0"}},
+		Body:       io.NopCloser(bytes.NewReader(make([]byte, DefaultTranscodeMaxBodyBytes+1))),
+	}
+	if _, err := (&transcodeCall{}).transcodeResponse(resp); err == nil {
+		t.Fatal("expected an error for a response above the size limit")
+	}
+}
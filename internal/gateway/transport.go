@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+// Upstream protocols of an API. By default HTTP/2 is negotiated with ALPN
+// on TLS upstreams and HTTP/1.1 is used otherwise. gRPC uses h2 or h2c
+// depending on the scheme of the upstreams.
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+	ProtocolGRPC  = "grpc"
+)
+
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 32
+	DefaultKeepAlive           = 30 * time.Second
+)
+
+// connectionPool is the resolved connection_pool block of an API.
+type connectionPool struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	keepAlive           time.Duration
+	disableKeepAlives   bool
+}
+
+// resolveConnectionPool merges the connection pool of an API over the
+// gateway settings and the built-in defaults.
+func resolveConnectionPool(gw config.GatewayConfig, api *config.ConnectionPoolConfig) connectionPool {
+	p := connectionPool{
+		maxIdleConns:        DefaultMaxIdleConns,
+		maxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+		keepAlive:           DefaultKeepAlive,
+	}
+	p.merge(gw.ConnectionPool)
+	if api != nil {
+		p.merge(*api)
+	}
+	return p
+}
+
+func (p *connectionPool) merge(c config.ConnectionPoolConfig) {
+	if c.MaxIdleConns > 0 {
+		p.maxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		p.maxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.MaxConnsPerHost > 0 {
+		p.maxConnsPerHost = c.MaxConnsPerHost
+	}
+	if c.KeepAliveSeconds > 0 {
+		p.keepAlive = time.Duration(c.KeepAliveSeconds) * time.Second
+	}
+	p.disableKeepAlives = p.disableKeepAlives || c.DisableKeepAlives
+}
+
+// upstreamProtocols returns the protocols the transport of an API may use,
+// or nil for the default negotiation. h2 requires https upstreams and h2c
+// (HTTP/2 with prior knowledge) plain http ones.
+func upstreamProtocols(name string, pool *upstreamPool) (*http.Protocols, error) {
+	p := new(http.Protocols)
+	scheme := ""
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case ProtocolHTTP1:
+		p.SetHTTP1(true)
+	case ProtocolH2:
+		p.SetHTTP2(true)
+		scheme = "https"
+	case ProtocolH2C:
+		p.SetUnencryptedHTTP2(true)
+		scheme = "http"
+	case ProtocolGRPC:
+		if pool == nil || len(pool.targets) == 0 {
+			return nil, fmt.Errorf("protocol %s requires upstreams", name)
+		}
+		scheme = pool.targets[0].url.Scheme
+		if scheme == "https" {
+			p.SetHTTP2(true)
+		} else {
+			p.SetUnencryptedHTTP2(true)
+		}
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", name)
+	}
+	if pool != nil && scheme != "" {
+		for _, t := range pool.targets {
+			if t.url.Scheme != scheme {
+				return nil, fmt.Errorf("protocol %s requires %s upstreams, got %q", name, scheme, t.url.String())
+			}
+		}
+	}
+	return p, nil
+}
+
+// newRouteTransport builds the transport owned by a route, rebuilt when its
+// upstream TLS files change.
+func newRouteTransport(t timeouts, p connectionPool, protocols *http.Protocols, u *upstreamTLS) *routeTransport {
+	return newReloadingTransport(u, func(tc *tls.Config) *http.Transport {
+		return newHTTPTransport(t, p, protocols, tc)
+	})
+}
+
+// newHTTPTransport builds an http.Transport for the given settings. It
+// honours the proxy environment variables like http.DefaultTransport.
+func newHTTPTransport(t timeouts, p connectionPool, protocols *http.Protocols, tc *tls.Config) *http.Transport {
+	return &http.Transport{
+		Protocols:             protocols,
+		TLSClientConfig:       tc,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: t.dial, KeepAlive: p.keepAlive}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   t.tlsHandshake,
+		ResponseHeaderTimeout: t.responseHeader,
+		IdleConnTimeout:       t.idle,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          p.maxIdleConns,
+		MaxIdleConnsPerHost:   p.maxIdleConnsPerHost,
+		MaxConnsPerHost:       p.maxConnsPerHost,
+		DisableKeepAlives:     p.disableKeepAlives,
+	}
+}
+
+// closeIdleConnections closes the idle backend connections of every route
+// of t, once t has been replaced.
+func (t *routeTable) closeIdleConnections() {
+	if t == nil {
+		return
+	}
+	for _, rt := range t.routes {
+		if rt.transport != nil {
+			rt.transport.CloseIdleConnections()
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+// Load-balancing strategies accepted in load_balancing.strategy.
+const (
+	StrategyRoundRobin       = "round_robin"
+	StrategyWeighted         = "weighted"
+	StrategyLeastRequests    = "least_requests"
+	StrategyRandomTwoChoices = "random_two_choices"
+	StrategyConsistentHash   = "consistent_hash"
+)
+
+const (
+	hashOnIP           = "ip"
+	hashOnHeaderPrefix = "header:"
+	hashRingReplicas   = 100
+)
+
+var errNoUpstream = errors.New("no upstream available")
+
+// upstreamTarget is one backend of an API.
+type upstreamTarget struct {
+	url         *url.URL
+	weight      int
+	outstanding atomic.Int64
+	health      *targetHealth
+	healthKey   string
+	breaker     *circuitBreaker
+}
+
+// healthy reports the result of active health checks. Targets without
+// health checks are always healthy.
+func (t *upstreamTarget) healthy() bool {
+	return t.health == nil || t.health.healthy.Load()
+}
+
+// available reports whether the target may receive traffic: it is healthy
+// and its circuit breaker lets requests through.
+func (t *upstreamTarget) available() bool {
+	return t.healthy() && t.breaker.ready()
+}
+
+// upstreamPool holds the backends of an API and picks one per request
+// according to the configured strategy.
+type upstreamPool struct {
+	targets  []*upstreamTarget
+	strategy string
+	hashOn   string
+	next     atomic.Uint64
+
+	mu      sync.Mutex
+	current []int
+
+	ring []ringEntry
+}
+
+type ringEntry struct {
+	hash   uint64
+	target *upstreamTarget
+}
+
+// newUpstreamPool builds the pool of an API from its upstreams list, or
+// from its single target_url when no upstreams are declared.
+func newUpstreamPool(d *store.ApiDefinition) (*upstreamPool, error) {
+	ups := d.Upstreams
+	if len(ups) == 0 && d.BackendURL != "" {
+		ups = []config.UpstreamConfig{{URL: d.BackendURL}}
+	}
+	p := &upstreamPool{
+		strategy: d.LoadBalancing.Strategy,
+		hashOn:   d.LoadBalancing.HashOn,
+	}
+	if p.strategy == "" {
+		p.strategy = StrategyRoundRobin
+	}
+	if p.hashOn == "" {
+		p.hashOn = hashOnIP
+	}
+	switch p.strategy {
+	case StrategyRoundRobin, StrategyWeighted, StrategyLeastRequests, StrategyRandomTwoChoices, StrategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", p.strategy)
+	}
+	if p.hashOn != hashOnIP && !strings.HasPrefix(p.hashOn, hashOnHeaderPrefix) {
+		return nil, fmt.Errorf("invalid hash_on %q: want %q or %q<name>", p.hashOn, hashOnIP, hashOnHeaderPrefix)
+	}
+	for _, u := range ups {
+		target, err := url.Parse(u.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", u.URL, err)
+		}
+		if target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("upstream %q: absolute URL required", u.URL)
+		}
+		weight := u.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.targets = append(p.targets, &upstreamTarget{url: target, weight: weight})
+	}
+	p.current = make([]int, len(p.targets))
+	if p.strategy == StrategyConsistentHash {
+		p.buildRing()
+	}
+	return p, nil
+}
+
+func (p *upstreamPool) buildRing() {
+	for _, t := range p.targets {
+		for i := 0; i < hashRingReplicas*t.weight; i++ {
+			p.ring = append(p.ring, ringEntry{hash: hashString(t.url.Host + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// pick returns the target serving r, or nil when no target is available.
+func (p *upstreamPool) pick(r *http.Request) *upstreamTarget {
+	if p == nil || len(p.targets) == 0 {
+		return nil
+	}
+	if len(p.targets) == 1 {
+		if t := p.targets[0]; t.available() {
+			return t
+		}
+		return nil
+	}
+	switch p.strategy {
+	case StrategyWeighted:
+		return p.pickWeighted()
+	case StrategyLeastRequests:
+		return p.pickLeastRequests()
+	case StrategyRandomTwoChoices:
+		return p.pickTwoChoices()
+	case StrategyConsistentHash:
+		return p.pickHash(p.hashKey(r))
+	default:
+		return p.pickRoundRobin()
+	}
+}
+
+func (p *upstreamPool) pickRoundRobin() *upstreamTarget {
+	n := uint64(len(p.targets))
+	start := p.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		if t := p.targets[(start+i)%n]; t.available() {
+			return t
+		}
+	}
+	return nil
+}
+
+// pickWeighted implements smooth weighted round-robin: every pick adds each
+// target's weight to its current score and selects the highest score, which
+// then pays back the total weight.
+func (p *upstreamPool) pickWeighted() *upstreamTarget {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, total := -1, 0
+	for i, t := range p.targets {
+		if !t.available() {
+			continue
+		}
+		p.current[i] += t.weight
+		total += t.weight
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.current[best] -= total
+	return p.targets[best]
+}
+
+func (p *upstreamPool) pickLeastRequests() *upstreamTarget {
+	n := len(p.targets)
+	start := int((p.next.Add(1) - 1) % uint64(n))
+	var best *upstreamTarget
+	for i := 0; i < n; i++ {
+		t := p.targets[(start+i)%n]
+		if !t.available() {
+			continue
+		}
+		if best == nil || t.outstanding.Load() < best.outstanding.Load() {
+			best = t
+		}
+	}
+	return best
+}
+
+func (p *upstreamPool) pickTwoChoices() *upstreamTarget {
+	var candidates []*upstreamTarget
+	for _, t := range p.targets {
+		if t.available() {
+			candidates = append(candidates, t)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if b.outstanding.Load() < a.outstanding.Load() {
+		return b
+	}
+	return a
+}
+
+// pickHash walks the hash ring clockwise from key and returns the first
+// available target. Requests without a key are spread randomly.
+func (p *upstreamPool) pickHash(key string) *upstreamTarget {
+	if key == "" {
+		return p.pickTwoChoices()
+	}
+	h := hashString(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		if t := p.ring[(start+i)%len(p.ring)].target; t.available() {
+			return t
+		}
+	}
+	return nil
+}
+
+// unavailableErr explains why pick found no target: every healthy target
+// has an open circuit, or no target is healthy at all.
+func (p *upstreamPool) unavailableErr() error {
+	if p != nil {
+		for _, t := range p.targets {
+			if t.healthy() && !t.breaker.ready() {
+				return errCircuitOpen
+			}
+		}
+	}
+	return errNoUpstream
+}
+
+func (p *upstreamPool) hashKey(r *http.Request) string {
+	if name, ok := strings.CutPrefix(p.hashOn, hashOnHeaderPrefix); ok {
+		return r.Header.Get(name)
+	}
+	return clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// upstreamTransport picks the backend of every outgoing request from the
+// pool stored in the request context, guards it with the target's circuit
+// breaker, retries according to the API's retry policy and tracks
+// outstanding requests per target until the response body is closed.
+type upstreamTransport struct {
+	base   http.RoundTripper
+	budget *retryBudget
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state, _ := req.Context().Value(proxyStateKey{}).(*proxyState)
+	if state == nil {
+		return t.base.RoundTrip(req)
+	}
+	t.budget.request()
+	policy := state.retry
+	if !policy.allows(req.Method) {
+		return t.attempt(req, state)
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		buf, replay, ok, err := bufferBody(req.Body, policy.maxBodyBytes)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			out := req.Clone(req.Context())
+			out.Body = replay
+			return t.attempt(out, state)
+		}
+		body = buf
+	}
+
+	for n := 1; ; n++ {
+		out := req
+		if body != nil {
+			out = req.Clone(req.Context())
+			out.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.attempt(out, state)
+		if n >= policy.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		switch {
+		case err != nil && !policy.retryableError(err):
+			return nil, err
+		case err == nil && !policy.statuses[resp.StatusCode]:
+			return resp, nil
+		}
+		if !t.budget.withdraw() {
+			state.retryBudgetExhausted = true
+			return resp, err
+		}
+		if resp != nil {
+			drainAndClose(resp.Body)
+		}
+		if !sleepContext(req.Context(), policy.backoff(n)) {
+			return nil, req.Context().Err()
+		}
+		state.retries++
+		state.circuitOpen = false
+	}
+}
+
+// attempt sends req to one target of the pool.
+func (t *upstreamTransport) attempt(req *http.Request, state *proxyState) (*http.Response, error) {
+	target := state.pool.pick(req)
+	if target == nil {
+		err := state.pool.unavailableErr()
+		state.circuitOpen = errors.Is(err, errCircuitOpen)
+		return nil, err
+	}
+	state.target = target
+	generation, ok := target.breaker.acquire()
+	if !ok {
+		state.circuitOpen = true
+		return nil, errCircuitOpen
+	}
+
+	out := new(http.Request)
+	*out = *req
+	u := *req.URL
+	u.Scheme = target.url.Scheme
+	u.Host = target.url.Host
+	out.URL = &u
+	out.Host = target.url.Host
+
+	target.outstanding.Add(1)
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		target.outstanding.Add(-1)
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			target.breaker.release(generation)
+		} else {
+			target.breaker.record(generation, false)
+		}
+		return nil, err
+	}
+	target.breaker.record(generation, resp.StatusCode < http.StatusInternalServerError)
+	state.upstreamProto = resp.Proto
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// Upgraded bodies must stay io.ReadWriteCloser for the proxy.
+		target.outstanding.Add(-1)
+		return resp, nil
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { target.outstanding.Add(-1) }}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,282 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func testPool(t *testing.T, strategy, hashOn string, weights ...int) *upstreamPool {
+	t.Helper()
+	d := &store.ApiDefinition{LoadBalancing: config.LoadBalancingConfig{Strategy: strategy, HashOn: hashOn}}
+	for i, w := range weights {
+		d.Upstreams = append(d.Upstreams, config.UpstreamConfig{URL: fmt.Sprintf("http://backend-%d:8080", i), Weight: w})
+	}
+	p, err := newUpstreamPool(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func pickCounts(p *upstreamPool, n int, req func(i int) *http.Request) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[p.pick(req(i)).url.Host]++
+	}
+	return counts
+}
+
+func TestUpstreamPool_Strategies(t *testing.T) {
+	plain := func(int) *http.Request { return httptest.NewRequest("GET", "/", nil) }
+
+	t.Run("Round Robin", func(t *testing.T) {
+		counts := pickCounts(testPool(t, "", "", 1, 1, 1), 300, plain)
+		for host, n := range counts {
+			if n != 100 {
+				t.Errorf("%s: expected 100 picks, got %d", host, n)
+			}
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		counts := pickCounts(testPool(t, StrategyWeighted, "", 3, 1), 400, plain)
+		if counts["backend-0:8080"] != 300 || counts["backend-1:8080"] != 100 {
+			t.Errorf("expected 300/100 split, got %v", counts)
+		}
+	})
+
+	t.Run("Least Requests", func(t *testing.T) {
+		p := testPool(t, StrategyLeastRequests, "", 1, 1, 1)
+		p.targets[0].outstanding.Store(5)
+		p.targets[2].outstanding.Store(2)
+		for i := 0; i < 10; i++ {
+			if got := p.pick(nil); got != p.targets[1] {
+				t.Fatalf("expected idle backend-1, got %s", got.url.Host)
+			}
+		}
+	})
+
+	t.Run("Random Two Choices", func(t *testing.T) {
+		p := testPool(t, StrategyRandomTwoChoices, "", 1, 1)
+		p.targets[0].outstanding.Store(10)
+		if got := p.pick(nil); got != p.targets[1] {
+			t.Errorf("expected less loaded backend-1, got %s", got.url.Host)
+		}
+	})
+
+	t.Run("Consistent Hash On Header", func(t *testing.T) {
+		p := testPool(t, StrategyConsistentHash, "header:X-User", 1, 1, 1, 1)
+		byUser := func(i int) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-User", fmt.Sprintf("user-%d", i%20))
+			return r
+		}
+		first := make(map[int]*upstreamTarget)
+		for i := 0; i < 20; i++ {
+			first[i] = p.pick(byUser(i))
+		}
+		for i := 0; i < 200; i++ {
+			if got := p.pick(byUser(i)); got != first[i%20] {
+				t.Fatalf("user-%d moved from %s to %s", i%20, first[i%20].url.Host, got.url.Host)
+			}
+		}
+		if counts := pickCounts(p, 200, byUser); len(counts) < 2 {
+			t.Errorf("expected keys spread over several backends, got %v", counts)
+		}
+	})
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		for _, d := range []*store.ApiDefinition{
+			{BackendURL: "http://a", LoadBalancing: config.LoadBalancingConfig{Strategy: "fastest"}},
+			{BackendURL: "http://a", LoadBalancing: config.LoadBalancingConfig{Strategy: StrategyConsistentHash, HashOn: "cookie"}},
+			{Upstreams: []config.UpstreamConfig{{URL: "backend:8080"}}},
+		} {
+			if _, err := newUpstreamPool(d); err == nil {
+				t.Errorf("expected error for %+v", d)
+			}
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	newBreaker := func(cfg config.CircuitBreakerConfig) *circuitBreaker {
+		b := newCircuitBreaker("test", &cfg)
+		b.now = func() time.Time { return now }
+		return b
+	}
+	admit := func(b *circuitBreaker) uint64 {
+		t.Helper()
+		gen, ok := b.acquire()
+		if !ok {
+			t.Fatalf("request rejected in state %s", b.currentState())
+		}
+		return gen
+	}
+	fail := func(b *circuitBreaker, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			b.record(admit(b), false)
+		}
+	}
+
+	t.Run("Consecutive Failures", func(t *testing.T) {
+		b := newBreaker(config.CircuitBreakerConfig{ConsecutiveFailures: 3, OpenSeconds: 5, HalfOpenRequests: 2})
+		fail(b, 2)
+		b.record(admit(b), true)
+		fail(b, 2)
+		if b.currentState() != circuitClosed {
+			t.Fatal("a success must reset the consecutive failure count")
+		}
+		fail(b, 1)
+		if _, ok := b.acquire(); b.currentState() != circuitOpen || b.ready() || ok {
+			t.Fatalf("expected open circuit, got %s", b.currentState())
+		}
+
+		now = now.Add(5 * time.Second)
+		p1, p2 := admit(b), admit(b)
+		if _, ok := b.acquire(); ok {
+			t.Fatal("expected exactly 2 half-open probes")
+		}
+		b.record(p1, true)
+		b.record(p2, false)
+		if b.currentState() != circuitOpen {
+			t.Fatalf("expected a failed probe to reopen the circuit, got %s", b.currentState())
+		}
+
+		now = now.Add(5 * time.Second)
+		p1, p2 = admit(b), admit(b)
+		b.record(p1, true)
+		b.record(p2, true)
+		if b.currentState() != circuitClosed {
+			t.Fatalf("expected closed circuit after successful probes, got %s", b.currentState())
+		}
+	})
+
+	t.Run("Error Rate", func(t *testing.T) {
+		b := newBreaker(config.CircuitBreakerConfig{ErrorRateThreshold: 0.5, MinRequests: 10, WindowSeconds: 10})
+		for i := 0; i < 8; i++ {
+			b.record(admit(b), i%2 == 0)
+		}
+		if b.currentState() != circuitClosed {
+			t.Fatal("expected closed circuit below min_requests")
+		}
+		now = now.Add(10 * time.Second)
+		for i := 0; i < 10; i++ {
+			b.record(admit(b), i%2 == 0)
+		}
+		if b.currentState() != circuitOpen {
+			t.Fatalf("expected open circuit at 50%% errors, got %s", b.currentState())
+		}
+	})
+
+	t.Run("Release Frees Probe", func(t *testing.T) {
+		b := newBreaker(config.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenSeconds: 1})
+		fail(b, 1)
+		now = now.Add(time.Second)
+		b.release(admit(b))
+		if !b.ready() {
+			t.Error("expected released probe slot to be reusable")
+		}
+	})
+
+	t.Run("Late Result After Half-Open", func(t *testing.T) {
+		b := newBreaker(config.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenSeconds: 1})
+		late := admit(b)
+		fail(b, 1)
+		now = now.Add(time.Second)
+		probe := admit(b)
+
+		// The request admitted while the circuit was closed finishes now:
+		// it neither closes nor reopens the circuit, nor frees the probe slot.
+		b.record(late, true)
+		if b.currentState() != circuitHalfOpen {
+			t.Fatalf("expected a late success to be ignored, got %s", b.currentState())
+		}
+		b.record(late, false)
+		if b.currentState() != circuitHalfOpen {
+			t.Fatalf("expected a late failure to be ignored, got %s", b.currentState())
+		}
+		b.release(late)
+		if _, ok := b.acquire(); ok {
+			t.Fatal("expected a late release not to free the probe slot")
+		}
+
+		b.record(probe, true)
+		if b.currentState() != circuitClosed {
+			t.Fatalf("expected the probe to close the circuit, got %s", b.currentState())
+		}
+	})
+
+	t.Run("Pool Skips Open Targets", func(t *testing.T) {
+		d := &store.ApiDefinition{
+			Name:           "cb",
+			Upstreams:      []config.UpstreamConfig{{URL: "http://a"}, {URL: "http://b"}},
+			CircuitBreaker: &config.CircuitBreakerConfig{ConsecutiveFailures: 1},
+		}
+		p, err := newUpstreamPool(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newBreakerRegistry().attach(p, d)
+		fail(p.targets[0].breaker, 1)
+		for i := 0; i < 4; i++ {
+			if got := p.pick(nil); got != p.targets[1] {
+				t.Fatalf("expected b, got %s", got.url.Host)
+			}
+		}
+		fail(p.targets[1].breaker, 1)
+		if got := p.pick(nil); got != nil || p.unavailableErr() != errCircuitOpen {
+			t.Errorf("expected no target and errCircuitOpen, got %v", got)
+		}
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newRetryBudget(config.RetryBudgetConfig{Ratio: 0.5, MinRetriesPerSecond: 1, WindowSeconds: 2})
+	b.now = func() time.Time { return now }
+
+	if !b.withdraw() || !b.withdraw() || b.withdraw() {
+		t.Fatal("expected the floor of 2 retries per 2s window without traffic")
+	}
+	for i := 0; i < 10; i++ {
+		b.request()
+	}
+	for i := 2; i < 5; i++ {
+		if !b.withdraw() {
+			t.Fatalf("retry %d: expected budget of 5 retries for 10 requests", i)
+		}
+	}
+	if b.withdraw() {
+		t.Error("expected budget to be spent")
+	}
+	now = now.Add(2 * time.Second)
+	if !b.withdraw() {
+		t.Error("expected a fresh budget in the next window")
+	}
+}
+
+func TestResolveTimeouts(t *testing.T) {
+	gw := config.GatewayConfig{
+		BackendTimeoutSeconds: 30,
+		Timeouts:              config.TimeoutsConfig{DialSeconds: 5, ResponseHeaderSeconds: 10},
+	}
+	got := resolveTimeouts(gw, &config.TimeoutsConfig{ResponseHeaderSeconds: 2})
+	want := timeouts{
+		dial:           5 * time.Second,
+		tlsHandshake:   DefaultTLSHandshakeTimeout,
+		responseHeader: 2 * time.Second,
+		idle:           DefaultIdleConnTimeout,
+		total:          30 * time.Second,
+	}
+	if got != want {
+		t.Errorf("resolveTimeouts = %+v, want %+v", got, want)
+	}
+}
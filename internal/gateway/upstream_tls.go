@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+// upstreamTLS is the compiled upstream_tls block of an API. Its files are
+// checked for changes at most every checkEvery, when a connection is about
+// to be used, and a new tls.Config is built when they changed.
+type upstreamTLS struct {
+	files      []string
+	cfg        config.UpstreamTLSConfig
+	checkEvery time.Duration
+
+	mu      sync.Mutex
+	config  *tls.Config
+	modTime time.Time
+	checked time.Time
+}
+
+// newUpstreamTLS validates and loads the upstream TLS settings of an API,
+// or returns nil when it has none.
+func newUpstreamTLS(cfg *config.UpstreamTLSConfig, pool *upstreamPool) (*upstreamTLS, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("upstream_tls: cert_file and key_file must be set together")
+	}
+	if cfg.InsecureSkipVerify && (len(cfg.CAFiles) > 0 || cfg.ServerName != "") {
+		return nil, errors.New("upstream_tls: insecure_skip_verify cannot be combined with ca_files or server_name")
+	}
+	if pool != nil {
+		for _, t := range pool.targets {
+			if t.url.Scheme != "https" {
+				return nil, fmt.Errorf("upstream_tls requires https upstreams, got %q", t.url.String())
+			}
+		}
+	}
+	u := &upstreamTLS{cfg: *cfg, checkEvery: DefaultCertReloadInterval}
+	u.files = append(u.files, cfg.CAFiles...)
+	if cfg.CertFile != "" {
+		u.files = append(u.files, cfg.CertFile, cfg.KeyFile)
+	}
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// load reads the files and replaces the current configuration. Callers
+// hold u.mu, except while the value is being built.
+func (u *upstreamTLS) load() error {
+	modTime := latestModTime(u.files...)
+	tc := &tls.Config{
+		ServerName:         u.cfg.ServerName,
+		InsecureSkipVerify: u.cfg.InsecureSkipVerify,
+	}
+	if len(u.cfg.CAFiles) > 0 {
+		pool, err := loadCertPool(u.cfg.CAFiles)
+		if err != nil {
+			return fmt.Errorf("upstream_tls: ca_files: %w", err)
+		}
+		tc.RootCAs = pool
+	}
+	if u.cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.cfg.CertFile, u.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("upstream_tls: client certificate %s: %w", u.cfg.CertFile, err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	u.config, u.modTime = tc, modTime
+	return nil
+}
+
+// clientConfig returns the TLS configuration for new upstream connections,
+// reloading the files first when they changed. A failed reload keeps the
+// current configuration. The result is shared and must not be modified.
+func (u *upstreamTLS) clientConfig() *tls.Config {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if time.Since(u.checked) < u.checkEvery {
+		return u.config
+	}
+	u.checked = time.Now()
+	if latestModTime(u.files...).Equal(u.modTime) {
+		return u.config
+	}
+	if err := u.load(); err != nil {
+		log.Printf("apimcore gateway: keeping current upstream TLS settings: %v", err)
+	} else {
+		log.Printf("apimcore gateway: reloaded upstream TLS files")
+	}
+	return u.config
+}
+
+// routeTransport is the upstream transport of a route. The http.Transport
+// is rebuilt whenever the upstream TLS configuration is reloaded; the
+// previous one keeps serving its requests in flight and its idle
+// connections are closed.
+type routeTransport struct {
+	tls   *upstreamTLS
+	build func(*tls.Config) *http.Transport
+
+	mu        sync.Mutex
+	current   *http.Transport
+	tlsConfig *tls.Config
+}
+
+func newReloadingTransport(u *upstreamTLS, build func(*tls.Config) *http.Transport) *routeTransport {
+	tc := u.clientConfig()
+	return &routeTransport{tls: u, build: build, current: build(tc), tlsConfig: tc}
+}
+
+func (t *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.transport().RoundTrip(req)
+}
+
+func (t *routeTransport) transport() *http.Transport {
+	tc := t.tls.clientConfig()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc != t.tlsConfig {
+		old := t.current
+		t.current, t.tlsConfig = t.build(tc), tc
+		old.CloseIdleConnections()
+	}
+	return t.current
+}
+
+func (t *routeTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.current.CloseIdleConnections()
+}
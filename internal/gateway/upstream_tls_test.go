@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	server, _ := writeTestCert(t, dir, "backend", "backend.internal")
+	client, clientCert := writeTestCert(t, dir, "client", "gateway.internal")
+	other, _ := writeTestCert(t, dir, "other", "other.internal")
+
+	serverPair, err := tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// The CA bundle starts with the wrong certificate, so the backend is
+	// not trusted until the file is replaced.
+	caFile := filepath.Join(dir, "ca.pem")
+	ca, _ := os.ReadFile(other.CertFile)
+	os.WriteFile(caFile, ca, 0o600)
+	d := &store.ApiDefinition{
+		Name:       "internal",
+		BackendURL: backend.URL,
+		UpstreamTLS: &config.UpstreamTLSConfig{
+			CAFiles:    []string{caFile},
+			CertFile:   client.CertFile,
+			KeyFile:    client.KeyFile,
+			ServerName: "backend.internal",
+		},
+	}
+	pool, err := newUpstreamPool(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newUpstreamTLS(d.UpstreamTLS, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.checkEvery = 0
+	transport := newRouteTransport(timeouts{}, connectionPool{}, nil, u)
+	defer transport.CloseIdleConnections()
+
+	get := func() (*http.Response, error) {
+		req, _ := http.NewRequest("GET", backend.URL+"/", nil)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	if _, err := get(); err == nil {
+		t.Fatal("expected the backend certificate to be rejected")
+	}
+
+	ca, _ = os.ReadFile(server.CertFile)
+	os.WriteFile(caFile, ca, 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, future, future)
+	resp, err := get()
+	if err != nil {
+		t.Fatalf("expected the reloaded CA bundle to be used: %v", err)
+	}
+	if got := resp.Header.Get("X-Client"); got != "gateway.internal" {
+		t.Errorf("expected the client certificate to be presented, got %q", got)
+	}
+
+	os.WriteFile(caFile, []byte("broken"), 0o600)
+	os.Chtimes(caFile, future.Add(time.Minute), future.Add(time.Minute))
+	if _, err := get(); err != nil {
+		t.Errorf("expected the current settings to be kept after a failed reload: %v", err)
+	}
+
+	tests := []struct {
+		cfg  config.UpstreamTLSConfig
+		url  string
+		want string
+	}{
+		{config.UpstreamTLSConfig{CertFile: client.CertFile}, backend.URL, "cert_file and key_file"},
+		{config.UpstreamTLSConfig{InsecureSkipVerify: true, CAFiles: []string{caFile}}, backend.URL, "insecure_skip_verify"},
+		{config.UpstreamTLSConfig{}, "http://backend.internal", "requires https upstreams"},
+		{config.UpstreamTLSConfig{CAFiles: []string{filepath.Join(dir, "missing.pem")}}, backend.URL, "missing.pem"},
+		{config.UpstreamTLSConfig{CAFiles: []string{caFile}}, backend.URL, "no PEM certificates"},
+	}
+	for _, tt := range tests {
+		pool, err := newUpstreamPool(&store.ApiDefinition{BackendURL: tt.url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newUpstreamTLS(&tt.cfg, pool); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got error %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
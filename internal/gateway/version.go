@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const (
+	HeaderAcceptVersion = "Accept-Version"
+	HeaderApiVersion    = "Api-Version"
+)
+
+var versionSegment = regexp.MustCompile(`^/[vV][0-9]+(\.[0-9]+)*(/|$)`)
+
+// requestedVersion returns the version of rt asked for by the client: a
+// /v{n}/ segment right after the path prefix naming one of its versions,
+// then the Accept-Version or Api-Version header, then a version parameter
+// of the Accept media type. segment is the path segment to remove before
+// forwarding, if any. Other /v{n}/ segments are part of the resource path.
+func (rt *route) requestedVersion(r *http.Request) (version, segment string) {
+	if prefix := rt.def.PathPrefix; prefix != "" {
+		if rest, ok := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(prefix, "/")); ok {
+			if m := versionSegment.FindString(rest); m != "" {
+				segment = strings.TrimSuffix(m, "/")
+				if rt.findVersion(segment[1:]) != nil {
+					return segment[1:], segment
+				}
+			}
+		}
+	}
+	for _, h := range []string{HeaderAcceptVersion, HeaderApiVersion} {
+		if v := strings.TrimSpace(r.Header.Get(h)); v != "" {
+			return v, ""
+		}
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(accept); err == nil {
+			if v := params["version"]; v != "" {
+				return v, ""
+			}
+			if v := params["v"]; v != "" {
+				return v, ""
+			}
+		}
+	}
+	return "", ""
+}
+
+// sameVersion compares versions ignoring case and a leading "v", so "v2",
+// "V2" and "2" are equal.
+func sameVersion(a, b string) bool {
+	trim := func(s string) string { return strings.TrimPrefix(strings.ToLower(s), "v") }
+	return trim(a) == trim(b)
+}
+
+// findVersion returns the route of rt or its versions declaring version.
+func (rt *route) findVersion(version string) *route {
+	if sameVersion(rt.def.Version, version) {
+		return rt
+	}
+	for _, v := range rt.versions {
+		if sameVersion(v.def.Version, version) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (rt *route) availableVersions() []string {
+	out := []string{rt.def.Version}
+	for _, v := range rt.versions {
+		out = append(out, v.def.Version)
+	}
+	return out
+}
+
+// stripVersionSegment removes a negotiated /v{n} segment following prefix
+// from the request path, keeping the escaping of the rest of the path.
+func stripVersionSegment(r *http.Request, prefix, segment string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	strip := func(p string) string {
+		rest := strings.TrimPrefix(p, prefix+segment)
+		if rest == "" {
+			rest = "/"
+		}
+		return prefix + rest
+	}
+	raw := r.URL.RawPath
+	r.URL.Path = strip(r.URL.Path)
+	r.URL.RawPath = ""
+	if raw != "" && strings.HasPrefix(raw, prefix+segment) {
+		r.URL.RawPath = strip(raw)
+	}
+}
+
+// deprecationHeaders builds the Deprecation, Sunset and Link response
+// headers of a deprecated version.
+func deprecationHeaders(dc *config.DeprecationConfig) (http.Header, error) {
+	if dc == nil {
+		return nil, nil
+	}
+	h := make(http.Header)
+	h.Set("Deprecation", "true")
+	if dc.Date != "" {
+		t, err := time.Parse(time.DateOnly, dc.Date)
+		if err != nil {
+			return nil, fmt.Errorf("deprecation date: %w", err)
+		}
+		h.Set("Deprecation", fmt.Sprintf("@%d", t.Unix()))
+	}
+	if dc.Sunset != "" {
+		t, err := time.Parse(time.DateOnly, dc.Sunset)
+		if err != nil {
+			return nil, fmt.Errorf("sunset date: %w", err)
+		}
+		h.Set("Sunset", t.UTC().Format(http.TimeFormat))
+	}
+	if dc.Link != "" {
+		h.Set("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", dc.Link))
+	}
+	return h, nil
+}
@@ -0,0 +1,253 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navantesolutions/apimcore/config"
+)
+
+const DefaultWebSocketIdleTimeout = 5 * time.Minute
+
+// webSocketPolicy is the compiled websocket block of an API. Routes without
+// one still proxy upgrades, with the default idle timeout and no limit.
+type webSocketPolicy struct {
+	idle           time.Duration
+	maxConnections int
+}
+
+func newWebSocketPolicy(cfg *config.WebSocketConfig) *webSocketPolicy {
+	p := &webSocketPolicy{idle: DefaultWebSocketIdleTimeout}
+	if cfg == nil {
+		return p
+	}
+	if cfg.IdleTimeoutSeconds > 0 {
+		p.idle = time.Duration(cfg.IdleTimeoutSeconds) * time.Second
+	}
+	p.maxConnections = cfg.MaxConnectionsPerSubscription
+	return p
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket
+// protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connLimiter counts the WebSocket connections each subscription keeps
+// open on each API.
+type connLimiter struct {
+	mu    sync.Mutex
+	conns map[connKey]int
+}
+
+type connKey struct {
+	api string
+	sub int64
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{conns: make(map[connKey]int)}
+}
+
+// acquire reserves a connection unless the subscription already holds max
+// of them. A max of zero means no limit.
+func (l *connLimiter) acquire(api string, sub int64, max int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := connKey{api: api, sub: sub}
+	if max > 0 && l.conns[k] >= max {
+		return false
+	}
+	l.conns[k]++
+	return true
+}
+
+func (l *connLimiter) release(api string, sub int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := connKey{api: api, sub: sub}
+	if l.conns[k] <= 1 {
+		delete(l.conns, k)
+		return
+	}
+	l.conns[k]--
+}
+
+// webSocket accounts for an upgraded connection. In is the client to
+// backend direction, out the other way.
+type webSocket struct {
+	idle       time.Duration
+	upgradedAt time.Time
+	lastActive atomic.Int64
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	in, out    frameCounter
+	onUpgrade  func()
+
+	mu     sync.Mutex
+	conn   io.Closer
+	timer  *time.Timer
+	closed bool
+}
+
+// upgrade wraps the backend connection of a 101 response so traffic is
+// counted and the connection is closed after ws.idle without traffic.
+func (ws *webSocket) upgrade(resp *http.Response) {
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	ws.upgradedAt = time.Now()
+	ws.lastActive.Store(ws.upgradedAt.UnixNano())
+	c := &wsConn{ReadWriteCloser: backend, ws: ws}
+	ws.mu.Lock()
+	ws.conn = c
+	if ws.idle > 0 {
+		ws.timer = time.AfterFunc(ws.idle, func() { ws.checkIdle(c) })
+	}
+	ws.mu.Unlock()
+	resp.Body = c
+	if ws.onUpgrade != nil {
+		ws.onUpgrade()
+	}
+}
+
+// checkIdle closes c once it has been idle for ws.idle, and otherwise
+// checks again when that would next be the case.
+func (ws *webSocket) checkIdle(c io.Closer) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return
+	}
+	idleFor := time.Since(time.Unix(0, ws.lastActive.Load()))
+	if idleFor >= ws.idle {
+		_ = c.Close()
+		return
+	}
+	ws.timer.Reset(ws.idle - idleFor)
+}
+
+func (ws *webSocket) upgraded() bool {
+	return !ws.upgradedAt.IsZero()
+}
+
+// disconnect closes the backend connection of an upgraded WebSocket, which
+// ends the proxying of both directions.
+func (ws *webSocket) disconnect() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.conn != nil && !ws.closed {
+		_ = ws.conn.Close()
+	}
+}
+
+func (ws *webSocket) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.closed = true
+	if ws.timer != nil {
+		ws.timer.Stop()
+	}
+}
+
+// wsConn is the backend side of an upgraded connection: reads flow to the
+// client and writes come from it.
+type wsConn struct {
+	io.ReadWriteCloser
+	ws *webSocket
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.ws.bytesOut.Add(int64(n))
+		c.ws.out.feed(p[:n])
+		c.ws.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.ws.bytesIn.Add(int64(n))
+		c.ws.in.feed(p[:n])
+		c.ws.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// frameCounter counts the data messages flowing in one direction of a
+// WebSocket connection by following frame headers (RFC 6455 section 5.2)
+// and skipping payloads. Each direction is fed by a single goroutine; only
+// the message count is read concurrently.
+type frameCounter struct {
+	messages atomic.Int64
+	header   [14]byte
+	have     int
+	need     int
+	skip     uint64
+}
+
+func (f *frameCounter) feed(p []byte) {
+	for len(p) > 0 {
+		if f.skip > 0 {
+			n := uint64(len(p))
+			if n > f.skip {
+				n = f.skip
+			}
+			f.skip -= n
+			p = p[n:]
+			continue
+		}
+		f.header[f.have] = p[0]
+		f.have++
+		p = p[1:]
+		if f.have == 2 {
+			f.need = 2
+			switch f.header[1] & 0x7f {
+			case 126:
+				f.need += 2
+			case 127:
+				f.need += 8
+			}
+			if f.header[1]&0x80 != 0 {
+				f.need += 4
+			}
+		}
+		if f.have < 2 || f.have < f.need {
+			continue
+		}
+		length := uint64(f.header[1] & 0x7f)
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(f.header[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(f.header[2:10])
+		}
+		// A final frame with a data or continuation opcode ends a message;
+		// control frames (opcode 8 and above) are not messages.
+		if fin, opcode := f.header[0]&0x80 != 0, f.header[0]&0x0f; fin && opcode < 8 {
+			f.messages.Add(1)
+		}
+		f.skip = length
+		f.have, f.need = 0, 0
+	}
+}
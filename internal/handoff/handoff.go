@@ -0,0 +1,297 @@
+// Package handoff passes the listening sockets of apimcore to a new process
+// on upgrade, and picks up the sockets of systemd socket activation.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvListenFDs lists the names of the listeners inherited from the
+	// previous process, comma-separated, starting at file descriptor 3.
+	EnvListenFDs = "APIM_LISTEN_FDS"
+	// EnvReadyFD is the file descriptor the new process reports readiness
+	// on.
+	EnvReadyFD = "APIM_READY_FD"
+
+	DefaultReadyTimeout = 30 * time.Second
+	acceptGrace         = 250 * time.Millisecond
+
+	firstFD = 3
+)
+
+// Default names of systemd sockets without FileDescriptorName, in order.
+var systemdNames = []string{"gateway", "server"}
+
+type namedListener struct {
+	name string
+	ln   net.Listener
+}
+
+// Upgrader owns the listeners of the process and hands them over on
+// upgrade.
+type Upgrader struct {
+	ReadyTimeout time.Duration
+	// Output, when set, receives the standard output and error of the new
+	// process, whose standard input is then the null device. By default
+	// the new process shares the standard streams of this one, which
+	// suits logs but not a terminal interface owned by this process.
+	Output *os.File
+
+	mu        sync.Mutex
+	inherited map[string]net.Listener
+	listeners []namedListener
+	ready     *os.File
+	upgraded  chan struct{}
+	child     *os.Process
+}
+
+// New returns an Upgrader holding the listeners inherited from a previous
+// apimcore process or from systemd (LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES), if any. The variables are removed from the environment
+// once read.
+func New() (*Upgrader, error) {
+	u := &Upgrader{
+		ReadyTimeout: DefaultReadyTimeout,
+		inherited:    make(map[string]net.Listener),
+		upgraded:     make(chan struct{}),
+	}
+	names, err := inheritedNames()
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("handoff: inherited listener %q: %w", name, err)
+		}
+		u.inherited[name] = ln
+	}
+	if s := os.Getenv(EnvReadyFD); s != "" {
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("handoff: invalid %s %q", EnvReadyFD, s)
+		}
+		u.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	for _, k := range []string{EnvListenFDs, EnvReadyFD, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(k)
+	}
+	return u, nil
+}
+
+// inheritedNames returns the names of the inherited listeners, in file
+// descriptor order.
+func inheritedNames() ([]string, error) {
+	if s := os.Getenv(EnvListenFDs); s != "" {
+		return strings.Split(s, ","), nil
+	}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("handoff: invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := make([]string, n)
+	fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range names {
+		switch {
+		case os.Getenv("LISTEN_FDNAMES") != "" && i < len(fdNames):
+			names[i] = fdNames[i]
+		case i < len(systemdNames):
+			names[i] = systemdNames[i]
+		default:
+			names[i] = "fd" + strconv.Itoa(firstFD+i)
+		}
+	}
+	return names, nil
+}
+
+// Listen returns the inherited listener called name, or a new TCP listener
+// on addr when there is none. The listener is handed over on upgrade.
+func (u *Upgrader) Listen(name, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ln, ok := u.inherited[name]
+	if ok {
+		delete(u.inherited, name)
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	u.listeners = append(u.listeners, namedListener{name: name, ln: ln})
+	return ln, nil
+}
+
+// Ready tells the process that started this one, if any, that its
+// listeners are being served. Inherited listeners not taken by Listen are
+// closed.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, ln := range u.inherited {
+		ln.Close()
+		delete(u.inherited, name)
+	}
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+// Upgrade starts a new process from the current executable with the same
+// arguments, hands it the listeners and waits until it is ready. A new
+// process exiting or not ready within ReadyTimeout is killed, and this one
+// keeps serving. After a successful upgrade the listeners of this process
+// are closed, so servers return net.ErrClosed, and Upgraded is closed; the
+// caller should drain and exit.
+func (u *Upgrader) Upgrade() error {
+	cmd, ready, err := u.start()
+	if err != nil {
+		return err
+	}
+	timeout := u.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadyTimeout
+	}
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = errors.New("handoff: new process exited before it was ready")
+		}
+	case <-time.After(timeout):
+		err = fmt.Errorf("handoff: new process not ready after %s", timeout)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		cmd.Process.Kill()
+		u.child = nil
+		return err
+	}
+	// The new process accepts the connections from now on. Requests on the
+	// connections this process accepted last get a moment to arrive: a
+	// server shutting down drops connections that have not sent one yet.
+	for _, l := range u.listeners {
+		l.ln.Close()
+	}
+	time.Sleep(acceptGrace)
+	close(u.upgraded)
+	return nil
+}
+
+// start starts the new process with the listeners and returns it with a
+// channel receiving the outcome of its readiness report. The new process
+// is recorded as in flight until Upgrade settles, so that a concurrent
+// Upgrade fails instead of starting another one.
+func (u *Upgrader) start() (*exec.Cmd, <-chan error, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if runtime.GOOS == "windows" {
+		return nil, nil, errors.New("handoff: upgrades are not supported on windows")
+	}
+	select {
+	case <-u.upgraded:
+		return nil, nil, errors.New("handoff: already upgraded")
+	default:
+	}
+	if u.child != nil {
+		return nil, nil, errors.New("handoff: upgrade already in progress")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, fmt.Errorf("handoff: %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, 0, len(u.listeners))
+	for _, l := range u.listeners {
+		fl, ok := l.ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, nil, fmt.Errorf("handoff: listener %q cannot be handed over", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, nil, fmt.Errorf("handoff: listener %q: %w", l.name, err)
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("handoff: %w", err)
+	}
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	if u.Output != nil {
+		cmd.Stdout, cmd.Stderr = u.Output, u.Output
+	} else {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	cmd.ExtraFiles = files
+	cmd.Env = append(childEnv(),
+		EnvListenFDs+"="+strings.Join(names, ","),
+		EnvReadyFD+"="+strconv.Itoa(firstFD+len(names)),
+	)
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return nil, nil, fmt.Errorf("handoff: start %s: %w", exe, err)
+	}
+	w.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+	u.child = cmd.Process
+
+	ready := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		_, err := io.ReadFull(r, make([]byte, 1))
+		ready <- err
+	}()
+	return cmd, ready, nil
+}
+
+// Upgraded is closed once a new process has taken over the listeners.
+func (u *Upgrader) Upgraded() <-chan struct{} {
+	return u.upgraded
+}
+
+// childEnv returns the environment of the new process, without the
+// variables describing the inherited file descriptors of this one.
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		switch k {
+		case EnvListenFDs, EnvReadyFD, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES":
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,186 @@
+package handoff
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envChild makes the test binary act as the upgraded process: "serve"
+// serves the inherited listener, "fail" exits before being ready and
+// "stall" never gets ready.
+const envChild = "HANDOFF_TEST_CHILD"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(envChild) {
+	case "serve":
+		runChild()
+	case "fail":
+		os.Exit(1)
+	case "stall":
+		time.Sleep(time.Minute)
+		os.Exit(1)
+	default:
+		os.Exit(m.Run())
+	}
+}
+
+// runChild serves "child" on the inherited gateway listener until the
+// parent closes its stdin.
+func runChild() {
+	if os.Getenv(EnvListenFDs) != "gateway" {
+		os.Exit(2)
+	}
+	u, err := New()
+	if err != nil {
+		os.Exit(1)
+	}
+	ln, err := u.Listen("gateway", "")
+	if err != nil {
+		os.Exit(2)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "child")
+	}))
+	if err := u.Ready(); err != nil {
+		os.Exit(3)
+	}
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrades are not supported on windows")
+	}
+	u, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := u.Listen("gateway", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "parent")
+	}))
+	url := "http://" + ln.Addr().String() + "/"
+	get := func() string {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if got := get(); got != "parent" {
+		t.Fatalf("expected the parent to serve before the upgrade, got %q", got)
+	}
+
+	// A new process failing before it is ready leaves this one serving.
+	t.Setenv(envChild, "fail")
+	if err := u.Upgrade(); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	if got := get(); got != "parent" {
+		t.Fatalf("expected the parent to keep serving after a failed upgrade, got %q", got)
+	}
+
+	// An upgrade waiting for its new process holds off another one, but
+	// not the rest of the Upgrader.
+	t.Setenv(envChild, "stall")
+	u.ReadyTimeout = time.Second
+	u.Output = os.Stderr
+	stalled := make(chan error, 1)
+	go func() { stalled <- u.Upgrade() }()
+	for inFlight := false; !inFlight; {
+		time.Sleep(10 * time.Millisecond)
+		u.mu.Lock()
+		inFlight = u.child != nil
+		u.mu.Unlock()
+	}
+	if err := u.Upgrade(); err == nil || !strings.Contains(err.Error(), "in progress") {
+		t.Fatalf("expected an upgrade in progress to be rejected, got %v", err)
+	}
+	if err := u.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stalled; err == nil {
+		t.Fatal("expected the stalled upgrade to time out")
+	}
+	if got := get(); got != "parent" {
+		t.Fatalf("expected the parent to keep serving after a timed out upgrade, got %q", got)
+	}
+	u.ReadyTimeout, u.Output = 0, nil
+
+	t.Setenv(envChild, "serve")
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	orig := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = orig }()
+	if err := u.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-u.Upgraded():
+	default:
+		t.Error("expected Upgraded to be closed")
+	}
+	http.DefaultClient.CloseIdleConnections()
+	if got := get(); got != "child" {
+		t.Errorf("expected the new process to serve after the upgrade, got %q", got)
+	}
+	if err := u.Upgrade(); err == nil {
+		t.Error("expected a second upgrade to fail")
+	}
+	w.Close()
+	done := make(chan struct{})
+	go func() {
+		u.child.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		u.child.Kill()
+	}
+}
+
+func TestInheritedNames(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		env  map[string]string
+		want []string
+	}{
+		{map[string]string{}, nil},
+		{map[string]string{EnvListenFDs: "gateway,server,redirect"}, []string{"gateway", "server", "redirect"}},
+		{map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2"}, []string{"gateway", "server"}},
+		{map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "2", "LISTEN_FDNAMES": "server:gateway"}, []string{"server", "gateway"}},
+		{map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "3"}, []string{"gateway", "server", "fd5"}},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"}, nil},
+	}
+	for _, tt := range tests {
+		for _, k := range []string{EnvListenFDs, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			t.Setenv(k, tt.env[k])
+		}
+		got, err := inheritedNames()
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, %v; want %v", tt.env, got, err, tt.want)
+		}
+	}
+	t.Setenv("LISTEN_PID", pid)
+	t.Setenv("LISTEN_FDS", "x")
+	if _, err := inheritedNames(); err == nil {
+		t.Error("expected an error for an invalid LISTEN_FDS")
+	}
+}
@@ -36,6 +36,13 @@ type TrafficEvent struct {
 	Country         string
 	IP              string
 	Action          string
+	Route           string
+	Params          map[string]string
+	Upstream        string
+	Version         string
+	Protocol        string
+	UpstreamProto   string
+	Cache           string
 }
 
 const (
@@ -85,45 +92,3 @@ func (b *Broadcaster) StatsChan() <-chan SystemStats {
 func (b *Broadcaster) Stop() {
 	close(b.stopChan)
 }
-
-// Collector gathers system vitals
-type Collector struct {
-	Hub      *Broadcaster
-	interval time.Duration
-	stop     chan struct{}
-}
-
-func NewCollector(h *Broadcaster, interval time.Duration) *Collector {
-	return &Collector{
-		Hub:      h,
-		interval: interval,
-		stop:     make(chan struct{}),
-	}
-}
-
-func (c *Collector) Start() {
-	ticker := time.NewTicker(c.interval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				// Gather real stats here in a real app (using gopsutil or /proc)
-				// For now, we emit enriched mock data to power the premium UI
-				c.Hub.PublishStats(SystemStats{
-					Uptime:        time.Hour * 1, // mock
-					CPUUsage:      0.45,          // mock
-					MemoryUsageMB: 1240,          // mock
-					ActiveConns:   42,            // mock
-					GeoThreats:    map[string]int{"CN": 5, "RU": 2, "US": 1},
-				})
-			case <-c.stop:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
-}
-
-func (c *Collector) Stop() {
-	close(c.stop)
-}
@@ -1,6 +1,7 @@
 package meter
 
 import (
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,8 +14,18 @@ type Meter struct {
 	requestCnt      *prometheus.CounterVec
 	requestLat      *prometheus.HistogramVec
 	backendLat      *prometheus.HistogramVec
+	ttfb            *prometheus.HistogramVec
 	usageTotal      prometheus.Counter
 	rateLimitHits   prometheus.Counter
+	circuitOpen     *prometheus.CounterVec
+	retries         *prometheus.CounterVec
+	retryBudget     prometheus.Counter
+	grpcRequests    *prometheus.CounterVec
+	wsActive        *prometheus.GaugeVec
+	wsDuration      *prometheus.HistogramVec
+	wsBytes         *prometheus.CounterVec
+	wsMessages      *prometheus.CounterVec
+	cacheRequests   *prometheus.CounterVec
 }
 
 func New(s *store.Store, reg prometheus.Registerer) *Meter {
@@ -39,6 +50,14 @@ func New(s *store.Store, reg prometheus.Registerer) *Meter {
 			Help:    "Backend-only latency in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
+		[]string{"backend", "path_prefix", "upstream"},
+	)
+	ttfb := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "apim_request_ttfb_seconds",
+			Help:    "Time until the first response byte is sent to the client in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
 		[]string{"backend", "path_prefix"},
 	)
 	usageTotal := prometheus.NewCounter(
@@ -53,42 +72,193 @@ func New(s *store.Store, reg prometheus.Registerer) *Meter {
 			Help: "Total requests rejected by rate limiter",
 		},
 	)
+	circuitOpen := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_circuit_open_total",
+			Help: "Total requests rejected because every upstream circuit was open",
+		},
+		[]string{"backend"},
+	)
+	retries := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_upstream_retries_total",
+			Help: "Total upstream retries",
+		},
+		[]string{"backend"},
+	)
+	retryBudget := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "apim_retry_budget_exhausted_total",
+			Help: "Total retries skipped because the retry budget was spent",
+		},
+	)
+	grpcRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_grpc_requests_total",
+			Help: "Total gRPC requests by grpc-status code",
+		},
+		[]string{"backend", "path_prefix", "grpc_code"},
+	)
+	wsActive := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "apim_websocket_connections",
+			Help: "Open WebSocket connections",
+		},
+		[]string{"backend"},
+	)
+	wsDuration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "apim_websocket_connection_duration_seconds",
+			Help:    "Lifetime of closed WebSocket connections in seconds",
+			Buckets: []float64{1, 5, 30, 60, 300, 900, 1800, 3600, 14400},
+		},
+		[]string{"backend"},
+	)
+	wsBytes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_websocket_bytes_total",
+			Help: "Total WebSocket bytes; direction is in (client to backend) or out",
+		},
+		[]string{"backend", "direction"},
+	)
+	wsMessages := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_websocket_messages_total",
+			Help: "Total WebSocket data messages; direction is in (client to backend) or out",
+		},
+		[]string{"backend", "direction"},
+	)
+	cacheRequests := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apim_cache_requests_total",
+			Help: "Total requests to APIs with a response cache by result: hit, miss, revalidated or bypass",
+		},
+		[]string{"backend", "result"},
+	)
 	if reg != nil {
-		reg.MustRegister(requestCnt, requestLat, backendLat, usageTotal, rateLimitHits)
+		reg.MustRegister(requestCnt, requestLat, backendLat, ttfb, usageTotal, rateLimitHits, circuitOpen, retries, retryBudget, grpcRequests,
+			wsActive, wsDuration, wsBytes, wsMessages, cacheRequests)
 	}
 	return &Meter{
 		store:         s,
 		requestCnt:    requestCnt,
 		requestLat:    requestLat,
 		backendLat:    backendLat,
+		ttfb:          ttfb,
 		usageTotal:    usageTotal,
 		rateLimitHits: rateLimitHits,
+		circuitOpen:   circuitOpen,
+		retries:       retries,
+		retryBudget:   retryBudget,
+		grpcRequests:  grpcRequests,
+		wsActive:      wsActive,
+		wsDuration:    wsDuration,
+		wsBytes:       wsBytes,
+		wsMessages:    wsMessages,
+		cacheRequests: cacheRequests,
 	}
 }
 
-func (m *Meter) Record(backend, pathPrefix, method string, status int, totalMs, backendMs int64, subID, apiDefID int64, tenantID string) {
-	m.requestCnt.WithLabelValues(backend, method, pathPrefix, statusLabel(status)).Inc()
-	m.requestLat.WithLabelValues(backend, pathPrefix).Observe(float64(totalMs) / 1000.0)
-	if backendMs > 0 {
-		m.backendLat.WithLabelValues(backend, pathPrefix).Observe(float64(backendMs) / 1000.0)
+// Request describes one request handled by the gateway. HasTTFB tells
+// whether TTFBMs was measured: requests rejected before they are proxied
+// have no time to first byte.
+type Request struct {
+	Backend         string
+	PathPrefix      string
+	Method          string
+	Status          int
+	TotalMs         int64
+	BackendMs       int64
+	TTFBMs          int64
+	HasTTFB         bool
+	SubscriptionID  int64
+	ApiDefinitionID int64
+	TenantID        string
+	Upstream        string
+	Retries         int
+	GrpcStatus      string
+	ResponseBytes   int64
+	SentBytes       int64
+}
+
+func (m *Meter) Record(r Request) {
+	m.requestCnt.WithLabelValues(r.Backend, r.Method, r.PathPrefix, statusLabel(r.Status)).Inc()
+	if r.GrpcStatus != "" {
+		m.grpcRequests.WithLabelValues(r.Backend, r.PathPrefix, r.GrpcStatus).Inc()
+	}
+	m.requestLat.WithLabelValues(r.Backend, r.PathPrefix).Observe(float64(r.TotalMs) / 1000.0)
+	if r.HasTTFB {
+		m.ttfb.WithLabelValues(r.Backend, r.PathPrefix).Observe(float64(r.TTFBMs) / 1000.0)
+	}
+	if r.BackendMs > 0 {
+		m.backendLat.WithLabelValues(r.Backend, r.PathPrefix, r.Upstream).Observe(float64(r.BackendMs) / 1000.0)
+	}
+	if r.Retries > 0 {
+		m.retries.WithLabelValues(r.Backend).Add(float64(r.Retries))
 	}
 	m.store.RecordUsage(store.RequestUsage{
-		SubscriptionID:  subID,
-		ApiDefinitionID: apiDefID,
-		TenantID:        tenantID,
-		Method:          method,
-		Path:            pathPrefix,
-		StatusCode:      status,
-		ResponseTimeMs:  totalMs,
-		BackendTimeMs:   backendMs,
+		SubscriptionID:  r.SubscriptionID,
+		ApiDefinitionID: r.ApiDefinitionID,
+		TenantID:        r.TenantID,
+		Method:          r.Method,
+		Path:            r.PathPrefix,
+		StatusCode:      r.Status,
+		ResponseTimeMs:  r.TotalMs,
+		BackendTimeMs:   r.BackendMs,
+		TTFBMs:          r.TTFBMs,
+		Upstream:        r.Upstream,
+		Retries:         r.Retries,
+		GrpcStatus:      r.GrpcStatus,
+		ResponseBytes:   r.ResponseBytes,
+		SentBytes:       r.SentBytes,
 	})
 	m.usageTotal.Inc()
 }
 
+// WebSocket describes a closed WebSocket connection. In counts traffic from
+// the client to the backend, Out the other way.
+type WebSocket struct {
+	Backend     string
+	Duration    time.Duration
+	BytesIn     int64
+	BytesOut    int64
+	MessagesIn  int64
+	MessagesOut int64
+}
+
+// WebSocketOpened counts an upgraded connection as open until the matching
+// RecordWebSocket.
+func (m *Meter) WebSocketOpened(backend string) {
+	m.wsActive.WithLabelValues(backend).Inc()
+}
+
+func (m *Meter) RecordWebSocket(ws WebSocket) {
+	m.wsActive.WithLabelValues(ws.Backend).Dec()
+	m.wsDuration.WithLabelValues(ws.Backend).Observe(ws.Duration.Seconds())
+	m.wsBytes.WithLabelValues(ws.Backend, "in").Add(float64(ws.BytesIn))
+	m.wsBytes.WithLabelValues(ws.Backend, "out").Add(float64(ws.BytesOut))
+	m.wsMessages.WithLabelValues(ws.Backend, "in").Add(float64(ws.MessagesIn))
+	m.wsMessages.WithLabelValues(ws.Backend, "out").Add(float64(ws.MessagesOut))
+}
+
+// RecordCache counts a request served by an API with a response cache;
+// result is the X-Cache value, such as HIT or MISS.
+func (m *Meter) RecordCache(backend, result string) {
+	m.cacheRequests.WithLabelValues(backend, strings.ToLower(result)).Inc()
+}
+
 func (m *Meter) IncrementRateLimit() {
 	m.rateLimitHits.Inc()
 }
 
+func (m *Meter) IncrementCircuitOpen(backend string) {
+	m.circuitOpen.WithLabelValues(backend).Inc()
+}
+
+func (m *Meter) IncrementRetryBudgetExhausted() {
+	m.retryBudget.Inc()
+}
+
 func statusLabel(code int) string {
 	if code >= 200 && code < 300 {
 		return "2xx"
@@ -0,0 +1,53 @@
+package meter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/navantesolutions/apimcore/internal/store"
+)
+
+func TestMeter_RecordTTFB(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		want uint64
+	}{
+		{"Measured", Request{Backend: "orders", PathPrefix: "/orders", Method: "GET", Status: 200, Upstream: "orders:8080", TTFBMs: 12, HasTTFB: true}, 1},
+		{"Measured Under A Millisecond", Request{Backend: "orders", PathPrefix: "/orders", Method: "GET", Status: 200, HasTTFB: true}, 1},
+		{"Rejected Before Proxying", Request{Backend: "orders", PathPrefix: "/orders", Method: "GET", Status: 400, Upstream: "orders:8080", TTFBMs: 3}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			st := store.NewStore()
+			New(st, reg).Record(tt.req)
+			if got := ttfbCount(t, reg); got != tt.want {
+				t.Errorf("expected %d TTFB observations, got %d", tt.want, got)
+			}
+			if usage := st.UsageSince(time.Time{}); len(usage) != 1 {
+				t.Errorf("expected the request in usage either way, got %d records", len(usage))
+			}
+		})
+	}
+}
+
+func ttfbCount(t *testing.T, reg *prometheus.Registry) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	for _, f := range families {
+		if f.GetName() != "apim_request_ttfb_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			n += m.GetHistogram().GetSampleCount()
+		}
+	}
+	return n
+}
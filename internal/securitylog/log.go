@@ -17,6 +17,8 @@ const asyncBuffer = 2000
 
 type Logger interface {
 	Append(ev hub.TrafficEvent)
+	// Close writes the events still queued and returns once the file or
+	// database is closed.
 	Close() error
 }
 
@@ -32,9 +34,10 @@ func New(path string) (Logger, error) {
 }
 
 type fileLogger struct {
-	ch   chan hub.TrafficEvent
-	done chan struct{}
-	once sync.Once
+	ch      chan hub.TrafficEvent
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
 }
 
 func newFile(path string) (Logger, error) {
@@ -42,12 +45,13 @@ func newFile(path string) (Logger, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := &fileLogger{ch: make(chan hub.TrafficEvent, asyncBuffer), done: make(chan struct{})}
+	l := &fileLogger{ch: make(chan hub.TrafficEvent, asyncBuffer), done: make(chan struct{}), stopped: make(chan struct{})}
 	go l.runFile(f)
 	return l, nil
 }
 
 func (l *fileLogger) runFile(f *os.File) {
+	defer close(l.stopped)
 	defer f.Close()
 	for {
 		select {
@@ -81,6 +85,7 @@ func (l *fileLogger) Close() error {
 	l.once.Do(func() {
 		close(l.done)
 	})
+	<-l.stopped
 	return nil
 }
 
@@ -109,10 +114,11 @@ const createTableSQL = `CREATE TABLE IF NOT EXISTS security_events (
 );`
 
 type sqliteLogger struct {
-	ch   chan hub.TrafficEvent
-	done chan struct{}
-	once sync.Once
-	db   *sql.DB
+	ch      chan hub.TrafficEvent
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	db      *sql.DB
 }
 
 func newSQLite(dbPath string) (Logger, error) {
@@ -125,15 +131,17 @@ func newSQLite(dbPath string) (Logger, error) {
 		return nil, err
 	}
 	l := &sqliteLogger{
-		ch:   make(chan hub.TrafficEvent, asyncBuffer),
-		done: make(chan struct{}),
-		db:   db,
+		ch:      make(chan hub.TrafficEvent, asyncBuffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		db:      db,
 	}
 	go l.runSQLite()
 	return l, nil
 }
 
 func (l *sqliteLogger) runSQLite() {
+	defer close(l.stopped)
 	insert, err := l.db.Prepare(`INSERT INTO security_events (time, action, ip, country, method, path, status, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return
@@ -188,6 +196,7 @@ func (l *sqliteLogger) Close() error {
 	l.once.Do(func() {
 		close(l.done)
 	})
+	<-l.stopped
 	return nil
 }
 
@@ -240,9 +249,10 @@ func eventLineAny(ev hub.TrafficEvent) []byte {
 }
 
 type allTrafficFileLogger struct {
-	ch   chan hub.TrafficEvent
-	done chan struct{}
-	once sync.Once
+	ch      chan hub.TrafficEvent
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
 }
 
 func NewFileLoggerAll(path string) (Logger, error) {
@@ -253,12 +263,13 @@ func NewFileLoggerAll(path string) (Logger, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := &allTrafficFileLogger{ch: make(chan hub.TrafficEvent, asyncBuffer), done: make(chan struct{})}
+	l := &allTrafficFileLogger{ch: make(chan hub.TrafficEvent, asyncBuffer), done: make(chan struct{}), stopped: make(chan struct{})}
 	go l.run(f)
 	return l, nil
 }
 
 func (l *allTrafficFileLogger) run(f *os.File) {
+	defer close(l.stopped)
 	defer f.Close()
 	for {
 		select {
@@ -290,6 +301,7 @@ func (l *allTrafficFileLogger) Close() error {
 		return nil
 	}
 	l.once.Do(func() { close(l.done) })
+	<-l.stopped
 	return nil
 }
 
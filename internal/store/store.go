@@ -3,7 +3,9 @@ package store
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,10 +34,43 @@ type ApiDefinition struct {
 	Version          string
 	AddHeaders       map[string]string
 	StripPathPrefix  bool
+	Path             string
+	Methods          []string
+	RewritePath      string
+	Upstreams        []config.UpstreamConfig
+	LoadBalancing    config.LoadBalancingConfig
+	HealthCheck      *config.HealthCheckConfig
+	CircuitBreaker   *config.CircuitBreakerConfig
+	Retry            *config.RetryConfig
+	Canary           *config.CanaryConfig
+	Deprecation      *config.DeprecationConfig
+	Mirror           *config.MirrorConfig
+	Rewrite          *config.RewriteConfig
+	Response         *config.ResponseConfig
+	Timeouts         *config.TimeoutsConfig
+	ConnectionPool   *config.ConnectionPoolConfig
+	Protocol         string
+	Transcoding      *config.TranscodingConfig
+	WebSocket        *config.WebSocketConfig
+	Streaming        bool
+	FlushIntervalMs  int
+	MTLS             string
+	UpstreamTLS      *config.UpstreamTLSConfig
+	Cache            *config.CacheConfig
+	Compression      *config.CompressionConfig
 	CreatedAt        time.Time
 	UpdatedAt        time.Time
 }
 
+// Route returns the label identifying the route of the definition in
+// metrics: its path template when set, otherwise its path prefix.
+func (d *ApiDefinition) Route() string {
+	if d.Path != "" {
+		return d.Path
+	}
+	return d.PathPrefix
+}
+
 type Subscription struct {
 	ID              int64
 	ProductID       int64
@@ -48,6 +83,20 @@ type Subscription struct {
 	UpdatedAt       time.Time
 }
 
+// ClientCertificate binds client certificates to a subscription. Exactly
+// one of Fingerprint (lowercase hex SHA-256 of the DER certificate),
+// Subject or SAN is set.
+type ClientCertificate struct {
+	ID             int64
+	SubscriptionID int64
+	Name           string
+	Fingerprint    string
+	Subject        string
+	SAN            string
+	Active         bool
+	CreatedAt      time.Time
+}
+
 type ApiKey struct {
 	ID             int64
 	SubscriptionID int64
@@ -59,6 +108,9 @@ type ApiKey struct {
 	LastUsedAt     time.Time
 }
 
+// RequestUsage is one request served by the gateway. ResponseBytes is the
+// size of the response body before compression and SentBytes the size sent
+// to the client; they differ only for compressed responses.
 type RequestUsage struct {
 	ID              int64
 	SubscriptionID  int64
@@ -69,6 +121,33 @@ type RequestUsage struct {
 	StatusCode      int
 	ResponseTimeMs  int64
 	BackendTimeMs   int64
+	TTFBMs          int64
+	Upstream        string
+	Retries         int
+	GrpcStatus      string
+	ResponseBytes   int64
+	SentBytes       int64
+	RequestedAt     time.Time
+}
+
+// MirrorResult is the outcome of one shadow request, recorded next to the
+// status and latency of the primary response it mirrors. Diff summarizes
+// the differences when response comparison is enabled; empty means the
+// responses matched.
+type MirrorResult struct {
+	ID              int64
+	ApiDefinitionID int64
+	Api             string
+	Method          string
+	Path            string
+	Target          string
+	PrimaryStatus   int
+	ShadowStatus    int
+	PrimaryMs       int64
+	ShadowMs        int64
+	Error           string
+	Compared        bool
+	Diff            string
 	RequestedAt     time.Time
 }
 
@@ -79,12 +158,17 @@ type Store struct {
 	subscriptions map[int64]*Subscription
 	keysByHash    map[string]*ApiKey
 	keysByPrefix  map[string]*ApiKey
+	clientCerts   map[int64]*ClientCertificate
 	usage         []RequestUsage
+	mirrors       []MirrorResult
 	nextProduct   int64
 	nextDef       int64
 	nextSub       int64
 	nextKey       int64
+	nextCert      int64
 	nextUsage     int64
+	nextMirror    int64
+	defsRevision  uint64
 }
 
 func NewStore() *Store {
@@ -94,12 +178,15 @@ func NewStore() *Store {
 		subscriptions: make(map[int64]*Subscription),
 		keysByHash:    make(map[string]*ApiKey),
 		keysByPrefix:  make(map[string]*ApiKey),
+		clientCerts:   make(map[int64]*ClientCertificate),
 		usage:         make([]RequestUsage, 0, 10000),
 		nextProduct:   1,
 		nextDef:       1,
 		nextSub:       1,
 		nextKey:       1,
+		nextCert:      1,
 		nextUsage:     1,
+		nextMirror:    1,
 	}
 }
 
@@ -111,10 +198,13 @@ func (s *Store) Reset() {
 	s.subscriptions = make(map[int64]*Subscription)
 	s.keysByHash = make(map[string]*ApiKey)
 	s.keysByPrefix = make(map[string]*ApiKey)
+	s.clientCerts = make(map[int64]*ClientCertificate)
+	s.defsRevision++
 	s.nextProduct = 1
 	s.nextDef = 1
 	s.nextSub = 1
 	s.nextKey = 1
+	s.nextCert = 1
 }
 
 func (s *Store) PopulateFromConfig(cfg *config.Config) {
@@ -133,18 +223,7 @@ func (s *Store) PopulateFromConfig(cfg *config.Config) {
 		productSlugToID[pc.Slug] = id
 
 		for _, ac := range pc.Apis {
-			d := &ApiDefinition{
-				ProductID:       id,
-				Name:            ac.Name,
-				Host:            ac.Host,
-				PathPrefix:      ac.PathPrefix,
-				BackendURL:      ac.BackendURL,
-				OpenAPISpecURL:  ac.OpenAPISpecURL,
-				Version:         ac.Version,
-				AddHeaders:      copyStringMap(ac.AddHeaders),
-				StripPathPrefix: ac.StripPathPrefix,
-			}
-			s.CreateDefinition(d)
+			s.CreateDefinition(DefinitionFromConfig(id, ac))
 		}
 	}
 
@@ -177,6 +256,60 @@ func (s *Store) PopulateFromConfig(cfg *config.Config) {
 			}
 			s.CreateApiKey(k)
 		}
+		for _, cc := range sc.ClientCertificates {
+			c := &ClientCertificate{SubscriptionID: subID, Name: cc.Name, Active: true}
+			switch {
+			case cc.Fingerprint != "":
+				c.Fingerprint = NormalizeFingerprint(cc.Fingerprint)
+			case cc.Subject != "":
+				c.Subject = cc.Subject
+			case cc.SAN != "":
+				c.SAN = cc.SAN
+			default:
+				continue
+			}
+			s.CreateClientCertificate(c)
+		}
+	}
+}
+
+// DefinitionFromConfig converts an API entry of the config file into an
+// ApiDefinition belonging to productID.
+func DefinitionFromConfig(productID int64, ac config.ApiConfig) *ApiDefinition {
+	return &ApiDefinition{
+		ProductID:       productID,
+		Name:            ac.Name,
+		Host:            ac.Host,
+		PathPrefix:      ac.PathPrefix,
+		BackendURL:      ac.BackendURL,
+		OpenAPISpecURL:  ac.OpenAPISpecURL,
+		Version:         ac.Version,
+		AddHeaders:      copyStringMap(ac.AddHeaders),
+		StripPathPrefix: ac.StripPathPrefix,
+		Path:            ac.Path,
+		Methods:         copyStrings(ac.Methods),
+		RewritePath:     ac.RewritePath,
+		Upstreams:       append([]config.UpstreamConfig(nil), ac.Upstreams...),
+		LoadBalancing:   ac.LoadBalancing,
+		HealthCheck:     cloneHealthCheck(ac.HealthCheck),
+		CircuitBreaker:  cloneCircuitBreaker(ac.CircuitBreaker),
+		Retry:           cloneRetry(ac.Retry),
+		Canary:          cloneCanary(ac.Canary),
+		Deprecation:     cloneDeprecation(ac.Deprecation),
+		Mirror:          cloneMirror(ac.Mirror),
+		Rewrite:         cloneRewrite(ac.Rewrite),
+		Response:        cloneResponse(ac.Response),
+		Timeouts:        cloneTimeouts(ac.Timeouts),
+		ConnectionPool:  cloneConnectionPool(ac.ConnectionPool),
+		Protocol:        ac.Protocol,
+		Transcoding:     cloneTranscoding(ac.Transcoding),
+		WebSocket:       cloneWebSocket(ac.WebSocket),
+		Streaming:       ac.Streaming,
+		FlushIntervalMs: ac.FlushIntervalMs,
+		MTLS:            ac.MTLS,
+		UpstreamTLS:     cloneUpstreamTLS(ac.UpstreamTLS),
+		Cache:           cloneCache(ac.Cache),
+		Compression:     cloneCompression(ac.Compression),
 	}
 }
 
@@ -220,9 +353,18 @@ func (s *Store) CreateDefinition(d *ApiDefinition) int64 {
 	d.CreatedAt = time.Now()
 	d.UpdatedAt = d.CreatedAt
 	s.definitions[d.ID] = cloneDefinition(d)
+	s.defsRevision++
 	return d.ID
 }
 
+// DefinitionsRevision changes every time the set of API definitions changes.
+// Callers caching data derived from definitions use it to detect staleness.
+func (s *Store) DefinitionsRevision() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.defsRevision
+}
+
 func (s *Store) GetDefinition(id int64) *ApiDefinition {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -314,6 +456,55 @@ func (s *Store) GetKeyByPrefix(prefix string) *ApiKey {
 	return cloneKey(s.keysByPrefix[prefix])
 }
 
+func (s *Store) CreateClientCertificate(c *ClientCertificate) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.ID = s.nextCert
+	s.nextCert++
+	c.CreatedAt = time.Now()
+	cp := *c
+	s.clientCerts[c.ID] = &cp
+	return c.ID
+}
+
+// FindClientCertificate returns the client certificate binding matching a
+// certificate fingerprint, subject or SAN, in that order of precedence.
+func (s *Store) FindClientCertificate(fingerprint, subject string, sans []string) *ClientCertificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var bySubject, bySAN *ClientCertificate
+	for _, c := range s.clientCerts {
+		switch {
+		case c.Fingerprint != "" && c.Fingerprint == fingerprint:
+			cp := *c
+			return &cp
+		case c.Subject != "" && c.Subject == subject:
+			if bySubject == nil || c.ID < bySubject.ID {
+				bySubject = c
+			}
+		case c.SAN != "" && slices.Contains(sans, c.SAN):
+			if bySAN == nil || c.ID < bySAN.ID {
+				bySAN = c
+			}
+		}
+	}
+	match := bySubject
+	if match == nil {
+		match = bySAN
+	}
+	if match == nil {
+		return nil
+	}
+	cp := *match
+	return &cp
+}
+
+// NormalizeFingerprint returns a certificate fingerprint as lowercase hex
+// without separators.
+func NormalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+}
+
 func (s *Store) GetKeyByID(id int64) *ApiKey {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -348,6 +539,32 @@ func (s *Store) RecordUsage(u RequestUsage) {
 	}
 }
 
+func (s *Store) RecordMirror(m MirrorResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.ID = s.nextMirror
+	s.nextMirror++
+	if m.RequestedAt.IsZero() {
+		m.RequestedAt = time.Now()
+	}
+	s.mirrors = append(s.mirrors, m)
+	if len(s.mirrors) > 20000 {
+		s.mirrors = s.mirrors[len(s.mirrors)-10000:]
+	}
+}
+
+func (s *Store) MirrorResultsSince(since time.Time) []MirrorResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []MirrorResult
+	for _, m := range s.mirrors {
+		if !m.RequestedAt.Before(since) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
 func (s *Store) UsageSince(since time.Time) []RequestUsage {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -526,6 +743,21 @@ func (s *Store) AvgBackendVsGatewaySince(since time.Time) (avgBackendMs, avgGate
 	return float64(sumBackend) / float64(count), float64(sumGateway) / float64(count), count
 }
 
+// ResponseBytesSince returns the response bytes before and after
+// compression since the given time, and the number of requests.
+func (s *Store) ResponseBytesSince(since time.Time) (responseBytes, sentBytes int64, count int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.usage {
+		if !u.RequestedAt.Before(since) {
+			count++
+			responseBytes += u.ResponseBytes
+			sentBytes += u.SentBytes
+		}
+	}
+	return responseBytes, sentBytes, count
+}
+
 func cloneProduct(p *ApiProduct) *ApiProduct {
 	if p == nil {
 		return nil
@@ -545,12 +777,186 @@ func copyStringMap(m map[string]string) map[string]string {
 	return out
 }
 
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
 func cloneDefinition(d *ApiDefinition) *ApiDefinition {
 	if d == nil {
 		return nil
 	}
 	c := *d
 	c.AddHeaders = copyStringMap(d.AddHeaders)
+	c.Methods = copyStrings(d.Methods)
+	c.Upstreams = append([]config.UpstreamConfig(nil), d.Upstreams...)
+	c.HealthCheck = cloneHealthCheck(d.HealthCheck)
+	c.CircuitBreaker = cloneCircuitBreaker(d.CircuitBreaker)
+	c.Retry = cloneRetry(d.Retry)
+	c.Canary = cloneCanary(d.Canary)
+	c.Deprecation = cloneDeprecation(d.Deprecation)
+	c.Mirror = cloneMirror(d.Mirror)
+	c.Rewrite = cloneRewrite(d.Rewrite)
+	c.Response = cloneResponse(d.Response)
+	c.Timeouts = cloneTimeouts(d.Timeouts)
+	c.ConnectionPool = cloneConnectionPool(d.ConnectionPool)
+	c.Transcoding = cloneTranscoding(d.Transcoding)
+	c.WebSocket = cloneWebSocket(d.WebSocket)
+	c.UpstreamTLS = cloneUpstreamTLS(d.UpstreamTLS)
+	c.Cache = cloneCache(d.Cache)
+	c.Compression = cloneCompression(d.Compression)
+	return &c
+}
+
+func cloneCompression(cc *config.CompressionConfig) *config.CompressionConfig {
+	if cc == nil {
+		return nil
+	}
+	c := *cc
+	c.Encodings = copyStrings(cc.Encodings)
+	c.ContentTypes = copyStrings(cc.ContentTypes)
+	return &c
+}
+
+func cloneCache(cc *config.CacheConfig) *config.CacheConfig {
+	if cc == nil {
+		return nil
+	}
+	c := *cc
+	c.KeyHeaders = copyStrings(cc.KeyHeaders)
+	return &c
+}
+
+func cloneUpstreamTLS(uc *config.UpstreamTLSConfig) *config.UpstreamTLSConfig {
+	if uc == nil {
+		return nil
+	}
+	c := *uc
+	c.CAFiles = copyStrings(uc.CAFiles)
+	return &c
+}
+
+func cloneWebSocket(wc *config.WebSocketConfig) *config.WebSocketConfig {
+	if wc == nil {
+		return nil
+	}
+	c := *wc
+	return &c
+}
+
+func cloneTranscoding(tc *config.TranscodingConfig) *config.TranscodingConfig {
+	if tc == nil {
+		return nil
+	}
+	c := *tc
+	c.Services = copyStrings(tc.Services)
+	return &c
+}
+
+func cloneConnectionPool(pc *config.ConnectionPoolConfig) *config.ConnectionPoolConfig {
+	if pc == nil {
+		return nil
+	}
+	c := *pc
+	return &c
+}
+
+func cloneTimeouts(tc *config.TimeoutsConfig) *config.TimeoutsConfig {
+	if tc == nil {
+		return nil
+	}
+	c := *tc
+	return &c
+}
+
+func cloneResponse(rc *config.ResponseConfig) *config.ResponseConfig {
+	if rc == nil {
+		return nil
+	}
+	c := *rc
+	c.Headers = cloneHeaderRules(rc.Headers)
+	if rc.StatusMap != nil {
+		c.StatusMap = make(map[int]int, len(rc.StatusMap))
+		for k, v := range rc.StatusMap {
+			c.StatusMap[k] = v
+		}
+	}
+	return &c
+}
+
+func cloneRewrite(rc *config.RewriteConfig) *config.RewriteConfig {
+	if rc == nil {
+		return nil
+	}
+	c := *rc
+	c.Path = append([]config.PathRewriteConfig(nil), rc.Path...)
+	c.RequestHeaders = cloneHeaderRules(rc.RequestHeaders)
+	c.AddQuery = copyStringMap(rc.AddQuery)
+	return &c
+}
+
+func cloneHeaderRules(hr config.HeaderRulesConfig) config.HeaderRulesConfig {
+	return config.HeaderRulesConfig{
+		Rename: copyStringMap(hr.Rename),
+		Remove: copyStrings(hr.Remove),
+		Set:    copyStringMap(hr.Set),
+		Add:    copyStringMap(hr.Add),
+	}
+}
+
+func cloneMirror(mc *config.MirrorConfig) *config.MirrorConfig {
+	if mc == nil {
+		return nil
+	}
+	c := *mc
+	return &c
+}
+
+func cloneDeprecation(dc *config.DeprecationConfig) *config.DeprecationConfig {
+	if dc == nil {
+		return nil
+	}
+	c := *dc
+	return &c
+}
+
+func cloneCanary(cc *config.CanaryConfig) *config.CanaryConfig {
+	if cc == nil {
+		return nil
+	}
+	c := *cc
+	c.Headers = copyStringMap(cc.Headers)
+	c.Plans = copyStrings(cc.Plans)
+	c.Tenants = copyStrings(cc.Tenants)
+	c.Developers = copyStrings(cc.Developers)
+	return &c
+}
+
+func cloneRetry(rc *config.RetryConfig) *config.RetryConfig {
+	if rc == nil {
+		return nil
+	}
+	c := *rc
+	c.RetryOnStatus = append([]int(nil), rc.RetryOnStatus...)
+	c.RetryOnErrors = copyStrings(rc.RetryOnErrors)
+	return &c
+}
+
+func cloneCircuitBreaker(cb *config.CircuitBreakerConfig) *config.CircuitBreakerConfig {
+	if cb == nil {
+		return nil
+	}
+	c := *cb
+	return &c
+}
+
+func cloneHealthCheck(hc *config.HealthCheckConfig) *config.HealthCheckConfig {
+	if hc == nil {
+		return nil
+	}
+	c := *hc
 	return &c
 }
 
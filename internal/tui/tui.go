@@ -137,6 +137,7 @@ type Model struct {
 	Hub           *hub.Broadcaster
 	RateLimited   int64
 	Blocked       int64
+	ActiveConns   int
 	GeoThreats    map[string]int
 
 	LastTotalRequests   int64
@@ -413,6 +414,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.RateLimited = msg.RateLimited
 		m.Blocked = msg.Blocked
+		m.ActiveConns = msg.ActiveConns
 		m.GeoThreats = msg.GeoThreats
 		return m, nil
 
@@ -565,10 +567,11 @@ func (m Model) dashboardView() string {
 		sparkData = []int64{0}
 	}
 	spark := m.renderSparkline(sparkData, sparkWidth)
-	trafficContent := fmt.Sprintf("Requests:  %s\nAvg Lat:   %s\nLimited:   %s\n\nPERFORMANCE TREND:\n%s",
+	trafficContent := fmt.Sprintf("Requests:  %s\nAvg Lat:   %s\nLimited:   %s\nConns:     %s\n\nPERFORMANCE TREND:\n%s",
 		infoStyle.Render(fmt.Sprintf("%d", m.TotalRequests)),
 		infoStyle.Render(fmt.Sprintf("%.2fms", m.AvgLatency)),
 		warningStyle.Render(fmt.Sprintf("%d", m.RateLimited)),
+		infoStyle.Render(fmt.Sprintf("%d", m.ActiveConns)),
 		specialStyle.Render(spark))
 
 	nodeID := m.NodeID
@@ -1068,6 +1071,36 @@ func (m Model) healthView() string {
 	health += fmt.Sprintf("DevPortal: %s\n", specialStyle.Render("OK"))
 	health += fmt.Sprintf("Store:     %s\n", specialStyle.Render("CONSISTENT"))
 
+	upstreams := m.Gateway.UpstreamHealth()
+	healthyCount := 0
+	for _, u := range upstreams {
+		if u.Healthy {
+			healthyCount++
+		}
+	}
+	if ready, _ := m.Gateway.Ready(); ready {
+		health += fmt.Sprintf("Ready:     %s\n", specialStyle.Render("YES"))
+	} else {
+		health += fmt.Sprintf("Ready:     %s\n", errorStyle.Render("NO"))
+	}
+	health += fmt.Sprintf("\nUPSTREAMS (%d/%d healthy):\n", healthyCount, len(upstreams))
+	maxUpstreamLines := row1Height - 10
+	for i, u := range upstreams {
+		if i >= maxUpstreamLines {
+			health += fmt.Sprintf("… %d more\n", len(upstreams)-i)
+			break
+		}
+		state := specialStyle.Render("UP")
+		if !u.Healthy {
+			state = errorStyle.Render("DOWN")
+		} else if u.Circuit == "open" {
+			state = errorStyle.Render("OPEN")
+		} else if !u.Checked {
+			state = lipgloss.NewStyle().Foreground(subtle).Render("N/A")
+		}
+		health += fmt.Sprintf("%-4s %s %s\n", state, truncateStr(u.Api, 10), truncateStr(u.Upstream, cardWidth-22))
+	}
+
 	since := time.Now().Add(-1 * time.Hour)
 	p95Ms, _ := m.Store.PercentileResponseTimeMsSince(since, 0.95)
 	p99Ms, _ := m.Store.PercentileResponseTimeMsSince(since, 0.99)